@@ -3,8 +3,10 @@
 package app
 
 import (
+	"fmt"
 	"github.com/Qitmeer/llama.go/config"
 	"github.com/Qitmeer/llama.go/server"
+	"github.com/Qitmeer/llama.go/system"
 	"github.com/Qitmeer/llama.go/wrapper"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/urfave/cli/v2"
@@ -12,11 +14,20 @@ import (
 	"time"
 )
 
+// reloadPollInterval is how often a reloading model is checked for readiness
+const reloadPollInterval = 100 * time.Millisecond
+
 type App struct {
 	ctx *cli.Context
 	cfg *config.Config
 	ser *server.Service
 	wg  sync.WaitGroup
+
+	// loadErr is set when the model fails to load in server mode
+	loadErr error
+
+	// reloadMu serializes the reloads and the shutdown of the runner
+	reloadMu sync.Mutex
 }
 
 func NewApp(ctx *cli.Context, cfg *config.Config) *App {
@@ -38,24 +49,24 @@ func (a *App) Start() error {
 	if err != nil {
 		return err
 	}
+	err = wrapper.LlamaCheckArgs(a.cfg)
+	if err != nil {
+		return err
+	}
+	err = a.loadPrompt()
+	if err != nil {
+		return err
+	}
 	if a.cfg.Interactive {
 		log.Debug("Run Interactive")
 		return wrapper.LlamaInteractive(a.cfg)
 	} else if a.cfg.IsLonely() {
-		log.Debug("Not support")
-		a.wg.Add(1)
-		go a.startLLama()
-		time.Sleep(time.Second)
-		content, err := wrapper.LlamaGenerate(a.cfg.Prompt)
-		if err != nil {
-			return err
-		}
-		log.Info(content)
-		return nil
+		return a.generateOnce()
 	} else {
 		a.wg.Add(1)
 		go a.startLLama()
 	}
+	a.ser.SetReloader(a.reload)
 	return a.ser.Start()
 }
 
@@ -65,23 +76,95 @@ func (a *App) startLLama() {
 	err := wrapper.LlamaStart(a.cfg)
 	if err != nil {
 		log.Error(err.Error())
+		if !a.cfg.IsLonely() {
+			a.loadErr = fmt.Errorf("Load model %s failed: %w", a.cfg.Model, err)
+			a.ser.SetLoadError(a.loadErr)
+			system.ShutdownRequestChannel <- struct{}{}
+		}
 	}
 }
 
 func (a *App) Stop() error {
 	log.Info("Stop App")
-	if !a.cfg.Interactive && !a.cfg.IsLonely() {
+	if !a.cfg.IsLonely() {
 		err := a.ser.Stop()
 		if err != nil {
 			log.Error(err.Error())
 		}
-	}
-	if !a.cfg.Interactive {
-		err := wrapper.LlamaStop()
+		// a reload in progress swaps its runner in before it is stopped
+		a.reloadMu.Lock()
+		defer a.reloadMu.Unlock()
+		err = wrapper.LlamaStop()
 		if err != nil {
 			log.Error(err.Error())
 		}
 	}
 	a.wg.Wait()
+	return a.loadErr
+}
+
+// Reload reads the config file again and loads its model, or the current
+// model again without config file, for example after the model file was replaced
+func (a *App) Reload() error {
+	if a.cfg.IsLonely() {
+		return fmt.Errorf("Reload is only supported by the server")
+	}
+	cfg, err := a.ser.ModelConfig().Reread("")
+	if err != nil {
+		return err
+	}
+	return a.reload(cfg)
+}
+
+// reload loads the model of cfg next to the current one, swaps the traffic to
+// it once it is ready and frees the previous runner after its requests drained.
+// The current model keeps serving when the new one fails to load.
+func (a *App) reload(cfg *config.Config) error {
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+
+	if err := cfg.Load(); err != nil {
+		return err
+	}
+	if err := wrapper.LlamaCheckArgs(cfg); err != nil {
+		return err
+	}
+	log.Info("Reload model", "model", cfg.Model, "ctx-size", cfg.CtxSize)
+	r, err := wrapper.NewRunner(cfg)
+	if err != nil {
+		return err
+	}
+	started := make(chan error, 1)
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		started <- r.Start()
+	}()
+
+	ticker := time.NewTicker(reloadPollInterval)
+	defer ticker.Stop()
+	for !r.Status().Ready {
+		select {
+		case err := <-started:
+			r.Free()
+			if err == nil {
+				err = fmt.Errorf("runner stopped while loading")
+			}
+			return fmt.Errorf("Reload model %s failed, keep serving %s: %w", cfg.Model, a.ser.ModelConfig().Model, err)
+		case <-ticker.C:
+		}
+	}
+
+	prev := wrapper.SwapRunner(r)
+	a.ser.SetModelConfig(cfg)
+	log.Info("Swapped to the reloaded model", "model", cfg.Model)
+	if prev != nil {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			prev.Free()
+			log.Info("Freed the previous model")
+		}()
+	}
 	return nil
 }
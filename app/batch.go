@@ -0,0 +1,386 @@
+// Copyright (c) 2017-2025 The qitmeer developers
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Qitmeer/llama.go/config"
+	"github.com/Qitmeer/llama.go/llama"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/urfave/cli/v2"
+	"maps"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// batchRequest is a line of the input of the batch command, a generate
+// request with a prompt or a chat request with messages
+type batchRequest struct {
+	ID       string          `json:"id"`
+	Prompt   string          `json:"prompt"`
+	Messages []llama.Message `json:"messages"`
+	// Options are parameters like the ones of /set in chat, for example temperature
+	Options map[string]any `json:"options"`
+}
+
+// batchResult is a line of the output of the batch command, Line is the
+// line of the request in the input starting at 1
+type batchResult struct {
+	Line             int     `json:"line"`
+	ID               string  `json:"id,omitempty"`
+	Response         string  `json:"response"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Duration         float64 `json:"duration"`
+	Error            string  `json:"error,omitempty"`
+
+	// cancelled results are not written and run again on resume
+	cancelled bool
+}
+
+// batchJob is a request of the input to run
+type batchJob struct {
+	line int
+	data []byte
+}
+
+func batchCmd() *cli.Command {
+	return &cli.Command{
+		Name:     "batch",
+		Category: "llama",
+		Usage:    "Run the generate and chat requests of a JSONL file and write their results to another",
+		Description: "Run the requests of --input, one JSON object per line with an optional id, a prompt or messages and options, " +
+			"on --parallel contexts sharing the model. A context is reset between requests, and created again for the options of a request. " +
+			"The results are appended to --output as they finish, run the command again to resume an interrupted batch or to retry the failed requests.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "input",
+				Usage:    "JSONL file of the requests",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "output",
+				Usage:    "JSONL file the results are appended to, the requests it already holds a successful result of are skipped",
+				Required: true,
+			},
+			&cli.IntFlag{
+				Name:  "parallel",
+				Usage: "Number of requests processed at the same time",
+				Value: 2,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			cfg := config.Conf
+			err := initLog(cfg)
+			if err != nil {
+				return err
+			}
+			err = cfg.Load()
+			if err != nil {
+				return err
+			}
+			if ctx.Int("parallel") < 1 {
+				return fmt.Errorf("parallel %d must be positive", ctx.Int("parallel"))
+			}
+			return runBatch(cfg, ctx.String("input"), ctx.String("output"), ctx.Int("parallel"))
+		},
+	}
+}
+
+func runBatch(cfg *config.Config, input string, output string, parallel int) error {
+	lines, err := readLines(input)
+	if err != nil {
+		return err
+	}
+	done, err := batchCheckpoint(output)
+	if err != nil {
+		return err
+	}
+	var jobs []batchJob
+	for i, data := range lines {
+		if len(bytes.TrimSpace(data)) == 0 || done[i+1] {
+			continue
+		}
+		jobs = append(jobs, batchJob{line: i + 1, data: data})
+	}
+	log.Info("Start batch", "requests", len(lines), "done", len(lines)-len(jobs), "todo", len(jobs), "parallel", parallel)
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	out, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	model, err := llama.LoadModel(cfg.Model, &llama.ModelOptions{NGpuLayers: &cfg.NGpuLayers})
+	if err != nil {
+		return err
+	}
+	defer model.Close()
+
+	// Ctrl+C stops the requests in progress, they run again on resume
+	bctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			log.Warn("Interrupted, stop the requests in progress")
+			cancel()
+		case <-bctx.Done():
+		}
+	}()
+
+	queue := make(chan batchJob)
+	results := make(chan *batchResult)
+	var wg sync.WaitGroup
+	for range min(parallel, len(jobs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := &batchWorker{cfg: cfg, model: model}
+			defer w.close()
+			for job := range queue {
+				results <- w.run(bctx, job)
+			}
+		}()
+	}
+	go func() {
+		defer close(queue)
+		for _, job := range jobs {
+			select {
+			case queue <- job:
+			case <-bctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	start := time.Now()
+	var finished, failed, promptToks, genToks int
+	var writeErr error
+	for res := range results {
+		if res.cancelled {
+			continue
+		}
+		if writeErr == nil {
+			writeErr = writeResult(out, res)
+			if writeErr != nil {
+				// nothing more can be saved
+				cancel()
+			}
+		}
+		finished++
+		promptToks += res.PromptTokens
+		genToks += res.CompletionTokens
+		if len(res.Error) > 0 {
+			failed++
+			log.Warn("Batch request failed", "line", res.Line, "id", res.ID, "err", res.Error)
+		}
+		log.Info("Batch progress", "done", finished, "total", len(jobs), "line", res.Line, "id", res.ID)
+	}
+	elapsed := time.Since(start)
+
+	fmt.Printf("processed %d of %d requests in %s: %d succeeded, %d failed, %d skipped as done\n",
+		finished, len(jobs), elapsed.Round(time.Millisecond), finished-failed, failed, len(lines)-len(jobs))
+	if s := elapsed.Seconds(); s > 0 {
+		fmt.Printf("throughput: %.2f requests/s, %.2f prompt tokens/s, %.2f generated tokens/s\n",
+			float64(finished)/s, float64(promptToks)/s, float64(genToks)/s)
+	}
+	switch {
+	case writeErr != nil:
+		return fmt.Errorf("output: %w", writeErr)
+	case finished < len(jobs):
+		return fmt.Errorf("Batch interrupted after %d of %d requests, run it again to resume", finished, len(jobs))
+	case failed > 0:
+		return fmt.Errorf("%d of %d requests failed", failed, finished)
+	}
+	return nil
+}
+
+// batchWorker runs requests one after the other on a context it keeps
+// while their parameters do not change
+type batchWorker struct {
+	cfg   *config.Config
+	model *llama.Model
+
+	ctx    *llama.Context
+	params map[string]string
+}
+
+// context returns a context with params, without the conversation of the
+// previous request
+func (w *batchWorker) context(params map[string]string) (*llama.Context, error) {
+	if w.ctx != nil && maps.Equal(w.params, params) {
+		w.ctx.Reset()
+		return w.ctx, nil
+	}
+	w.close()
+	opts, err := contextOptions(w.cfg, params)
+	if err != nil {
+		return nil, err
+	}
+	c, err := w.model.NewContext(opts)
+	if err != nil {
+		return nil, err
+	}
+	w.ctx, w.params = c, params
+	return c, nil
+}
+
+func (w *batchWorker) close() {
+	if w.ctx != nil {
+		w.ctx.Close()
+		w.ctx, w.params = nil, nil
+	}
+}
+
+// run answers the request, the requests are independent
+func (w *batchWorker) run(ctx context.Context, job batchJob) *batchResult {
+	start := time.Now()
+	res := &batchResult{Line: job.line}
+	fail := func(err error) *batchResult {
+		res.Error = err.Error()
+		res.Duration = time.Since(start).Seconds()
+		return res
+	}
+
+	var req batchRequest
+	if err := json.Unmarshal(job.data, &req); err != nil {
+		return fail(err)
+	}
+	res.ID = req.ID
+	if len(req.Prompt) == 0 && len(req.Messages) == 0 {
+		return fail(fmt.Errorf("the request has neither prompt nor messages"))
+	}
+	if len(req.Prompt) > 0 && len(req.Messages) > 0 {
+		return fail(fmt.Errorf("the request has both prompt and messages"))
+	}
+	params, err := batchParams(req.Options)
+	if err != nil {
+		return fail(err)
+	}
+	if ctx.Err() != nil {
+		res.cancelled = true
+		return res
+	}
+
+	c, err := w.context(params)
+	if err != nil {
+		return fail(err)
+	}
+	var content string
+	var stats *llama.Stats
+	if len(req.Prompt) > 0 {
+		content, stats, err = c.Generate(ctx, req.Prompt, nil)
+	} else {
+		content, stats, err = c.Chat(ctx, req.Messages, nil)
+	}
+	if ctx.Err() != nil {
+		res.cancelled = true
+		return res
+	}
+	if err != nil {
+		return fail(err)
+	}
+	res.Response = content
+	res.PromptTokens = stats.PromptTokens
+	res.CompletionTokens = stats.GeneratedTokens
+	res.Duration = time.Since(start).Seconds()
+	return res
+}
+
+// batchParams converts the options of a request to parameters of the context
+func batchParams(options map[string]any) (map[string]string, error) {
+	params := map[string]string{}
+	for name, v := range options {
+		if _, ok := optionArgs[name]; !ok {
+			return nil, fmt.Errorf("unknown option '%s'", name)
+		}
+		switch v := v.(type) {
+		case float64:
+			params[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		case string:
+			if _, err := strconv.ParseFloat(v, 64); err != nil {
+				return nil, fmt.Errorf("option %s must be a number", name)
+			}
+			params[name] = v
+		default:
+			return nil, fmt.Errorf("option %s must be a number", name)
+		}
+	}
+	return params, nil
+}
+
+func writeResult(out *os.File, res *batchResult) error {
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// batchCheckpoint returns the input lines the output already holds a
+// successful result of, the failed requests run again. A result cut by an
+// interruption is removed, its request runs again.
+func batchCheckpoint(output string) (map[int]bool, error) {
+	done := map[int]bool{}
+	data, err := os.ReadFile(output)
+	if errors.Is(err, os.ErrNotExist) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n := bytes.LastIndexByte(data, '\n') + 1; n < len(data) {
+		if err := os.Truncate(output, int64(n)); err != nil {
+			return nil, err
+		}
+		data = data[:n]
+	}
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var res batchResult
+		if err := json.Unmarshal(line, &res); err != nil || res.Line <= 0 {
+			return nil, fmt.Errorf("%s: line %d is not a batch result", output, i+1)
+		}
+		if len(res.Error) == 0 {
+			done[res.Line] = true
+		}
+	}
+	return done, nil
+}
+
+// readLines returns the lines of the file without their line breaks
+func readLines(path string) ([][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+	for i := range lines {
+		lines[i] = bytes.TrimSuffix(lines[i], []byte("\r"))
+	}
+	return lines, nil
+}
@@ -1,6 +1,7 @@
 package app
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/Qitmeer/llama.go/config"
 	"github.com/Qitmeer/llama.go/wrapper"
@@ -13,6 +14,10 @@ func commands() []*cli.Command {
 	cmds := []*cli.Command{}
 	cmds = append(cmds, downloadCmd())
 	cmds = append(cmds, embeddingCmd())
+	cmds = append(cmds, tokenizeCmd())
+	cmds = append(cmds, replayCmd())
+	cmds = append(cmds, chatCmd())
+	cmds = append(cmds, batchCmd())
 	return cmds
 }
 
@@ -31,22 +36,45 @@ func downloadCmd() *cli.Command {
 
 func embeddingCmd() *cli.Command {
 	return &cli.Command{
-		Name:        "embedding",
-		Aliases:     []string{"e"},
-		Category:    "llama",
-		Usage:       "Generate high-dimensional embedding vector of a given text",
-		Description: "Generate high-dimensional embedding vector of a given text",
+		Name:     "embedding",
+		Aliases:  []string{"e"},
+		Category: "llama",
+		Usage:    "Generate high-dimensional embedding vector of a given text",
+		Description: "Generate high-dimensional embedding vector of a given text, or of every text of --input. " +
+			"The texts of --input are embedded in batches of at most --batch-size tokens and written with their ids to --output-file, " +
+			"or to the standard output for JSONL.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "input",
+				Usage: "Text file of one text per line or JSONL file of {\"id\", \"text\"} objects to embed, - reads the standard input",
+			},
+			&cli.StringFlag{
+				Name:  "input-format",
+				Usage: "Format of --input, text or jsonl, from its extension by default",
+			},
+			&cli.StringFlag{
+				Name:  "output-format",
+				Usage: "Format of the embeddings of --input: jsonl, npy (with the ids in <name>.ids.json) or parquet, from the extension of --output-file by default",
+			},
+		},
 		Action: func(ctx *cli.Context) error {
 			cfg := config.Conf
-			err := initLog(cfg)
+			// the embeddings can be written to the standard output
+			err := initLogOutput(cfg, os.Stderr)
 			if err != nil {
 				return err
 			}
-			log.Info("Start embedding")
 			err = cfg.Load()
 			if err != nil {
 				return err
 			}
+			if input := ctx.String("input"); len(input) > 0 {
+				if len(cfg.Prompt) > 0 {
+					return fmt.Errorf("input and prompt can not be used together")
+				}
+				return embedFile(cfg, input, ctx.String("input-format"), ctx.String("output-format"))
+			}
+			log.Info("Start embedding")
 			ret, err := wrapper.LlamaEmbedding(cfg, cfg.Model, cfg.Prompt, cfg.EmbdOutputFormat)
 			if err != nil {
 				return err
@@ -62,6 +90,69 @@ func embeddingCmd() *cli.Command {
 	}
 }
 
+func tokenizeCmd() *cli.Command {
+	return &cli.Command{
+		Name:        "tokenize",
+		Aliases:     []string{"t"},
+		Category:    "llama",
+		Usage:       "Convert the prompt into token ids of the model vocabulary",
+		Description: "Convert the prompt into token ids of the model vocabulary, only the vocabulary of the model is loaded",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "pieces",
+				Usage: "Print the text piece of every token",
+			},
+			&cli.BoolFlag{
+				Name:  "add-special",
+				Usage: "Add special tokens (BOS/EOS) the model is configured to add",
+			},
+			&cli.BoolFlag{
+				Name:  "parse-special",
+				Usage: "Parse special tokens written in the prompt",
+				Value: true,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			cfg := config.Conf
+			err := initLog(cfg)
+			if err != nil {
+				return err
+			}
+			err = cfg.Load()
+			if err != nil {
+				return err
+			}
+			err = wrapper.LlamaVocabLoad(cfg.Model)
+			if err != nil {
+				return err
+			}
+			defer wrapper.LlamaVocabFree()
+
+			tokens, err := wrapper.LlamaTokenize(cfg.Prompt, ctx.Bool("add-special"), ctx.Bool("parse-special"))
+			if err != nil {
+				return err
+			}
+			if !ctx.Bool("pieces") {
+				ret, err := json.Marshal(tokens)
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(ret))
+				return nil
+			}
+			for _, t := range tokens {
+				piece, err := wrapper.LlamaTokenPiece(t, true)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%6d -> '%s'\n", t, piece)
+			}
+			fmt.Printf("number of tokens: %d\n", len(tokens))
+			return nil
+		},
+	}
+}
+
 func saveOutputToFile(outFilePath string, content string) error {
 	outFile, err := os.OpenFile(outFilePath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.ModePerm)
 	if err != nil {
@@ -0,0 +1,435 @@
+// Copyright (c) 2017-2025 The qitmeer developers
+
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Qitmeer/llama.go/config"
+	"github.com/Qitmeer/llama.go/llama"
+	"github.com/Qitmeer/llama.go/wrapper"
+	"github.com/ethereum/go-ethereum/log"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// embedItem is a text of the input of the embedding command
+type embedItem struct {
+	// id is the id of the JSONL line or the line number, as JSON
+	id     json.RawMessage
+	text   string
+	tokens int
+}
+
+// label is the id as text, without the quotes of a string
+func (it *embedItem) label() string {
+	var s string
+	if json.Unmarshal(it.id, &s) == nil {
+		return s
+	}
+	return string(it.id)
+}
+
+// embedInputFormat returns the format of the input, from its extension
+// unless it is given
+func embedInputFormat(input string, format string) (string, error) {
+	switch format {
+	case "text", "jsonl":
+		return format, nil
+	case "":
+		switch strings.ToLower(filepath.Ext(input)) {
+		case ".jsonl", ".ndjson":
+			return "jsonl", nil
+		}
+		return "text", nil
+	}
+	return "", fmt.Errorf("input-format %s is not one of text, jsonl", format)
+}
+
+// embedOutputFormat returns the format of the output, from its extension
+// unless it is given
+func embedOutputFormat(output string, format string) (string, error) {
+	switch format {
+	case "jsonl", "npy", "parquet":
+	case "":
+		switch strings.ToLower(filepath.Ext(output)) {
+		case ".npy":
+			format = "npy"
+		case ".parquet":
+			format = "parquet"
+		default:
+			format = "jsonl"
+		}
+	default:
+		return "", fmt.Errorf("output-format %s is not one of jsonl, npy, parquet", format)
+	}
+	if format != "jsonl" && (len(output) == 0 || output == "-") {
+		return "", fmt.Errorf("the %s output must be written to a file, set --output-file", format)
+	}
+	return format, nil
+}
+
+// readEmbedInput reads the texts of a text file, one per line with its line
+// number as id, or of a JSONL file of {"id": ..., "text": ...} objects.
+// - reads the standard input. The empty lines are skipped.
+func readEmbedInput(input string, format string) ([]*embedItem, error) {
+	r := io.Reader(os.Stdin)
+	if input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	br := bufio.NewReader(r)
+	var items []*embedItem
+	for n := 1; ; n++ {
+		line, err := br.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		text := strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if len(strings.TrimSpace(text)) > 0 {
+			it := &embedItem{id: json.RawMessage(strconv.Itoa(n)), text: text}
+			if format == "jsonl" {
+				var perr error
+				if it, perr = parseEmbedLine(text); perr != nil {
+					return nil, fmt.Errorf("%s: line %d: %w", input, n, perr)
+				}
+			}
+			items = append(items, it)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("%s has no text to embed", input)
+	}
+	return items, nil
+}
+
+func parseEmbedLine(line string) (*embedItem, error) {
+	var v struct {
+		ID   json.RawMessage `json:"id"`
+		Text *string         `json:"text"`
+	}
+	if err := json.Unmarshal([]byte(line), &v); err != nil {
+		return nil, err
+	}
+	var id any
+	if err := json.Unmarshal(v.ID, &id); err != nil || id == nil {
+		return nil, fmt.Errorf("id is missing")
+	}
+	switch id.(type) {
+	case string, float64:
+	default:
+		return nil, fmt.Errorf("id must be a string or a number")
+	}
+	if v.Text == nil || len(strings.TrimSpace(*v.Text)) == 0 {
+		return nil, fmt.Errorf("text is missing")
+	}
+	return &embedItem{id: v.ID, text: *v.Text}, nil
+}
+
+// embedBatches groups the items in input order into batches of at most
+// budget tokens
+func embedBatches(items []*embedItem, budget int) [][]*embedItem {
+	var batches [][]*embedItem
+	var cur []*embedItem
+	used := 0
+	for _, it := range items {
+		if len(cur) > 0 && used+it.tokens > budget {
+			batches = append(batches, cur)
+			cur, used = nil, 0
+		}
+		cur = append(cur, it)
+		used += it.tokens
+	}
+	if len(cur) > 0 {
+		batches = append(batches, cur)
+	}
+	return batches
+}
+
+// countTokens sets the tokens of the items with the vocabulary of the model,
+// counted like the embedding does
+func countTokens(model string, items []*embedItem, budget int) (int, error) {
+	err := wrapper.LlamaVocabLoad(model)
+	if err != nil {
+		return 0, err
+	}
+	defer wrapper.LlamaVocabFree()
+	total := 0
+	for _, it := range items {
+		tokens, err := wrapper.LlamaTokenize(it.text, true, true)
+		if err != nil {
+			return 0, fmt.Errorf("text %s: %w", it.label(), err)
+		}
+		if len(tokens) > budget {
+			return 0, fmt.Errorf("text %s has %d tokens, more than the batch size %d, increase --batch-size", it.label(), len(tokens), budget)
+		}
+		it.tokens = len(tokens)
+		total += it.tokens
+	}
+	return total, nil
+}
+
+// embedFile embeds the texts of input in batches of at most --batch-size
+// tokens and writes them with their ids to --output-file in the format
+func embedFile(cfg *config.Config, input string, inFormat string, outFormat string) error {
+	inFormat, err := embedInputFormat(input, inFormat)
+	if err != nil {
+		return err
+	}
+	outFormat, err = embedOutputFormat(cfg.OutputFile, outFormat)
+	if err != nil {
+		return err
+	}
+	if cfg.Pooling == "none" {
+		return fmt.Errorf("pooling none gives an embedding per token, choose another pooling to embed a file")
+	}
+	budget := cfg.BatchSize
+	if budget < 1 {
+		return fmt.Errorf("batch-size %d must be positive", budget)
+	}
+
+	items, err := readEmbedInput(input, inFormat)
+	if err != nil {
+		return err
+	}
+	tokens, err := countTokens(cfg.Model, items, budget)
+	if err != nil {
+		return err
+	}
+	batches := embedBatches(items, budget)
+	log.Info("Start embedding", "input", input, "texts", len(items), "tokens", tokens, "batches", len(batches), "output", cfg.OutputFile, "format", outFormat)
+
+	out, err := newEmbeddingWriter(cfg.OutputFile, outFormat, len(items))
+	if err != nil {
+		return err
+	}
+	model, err := llama.LoadModel(cfg.Model, &llama.ModelOptions{NGpuLayers: &cfg.NGpuLayers})
+	if err != nil {
+		out.abort()
+		return err
+	}
+	defer model.Close()
+
+	// Ctrl+C stops after the current batch
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			log.Warn("Interrupted, stop after the current batch")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	bar := newProgressBar("Embedding", len(items))
+	if bar.tty {
+		// the logs of every batch would break the bar
+		wrapper.LlamaLogSet(max(parseLevel(cfg.LogLevel), slog.LevelWarn))
+	}
+	opts := &llama.EmbedOptions{
+		Pooling:   cfg.Pooling,
+		BatchSize: budget,
+		Args:      []string{"--ctx-size", strconv.Itoa(budget), "--embd-normalize", strconv.Itoa(cfg.EmbdNormalize)},
+	}
+	start := time.Now()
+	for _, batch := range batches {
+		texts := make([]string, len(batch))
+		for i, it := range batch {
+			texts[i] = it.text
+		}
+		err = ctx.Err()
+		if err == nil {
+			var vecs [][]float32
+			vecs, err = model.Embed(ctx, texts, opts)
+			if err == nil {
+				err = out.write(batch, vecs)
+			}
+		}
+		if err != nil {
+			bar.finish()
+			out.abort()
+			if errors.Is(err, context.Canceled) {
+				return fmt.Errorf("Embedding interrupted after %d of %d texts", bar.done, len(items))
+			}
+			return err
+		}
+		bar.add(len(batch))
+	}
+	bar.finish()
+	if err := out.close(); err != nil {
+		return fmt.Errorf("output: %w", err)
+	}
+	elapsed := time.Since(start)
+	log.Info("Embedding done", "texts", len(items), "tokens", tokens, "elapsed", elapsed.Round(time.Millisecond),
+		"rate", fmt.Sprintf("%.1f texts/s", float64(len(items))/elapsed.Seconds()))
+	return nil
+}
+
+// embeddingWriter writes the embeddings with their ids, abort removes the
+// incomplete output of a file format
+type embeddingWriter interface {
+	write(items []*embedItem, vecs [][]float32) error
+	close() error
+	abort()
+}
+
+func newEmbeddingWriter(output string, format string, count int) (embeddingWriter, error) {
+	if format == "jsonl" && (len(output) == 0 || output == "-") {
+		return &jsonlEmbeddingWriter{w: bufio.NewWriter(os.Stdout)}, nil
+	}
+	f, err := os.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case "npy":
+		return &npyEmbeddingWriter{f: f, w: bufio.NewWriter(f), count: count}, nil
+	case "parquet":
+		pw, err := newParquetEmbeddingWriter(f)
+		if err != nil {
+			f.Close()
+			os.Remove(output)
+			return nil, err
+		}
+		return pw, nil
+	}
+	return &jsonlEmbeddingWriter{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// jsonlEmbeddingWriter writes a {"id": ..., "embedding": [...]} line per
+// text, an interrupted output keeps the lines written
+type jsonlEmbeddingWriter struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+func (o *jsonlEmbeddingWriter) write(items []*embedItem, vecs [][]float32) error {
+	for i, it := range items {
+		line, err := json.Marshal(struct {
+			ID        json.RawMessage `json:"id"`
+			Embedding []float32       `json:"embedding"`
+		}{it.id, vecs[i]})
+		if err != nil {
+			return err
+		}
+		o.w.Write(line)
+		if err := o.w.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	return o.w.Flush()
+}
+
+func (o *jsonlEmbeddingWriter) close() error {
+	err := o.w.Flush()
+	if o.f != nil {
+		if cerr := o.f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (o *jsonlEmbeddingWriter) abort() {
+	o.close()
+}
+
+// npyEmbeddingWriter writes a float32 matrix of a row per text in the NumPy
+// format, and the ids in input order to <name>.ids.json next to it
+type npyEmbeddingWriter struct {
+	f     *os.File
+	w     *bufio.Writer
+	count int
+	rows  int
+	dim   int
+	ids   []json.RawMessage
+}
+
+func (o *npyEmbeddingWriter) write(items []*embedItem, vecs [][]float32) error {
+	if o.rows == 0 && len(vecs) > 0 {
+		// the shape is known with the first embedding
+		o.dim = len(vecs[0])
+		if _, err := o.w.Write(npyHeader(o.count, o.dim)); err != nil {
+			return err
+		}
+	}
+	for i, v := range vecs {
+		if len(v) != o.dim {
+			return fmt.Errorf("embedding of %d dimensions instead of %d", len(v), o.dim)
+		}
+		if err := binary.Write(o.w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+		o.ids = append(o.ids, items[i].id)
+		o.rows++
+	}
+	return nil
+}
+
+func (o *npyEmbeddingWriter) close() error {
+	err := o.w.Flush()
+	if cerr := o.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if o.rows != o.count {
+		return fmt.Errorf("%d rows written instead of %d", o.rows, o.count)
+	}
+	ids, err := json.Marshal(o.ids)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(npyIDsPath(o.f.Name()), ids, 0644)
+}
+
+func (o *npyEmbeddingWriter) abort() {
+	o.f.Close()
+	os.Remove(o.f.Name())
+}
+
+// npyIDsPath is the file of the ids of the .npy output
+func npyIDsPath(output string) string {
+	return strings.TrimSuffix(output, filepath.Ext(output)) + ".ids.json"
+}
+
+// npyHeader is the header of a version 1.0 .npy file of a little-endian
+// float32 matrix, padded so that the data starts at a multiple of 64 bytes
+func npyHeader(rows int, cols int) []byte {
+	dict := fmt.Sprintf("{'descr': '<f4', 'fortran_order': False, 'shape': (%d, %d), }", rows, cols)
+	// magic, version and header length take 10 bytes, the header ends with \n
+	pad := 64 - (10+len(dict)+1)%64
+	if pad == 64 {
+		pad = 0
+	}
+	dict += strings.Repeat(" ", pad) + "\n"
+	var buf bytes.Buffer
+	buf.WriteString("\x93NUMPY\x01\x00")
+	binary.Write(&buf, binary.LittleEndian, uint16(len(dict)))
+	buf.WriteString(dict)
+	return buf.Bytes()
+}
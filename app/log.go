@@ -1,24 +1,61 @@
 package app
 
 import (
+	"fmt"
 	"github.com/Qitmeer/llama.go/config"
+	"github.com/Qitmeer/llama.go/wrapper"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/mattn/go-colorable"
 	"github.com/mattn/go-isatty"
 	"io"
 	"log/slog"
 	"os"
+	"sync"
 )
 
+// logFile is the file of the current logger, closed when the logger is replaced
+var logFile *rotatingFile
+
 func initLog(cfg *config.Config) error {
-	logOutput := os.Stdout
-	usecolor := (isatty.IsTerminal(os.Stderr.Fd()) || isatty.IsCygwinTerminal(os.Stderr.Fd())) && os.Getenv("TERM") != "dumb"
-	output := io.Writer(logOutput)
-	if usecolor {
-		output = colorable.NewColorable(logOutput)
+	// the answer of a prompt is written alone to the standard output
+	stdout := os.Stdout
+	if cfg.IsLonely() {
+		stdout = os.Stderr
+	}
+	return initLogOutput(cfg, stdout)
+}
+
+// initLogOutput sets the logger writing to stdout unless --log-file is set
+func initLogOutput(cfg *config.Config, stdout *os.File) error {
+	output := io.Writer(stdout)
+	usecolor := false
+	var file *rotatingFile
+	if len(cfg.LogFile) > 0 {
+		var err error
+		file, err = openRotatingFile(cfg.LogFile, int64(cfg.LogMaxSize)<<20, cfg.LogMaxBackups)
+		if err != nil {
+			return fmt.Errorf("log-file: %w", err)
+		}
+		output = file
+	} else if cfg.LogFormat != "json" {
+		usecolor = (isatty.IsTerminal(os.Stderr.Fd()) || isatty.IsCygwinTerminal(os.Stderr.Fd())) && os.Getenv("TERM") != "dumb"
+		if usecolor {
+			output = colorable.NewColorable(stdout)
+		}
 	}
 	verbosity := parseLevel(cfg.LogLevel)
-	log.SetDefault(log.NewLogger(log.NewTerminalHandlerWithLevel(output, verbosity, usecolor)))
+	if cfg.LogFormat == "json" {
+		log.SetDefault(log.NewLogger(log.JSONHandlerWithLevel(output, verbosity)))
+	} else {
+		log.SetDefault(log.NewLogger(log.NewTerminalHandlerWithLevel(output, verbosity, usecolor)))
+	}
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = file
+
+	// llama.cpp and the runners log through the same logger
+	wrapper.LlamaLogSet(verbosity)
 	return nil
 }
 
@@ -36,3 +73,84 @@ func parseLevel(level string) slog.Level {
 		return slog.LevelInfo
 	}
 }
+
+// rotatingFile is a log file renamed to <name>.1 once it would grow beyond
+// maxSize, the older files are shifted to <name>.2 and so on up to backups
+type rotatingFile struct {
+	mu      sync.Mutex
+	name    string
+	maxSize int64
+	backups int
+	f       *os.File
+	size    int64
+}
+
+func openRotatingFile(name string, maxSize int64, backups int) (*rotatingFile, error) {
+	r := &rotatingFile{name: name, maxSize: maxSize, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate keeps writing to the same file when it can not be renamed
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+	if r.backups > 0 {
+		os.Remove(r.backupName(r.backups))
+		for i := r.backups - 1; i >= 1; i-- {
+			os.Rename(r.backupName(i), r.backupName(i+1))
+		}
+		os.Rename(r.name, r.backupName(1))
+	} else {
+		os.Remove(r.name)
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) backupName(i int) string {
+	return fmt.Sprintf("%s.%d", r.name, i)
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2017-2025 The qitmeer developers
+
+package app
+
+import (
+	"fmt"
+	"github.com/ethereum/go-ethereum/log"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// loadPrompt reads the prompt of --file once, the prompt replaces it
+func (a *App) loadPrompt() error {
+	if len(a.cfg.File) <= 0 {
+		return nil
+	}
+	prompt, err := readPrompt(a.cfg.File)
+	if err != nil {
+		return fmt.Errorf("file: %w", err)
+	}
+	a.cfg.Prompt = prompt
+	a.cfg.File = ""
+	return nil
+}
+
+// readPrompt reads the prompt from the file or from the standard input for -,
+// without its final line break
+func readPrompt(name string) (string, error) {
+	var data []byte
+	var err error
+	if name == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return "", err
+	}
+	prompt := strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+	if len(prompt) == 0 {
+		return "", fmt.Errorf("%s is empty", name)
+	}
+	return prompt, nil
+}
+
+// generateOnce loads the model, streams the answer of the prompt to the
+// standard output as it is generated and frees the model. Ctrl+C stops the
+// generation and fails like any error, so that scripts see it.
+func (a *App) generateOnce() error {
+	// the prompt is sent as a request, the runner would answer the one it
+	// is started with on its own
+	cfg := *a.cfg
+	cfg.Prompt = ""
+	r, err := startRunner(&cfg)
+	if err != nil {
+		return err
+	}
+	defer r.Free()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	var interrupted bool
+	var writeErr error
+	_, stats, err := r.Generate(a.cfg.Prompt, func(piece string) bool {
+		select {
+		case <-interrupt:
+			interrupted = true
+			return false
+		default:
+		}
+		if _, writeErr = os.Stdout.WriteString(piece); writeErr != nil {
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println()
+	if writeErr != nil {
+		return writeErr
+	}
+	if interrupted {
+		return fmt.Errorf("Generation interrupted")
+	}
+	log.Info("Generated", "prompt_tokens", stats.PromptTokens, "completion_tokens", stats.GeneratedTokens,
+		"duration", stats.TotalDuration, "tokens_per_second", fmt.Sprintf("%.2f", stats.TokensPerSecond()))
+	return nil
+}
@@ -0,0 +1,338 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+)
+
+// parquetRowGroupRows is the number of rows of a row group, the rows are kept
+// in memory until their row group is written
+const parquetRowGroupRows = 10000
+
+// Values of the Parquet format used by parquetEmbeddingWriter
+const (
+	parquetMagic = "PAR1"
+
+	parquetFloat     = 4
+	parquetByteArray = 6
+
+	parquetRequired = 0
+	parquetRepeated = 2
+
+	parquetUTF8         = 0
+	parquetPlain        = 0
+	parquetRLE          = 3
+	parquetUncompressed = 0
+	parquetDataPage     = 0
+)
+
+// parquetEmbeddingWriter writes the embeddings to an uncompressed Parquet
+// file with a required UTF8 id column and a repeated float embedding column,
+// read as a list of floats by pyarrow, pandas, DuckDB or Spark
+type parquetEmbeddingWriter struct {
+	f *os.File
+	w *bufio.Writer
+	// offset is the number of bytes written to the file
+	offset int64
+
+	ids  []string
+	vecs [][]float32
+	rows int64
+
+	groups []parquetRowGroup
+}
+
+type parquetRowGroup struct {
+	rows   int64
+	size   int64
+	chunks []parquetChunk
+}
+
+type parquetChunk struct {
+	typ    int32
+	name   string
+	values int64
+	size   int64
+	offset int64
+}
+
+func newParquetEmbeddingWriter(f *os.File) (*parquetEmbeddingWriter, error) {
+	o := &parquetEmbeddingWriter{f: f, w: bufio.NewWriter(f)}
+	if err := o.put([]byte(parquetMagic)); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *parquetEmbeddingWriter) put(data []byte) error {
+	n, err := o.w.Write(data)
+	o.offset += int64(n)
+	return err
+}
+
+func (o *parquetEmbeddingWriter) write(items []*embedItem, vecs [][]float32) error {
+	for i, it := range items {
+		if len(vecs[i]) == 0 {
+			return fmt.Errorf("empty embedding of text %s", it.label())
+		}
+		o.ids = append(o.ids, it.label())
+		o.vecs = append(o.vecs, vecs[i])
+	}
+	if len(o.ids) >= parquetRowGroupRows {
+		return o.flush()
+	}
+	return nil
+}
+
+// flush writes the rows kept in memory as a row group, a data page per column
+func (o *parquetEmbeddingWriter) flush() error {
+	if len(o.ids) == 0 {
+		return nil
+	}
+	var ids bytes.Buffer
+	for _, id := range o.ids {
+		binary.Write(&ids, binary.LittleEndian, uint32(len(id)))
+		ids.WriteString(id)
+	}
+
+	// the repetition level is 0 at the start of a row and 1 in it, the
+	// definition level is 1 since no list is empty
+	var reps, defs, values bytes.Buffer
+	var count int64
+	for _, v := range o.vecs {
+		rleRun(&reps, 1, 0)
+		if len(v) > 1 {
+			rleRun(&reps, len(v)-1, 1)
+		}
+		for _, x := range v {
+			binary.Write(&values, binary.LittleEndian, math.Float32bits(x))
+		}
+		count += int64(len(v))
+	}
+	rleRun(&defs, int(count), 1)
+	var embeddings bytes.Buffer
+	for _, levels := range []*bytes.Buffer{&reps, &defs} {
+		binary.Write(&embeddings, binary.LittleEndian, uint32(levels.Len()))
+		embeddings.Write(levels.Bytes())
+	}
+	embeddings.Write(values.Bytes())
+
+	g := parquetRowGroup{rows: int64(len(o.ids))}
+	for _, page := range []struct {
+		chunk parquetChunk
+		data  []byte
+	}{
+		{parquetChunk{typ: parquetByteArray, name: "id", values: int64(len(o.ids))}, ids.Bytes()},
+		{parquetChunk{typ: parquetFloat, name: "embedding", values: count}, embeddings.Bytes()},
+	} {
+		c := page.chunk
+		c.offset = o.offset
+		if err := o.put(parquetPageHeader(c.values, len(page.data))); err != nil {
+			return err
+		}
+		if err := o.put(page.data); err != nil {
+			return err
+		}
+		c.size = o.offset - c.offset
+		g.size += c.size
+		g.chunks = append(g.chunks, c)
+	}
+	o.groups = append(o.groups, g)
+	o.rows += g.rows
+	o.ids, o.vecs = o.ids[:0], o.vecs[:0]
+	return nil
+}
+
+func (o *parquetEmbeddingWriter) close() error {
+	err := o.flush()
+	if err == nil {
+		footer := o.footer()
+		err = o.put(footer)
+		if err == nil {
+			err = o.put(binary.LittleEndian.AppendUint32(nil, uint32(len(footer))))
+		}
+		if err == nil {
+			err = o.put([]byte(parquetMagic))
+		}
+		if err == nil {
+			err = o.w.Flush()
+		}
+	}
+	if cerr := o.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (o *parquetEmbeddingWriter) abort() {
+	o.f.Close()
+	os.Remove(o.f.Name())
+}
+
+// footer is the FileMetaData of the file
+func (o *parquetEmbeddingWriter) footer() []byte {
+	t := &thriftWriter{}
+	t.i32(1, 1)
+	t.list(2, thriftStruct, 3)
+	// the root of the schema and its two columns
+	t.begin()
+	t.str(4, "schema")
+	t.i32(5, 2)
+	t.end()
+	t.begin()
+	t.i32(1, parquetByteArray)
+	t.i32(3, parquetRequired)
+	t.str(4, "id")
+	t.i32(6, parquetUTF8)
+	t.end()
+	t.begin()
+	t.i32(1, parquetFloat)
+	t.i32(3, parquetRepeated)
+	t.str(4, "embedding")
+	t.end()
+	t.i64(3, o.rows)
+	t.list(4, thriftStruct, len(o.groups))
+	for _, g := range o.groups {
+		t.begin()
+		t.list(1, thriftStruct, len(g.chunks))
+		for _, c := range g.chunks {
+			t.begin()
+			t.i64(2, c.offset)
+			t.field(3, thriftStruct)
+			t.begin()
+			t.i32(1, c.typ)
+			t.list(2, thriftI32, 2)
+			t.varint(zigzag(parquetPlain))
+			t.varint(zigzag(parquetRLE))
+			t.list(3, thriftBinary, 1)
+			t.binary(c.name)
+			t.i32(4, parquetUncompressed)
+			t.i64(5, c.values)
+			t.i64(6, c.size)
+			t.i64(7, c.size)
+			t.i64(9, c.offset)
+			t.end()
+			t.end()
+		}
+		t.i64(2, g.size)
+		t.i64(3, g.rows)
+		t.end()
+	}
+	t.str(6, "llama.go")
+	t.stop()
+	return t.buf.Bytes()
+}
+
+// parquetPageHeader is the PageHeader of an uncompressed data page
+func parquetPageHeader(values int64, size int) []byte {
+	t := &thriftWriter{}
+	t.i32(1, parquetDataPage)
+	t.i32(2, int32(size))
+	t.i32(3, int32(size))
+	t.field(5, thriftStruct)
+	t.begin()
+	t.i32(1, int32(values))
+	t.i32(2, parquetPlain)
+	t.i32(3, parquetRLE)
+	t.i32(4, parquetRLE)
+	t.end()
+	t.stop()
+	return t.buf.Bytes()
+}
+
+// rleRun appends a run of count times the level to levels encoded with the
+// RLE/bit-packing hybrid of bit width 1
+func rleRun(levels *bytes.Buffer, count int, level byte) {
+	levels.Write(binary.AppendUvarint(nil, uint64(count)<<1))
+	levels.WriteByte(level)
+}
+
+// Types of the Thrift compact protocol
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structs with the Thrift compact protocol, which the
+// metadata of Parquet uses. Fields must be written in increasing id order.
+type thriftWriter struct {
+	buf bytes.Buffer
+	// last is the id of the last field of the current struct, and ids the
+	// ones of the structs it is nested in
+	last int16
+	ids  []int16
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	t.buf.Write(binary.AppendUvarint(nil, v))
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if delta := id - t.last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(zigzag(int64(id)))
+	}
+	t.last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(zigzag(int64(v)))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(zigzag(v))
+}
+
+func (t *thriftWriter) str(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.binary(s)
+}
+
+func (t *thriftWriter) binary(s string) {
+	t.varint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+// list starts a list field of n elements, written next
+func (t *thriftWriter) list(id int16, elem byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | elem)
+	} else {
+		t.buf.WriteByte(0xf0 | elem)
+		t.varint(uint64(n))
+	}
+}
+
+// begin starts a struct, after its field header or as an element of a list
+func (t *thriftWriter) begin() {
+	t.ids = append(t.ids, t.last)
+	t.last = 0
+}
+
+// end ends the struct started by begin
+func (t *thriftWriter) end() {
+	t.stop()
+	t.last = t.ids[len(t.ids)-1]
+	t.ids = t.ids[:len(t.ids)-1]
+}
+
+// stop ends the fields of the outermost struct
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+}
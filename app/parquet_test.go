@@ -0,0 +1,228 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParquetPageHeader(t *testing.T) {
+	want := []byte{
+		0x15, 0x00, // type: DATA_PAGE
+		0x15, 0x28, // uncompressed_page_size: 20
+		0x15, 0x28, // compressed_page_size: 20
+		0x2c,       // data_page_header
+		0x15, 0x06, // num_values: 3
+		0x15, 0x00, // encoding: PLAIN
+		0x15, 0x06, // definition_level_encoding: RLE
+		0x15, 0x06, // repetition_level_encoding: RLE
+		0x00, // end of data_page_header
+		0x00, // end of PageHeader
+	}
+	if got := parquetPageHeader(3, 20); !bytes.Equal(got, want) {
+		t.Fatalf("parquetPageHeader(3, 20) = % x, want % x", got, want)
+	}
+}
+
+func TestNpyHeader(t *testing.T) {
+	dict := "{'descr': '<f4', 'fortran_order': False, 'shape': (2, 3), }"
+	want := "\x93NUMPY\x01\x00\x76\x00" + dict + strings.Repeat(" ", 58) + "\n"
+	got := npyHeader(2, 3)
+	if string(got) != want {
+		t.Fatalf("npyHeader(2, 3) = %q, want %q", got, want)
+	}
+	if len(got)%64 != 0 {
+		t.Fatalf("npyHeader(2, 3) is %d bytes, not a multiple of 64", len(got))
+	}
+}
+
+// TestParquetRoundTrip writes two row groups and reads them back with a
+// minimal reader of the subset of the format the writer uses
+func TestParquetRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.parquet")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := newParquetEmbeddingWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := []*embedItem{
+		{id: json.RawMessage(`"a"`)},
+		{id: json.RawMessage(`2`)},
+		{id: json.RawMessage(`"c"`)},
+	}
+	vecs := [][]float32{{1, 2, 3}, {4.5}, {-1, 0}}
+	if err := w.write(items[:2], vecs[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.write(items[2:], vecs[2:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(parquetMagic)) || !bytes.HasSuffix(data, []byte(parquetMagic)) {
+		t.Fatal("missing PAR1 magic")
+	}
+	end := len(data) - len(parquetMagic) - 4
+	size := int(binary.LittleEndian.Uint32(data[end:]))
+	footer := (&thriftReader{b: data[end-size : end]}).structure()
+
+	if rows := footer[3]; rows != int64(3) {
+		t.Fatalf("num_rows = %v, want 3", rows)
+	}
+	var names []string
+	for _, e := range footer[2].([]any) {
+		names = append(names, e.(map[int16]any)[4].(string))
+	}
+	if want := []string{"schema", "id", "embedding"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("schema = %v, want %v", names, want)
+	}
+
+	var ids []string
+	var got [][]float32
+	groups := footer[4].([]any)
+	if len(groups) != 2 {
+		t.Fatalf("%d row groups, want 2", len(groups))
+	}
+	for _, g := range groups {
+		chunks := g.(map[int16]any)[1].([]any)
+		if len(chunks) != 2 {
+			t.Fatalf("%d column chunks, want 2", len(chunks))
+		}
+		idPage, n := readParquetPage(t, data, chunks[0])
+		for range n {
+			l := int(binary.LittleEndian.Uint32(idPage))
+			ids = append(ids, string(idPage[4:4+l]))
+			idPage = idPage[4+l:]
+		}
+		embPage, n := readParquetPage(t, data, chunks[1])
+		got = append(got, readParquetEmbeddings(t, embPage, n)...)
+	}
+	if want := []string{"a", "2", "c"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("ids = %v, want %v", ids, want)
+	}
+	if !reflect.DeepEqual(got, vecs) {
+		t.Fatalf("embeddings = %v, want %v", got, vecs)
+	}
+}
+
+// readParquetPage returns the data and the number of values of the page of
+// a column chunk
+func readParquetPage(t *testing.T, data []byte, chunk any) ([]byte, int) {
+	t.Helper()
+	meta := chunk.(map[int16]any)[3].(map[int16]any)
+	r := &thriftReader{b: data, pos: int(meta[9].(int64))}
+	header := r.structure()
+	size := int(header[3].(int64))
+	values := int(header[5].(map[int16]any)[1].(int64))
+	if values != int(meta[5].(int64)) {
+		t.Fatalf("page of %d values, the chunk has %d", values, meta[5])
+	}
+	return data[r.pos : r.pos+size], values
+}
+
+// readParquetEmbeddings splits the values of the embedding column into rows
+// with its repetition levels
+func readParquetEmbeddings(t *testing.T, page []byte, n int) [][]float32 {
+	t.Helper()
+	var levels [2][]byte
+	for i := range levels {
+		l := int(binary.LittleEndian.Uint32(page))
+		levels[i] = page[4 : 4+l]
+		page = page[4+l:]
+	}
+	var reps []byte
+	for runs := levels[0]; len(runs) > 0; {
+		count, k := binary.Uvarint(runs)
+		reps = append(reps, bytes.Repeat(runs[k:k+1], int(count>>1))...)
+		runs = runs[k+1:]
+	}
+	if len(reps) != n || len(page) != 4*n {
+		t.Fatalf("%d repetition levels and %d bytes of values for %d values", len(reps), len(page), n)
+	}
+	var rows [][]float32
+	for i, rep := range reps {
+		v := math.Float32frombits(binary.LittleEndian.Uint32(page[4*i:]))
+		if rep == 0 {
+			rows = append(rows, nil)
+		}
+		rows[len(rows)-1] = append(rows[len(rows)-1], v)
+	}
+	return rows
+}
+
+// thriftReader decodes the Thrift compact protocol into maps of field ids
+type thriftReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b[r.pos:])
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) value(typ byte) any {
+	switch typ {
+	case thriftI32, thriftI64:
+		v := r.uvarint()
+		return int64(v>>1) ^ -int64(v&1)
+	case thriftBinary:
+		n := int(r.uvarint())
+		s := string(r.b[r.pos : r.pos+n])
+		r.pos += n
+		return s
+	case thriftList:
+		h := r.b[r.pos]
+		r.pos++
+		n := int(h >> 4)
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		list := make([]any, n)
+		for i := range list {
+			list[i] = r.value(h & 0x0f)
+		}
+		return list
+	case thriftStruct:
+		return r.structure()
+	}
+	panic("unsupported thrift type")
+}
+
+func (r *thriftReader) structure() map[int16]any {
+	fields := map[int16]any{}
+	var id int16
+	for {
+		h := r.b[r.pos]
+		r.pos++
+		if h == 0 {
+			return fields
+		}
+		if delta := h >> 4; delta != 0 {
+			id += int16(delta)
+		} else {
+			v := r.uvarint()
+			id = int16(int64(v>>1) ^ -int64(v&1))
+		}
+		fields[id] = r.value(h & 0x0f)
+	}
+}
@@ -0,0 +1,90 @@
+package app
+
+import (
+	"fmt"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/mattn/go-isatty"
+	"os"
+	"strings"
+	"time"
+)
+
+// progressWidth is the number of characters of the bar
+const progressWidth = 30
+
+// progressLogInterval is how often the progress is logged when the standard
+// error is not a terminal
+const progressLogInterval = 10 * time.Second
+
+// progressBar shows how many of total items are done on the standard error,
+// or logs it from time to time when the standard error is not a terminal
+type progressBar struct {
+	label  string
+	total  int
+	done   int
+	start  time.Time
+	logged time.Time
+	tty    bool
+}
+
+func newProgressBar(label string, total int) *progressBar {
+	p := &progressBar{
+		label: label,
+		total: total,
+		start: time.Now(),
+		tty:   isatty.IsTerminal(os.Stderr.Fd()) || isatty.IsCygwinTerminal(os.Stderr.Fd()),
+	}
+	p.logged = p.start
+	p.draw()
+	return p
+}
+
+func (p *progressBar) add(n int) {
+	p.done += n
+	if p.tty {
+		p.draw()
+	} else if time.Since(p.logged) >= progressLogInterval {
+		p.logged = time.Now()
+		log.Info(p.label, "done", p.done, "total", p.total, "rate", fmt.Sprintf("%.1f/s", p.rate()), "eta", p.eta())
+	}
+}
+
+// finish ends the line of the bar
+func (p *progressBar) finish() {
+	if p.tty {
+		p.draw()
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+func (p *progressBar) draw() {
+	if !p.tty {
+		return
+	}
+	ratio := 1.0
+	if p.total > 0 {
+		ratio = float64(p.done) / float64(p.total)
+	}
+	filled := int(ratio * progressWidth)
+	bar := strings.Repeat("=", filled)
+	if filled < progressWidth {
+		bar += ">" + strings.Repeat(" ", progressWidth-filled-1)
+	}
+	fmt.Fprintf(os.Stderr, "\r\033[K%s [%s] %d/%d %3.0f%% %.1f/s eta %s",
+		p.label, bar, p.done, p.total, ratio*100, p.rate(), p.eta())
+}
+
+func (p *progressBar) rate() float64 {
+	if s := time.Since(p.start).Seconds(); s > 0 {
+		return float64(p.done) / s
+	}
+	return 0
+}
+
+func (p *progressBar) eta() string {
+	rate := p.rate()
+	if p.done == 0 || rate == 0 {
+		return "?"
+	}
+	return (time.Duration(float64(p.total-p.done)/rate) * time.Second).String()
+}
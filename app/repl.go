@@ -0,0 +1,531 @@
+// Copyright (c) 2017-2025 The qitmeer developers
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Qitmeer/llama.go/config"
+	"github.com/Qitmeer/llama.go/llama"
+	"github.com/Qitmeer/llama.go/wrapper"
+	"github.com/emirpasic/gods/v2/lists/arraylist"
+	"github.com/ollama/ollama/readline"
+	"github.com/urfave/cli/v2"
+	"io"
+	"maps"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// historyLimit is the number of lines kept in the history file
+const historyLimit = 500
+
+// optionArgs maps the parameters of /set and of the batch requests to their
+// llama.cpp options
+var optionArgs = map[string]string{
+	"temperature":    "--temp",
+	"top_k":          "--top-k",
+	"top_p":          "--top-p",
+	"min_p":          "--min-p",
+	"repeat_penalty": "--repeat-penalty",
+	"repeat_last_n":  "--repeat-last-n",
+	"seed":           "--seed",
+	"num_predict":    "--n-predict",
+	"num_ctx":        "--ctx-size",
+}
+
+// conversation is the content of the files of /save and /load
+type conversation struct {
+	Model    string            `json:"model"`
+	System   string            `json:"system,omitempty"`
+	Params   map[string]string `json:"params,omitempty"`
+	Messages []llama.Message   `json:"messages"`
+}
+
+// repl is a chat in the terminal. The context of the model holds the
+// conversation, it is created again when the model, the system message or
+// a parameter changes and the conversation is then sent with the next message.
+type repl struct {
+	cfg       *config.Config
+	modelPath string
+	model     *llama.Model
+	ctx       *llama.Context
+	// fresh is true until the context holds the conversation
+	fresh bool
+
+	system   string
+	params   map[string]string
+	messages []llama.Message
+
+	last       *llama.Stats
+	requests   int
+	promptToks int
+	genToks    int
+}
+
+func chatCmd() *cli.Command {
+	return &cli.Command{
+		Name:     "chat",
+		Aliases:  []string{"c"},
+		Category: "llama",
+		Usage:    "Chat with the model in the terminal",
+		Description: "Chat with the model in the terminal, with line editing and history. " +
+			"Start and end a message with \"\"\" to write several lines, type /? for the commands. " +
+			"Ctrl+C stops the answer being generated, Ctrl+D or /bye exits.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "history-file",
+				Usage: "File keeping the input history, empty disables it",
+				Value: defaultHistoryFile(),
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			cfg := config.Conf
+			err := initLog(cfg)
+			if err != nil {
+				return err
+			}
+			err = cfg.Load()
+			if err != nil {
+				return err
+			}
+			if !readline.IsTerminal(os.Stdin.Fd()) {
+				return fmt.Errorf("chat needs a terminal, use the server or --prompt otherwise")
+			}
+			r := &repl{cfg: cfg, params: map[string]string{}}
+			if err := r.loadModel(cfg.Model); err != nil {
+				return err
+			}
+			// /model replaces the model
+			defer func() { r.model.Close() }()
+			return r.run(ctx.String("history-file"))
+		},
+	}
+}
+
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".llamago_history")
+}
+
+func (r *repl) run(historyFile string) error {
+	term, err := readline.NewTerminal()
+	if err != nil {
+		return err
+	}
+	scanner := &readline.Instance{
+		Prompt: &readline.Prompt{
+			Prompt:         ">>> ",
+			AltPrompt:      "... ",
+			Placeholder:    "Send a message (/? for help)",
+			AltPlaceholder: `Use """ to end multi-line input`,
+		},
+		Terminal: term,
+		History:  newHistory(historyFile),
+	}
+
+	// Ctrl+C interrupts the generation instead of the process, the line
+	// editor reads it as a key
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	fmt.Print(readline.StartBracketedPaste)
+	defer fmt.Print(readline.EndBracketedPaste)
+
+	var sb strings.Builder
+	multiline := false
+	for {
+		line, err := scanner.Readline()
+		switch {
+		case errors.Is(err, io.EOF):
+			fmt.Println()
+			return nil
+		case errors.Is(err, readline.ErrInterrupt):
+			if line == "" && sb.Len() == 0 {
+				fmt.Println("\nUse Ctrl + d or /bye to exit.")
+			}
+			scanner.Prompt.UseAlt = false
+			multiline = false
+			sb.Reset()
+			continue
+		case err != nil:
+			return err
+		}
+
+		switch {
+		case multiline:
+			before, ok := strings.CutSuffix(line, `"""`)
+			sb.WriteString(before)
+			if !ok {
+				sb.WriteString("\n")
+				continue
+			}
+			multiline = false
+			scanner.Prompt.UseAlt = false
+		case scanner.Pasting:
+			sb.WriteString(line + "\n")
+			continue
+		case strings.HasPrefix(line, `"""`) && sb.Len() == 0:
+			line, ok := strings.CutSuffix(strings.TrimPrefix(line, `"""`), `"""`)
+			sb.WriteString(line)
+			if !ok || len(line) == 0 {
+				sb.WriteString("\n")
+				multiline = true
+				scanner.Prompt.UseAlt = true
+				continue
+			}
+		case strings.HasPrefix(line, "/system") && strings.HasSuffix(strings.TrimSpace(line), `"""`) && sb.Len() == 0:
+			// a system message on several lines
+			sb.WriteString(strings.TrimSuffix(strings.TrimSpace(line), `"""`) + " ")
+			multiline = true
+			scanner.Prompt.UseAlt = true
+			continue
+		default:
+			sb.WriteString(line)
+		}
+
+		input := sb.String()
+		sb.Reset()
+		if strings.HasPrefix(input, "/") {
+			if quit := r.command(input); quit {
+				return nil
+			}
+			continue
+		}
+		if len(strings.TrimSpace(input)) == 0 {
+			continue
+		}
+		r.send(input, interrupt)
+	}
+}
+
+// newHistory reads the history file, the history is only kept in memory
+// when it can not be read
+func newHistory(path string) *readline.History {
+	h := &readline.History{
+		Buf:      arraylist.New[string](),
+		Limit:    historyLimit,
+		Filename: path,
+		Enabled:  len(path) > 0,
+	}
+	if h.Enabled {
+		if data, err := os.ReadFile(path); err == nil {
+			for _, line := range strings.Split(string(data), "\n") {
+				if len(strings.TrimSpace(line)) > 0 {
+					h.Add(line)
+				}
+			}
+		}
+	}
+	h.Autosave = h.Enabled
+	return h
+}
+
+// send adds the message to the conversation and streams the answer, Ctrl+C
+// stops it and keeps what was generated
+func (r *repl) send(content string, interrupt chan os.Signal) {
+	msgs := []llama.Message{}
+	if r.fresh {
+		if len(r.system) > 0 {
+			msgs = append(msgs, llama.Message{Role: "system", Content: r.system})
+		}
+		msgs = append(msgs, r.messages...)
+	}
+	msgs = append(msgs, llama.Message{Role: "user", Content: content})
+
+	// drop the Ctrl+C typed before the generation started
+	select {
+	case <-interrupt:
+	default:
+	}
+	gctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-done:
+		}
+	}()
+	answer, stats, err := r.ctx.Chat(gctx, msgs, func(piece string) bool {
+		fmt.Print(piece)
+		return true
+	})
+	close(done)
+	cancel()
+	fmt.Println()
+
+	if stats == nil {
+		// the failed generation cleared the context, the history is sent again
+		fmt.Printf("error: %v\n", err)
+		r.fresh = true
+		return
+	}
+	if err != nil {
+		fmt.Println("(interrupted)")
+	}
+	r.messages = append(r.messages,
+		llama.Message{Role: "user", Content: content},
+		llama.Message{Role: "assistant", Content: answer})
+	r.fresh = false
+	r.last = stats
+	r.requests++
+	r.promptToks += stats.PromptTokens
+	r.genToks += stats.GeneratedTokens
+}
+
+// command runs a slash command, it returns true to exit
+func (r *repl) command(line string) bool {
+	name, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	arg = strings.TrimSpace(arg)
+	switch name {
+	case "/bye", "/exit":
+		return true
+	case "/?", "/help":
+		printReplHelp()
+	case "/system":
+		if len(arg) == 0 {
+			if len(r.system) == 0 {
+				fmt.Println("No system message.")
+			} else {
+				fmt.Println(r.system)
+			}
+			return false
+		}
+		if err := r.reset(r.params); err != nil {
+			fmt.Printf("error: %v\n", err)
+			return false
+		}
+		r.system = arg
+		fmt.Println("Set system message.")
+	case "/set":
+		r.set(strings.Fields(arg))
+	case "/clear":
+		if err := r.reset(r.params); err != nil {
+			fmt.Printf("error: %v\n", err)
+			return false
+		}
+		r.messages = nil
+		fmt.Println("Cleared the conversation.")
+	case "/save":
+		if len(arg) == 0 {
+			fmt.Println("Usage:\n  /save <file>")
+			return false
+		}
+		if err := r.save(arg); err != nil {
+			fmt.Printf("error: %v\n", err)
+			return false
+		}
+		fmt.Printf("Saved the conversation to %s\n", arg)
+	case "/load":
+		if len(arg) == 0 {
+			fmt.Println("Usage:\n  /load <file>")
+			return false
+		}
+		if err := r.load(arg); err != nil {
+			fmt.Printf("error: %v\n", err)
+			return false
+		}
+		fmt.Printf("Loaded %d messages from %s\n", len(r.messages), arg)
+	case "/model":
+		if len(arg) == 0 {
+			fmt.Println(r.modelPath)
+			return false
+		}
+		fmt.Printf("Loading model '%s'\n", arg)
+		if err := r.loadModel(arg); err != nil {
+			fmt.Printf("error: %v\n", err)
+			return false
+		}
+		fmt.Printf("Switched to model '%s'\n", arg)
+	case "/stats":
+		r.printStats()
+	default:
+		fmt.Printf("Unknown command '%s'. Type /? for help\n", name)
+	}
+	return false
+}
+
+func printReplHelp() {
+	fmt.Println("Available commands:")
+	fmt.Println("  /system [message]     Show or set the system message, end with \"\"\" for several lines")
+	fmt.Println("  /set [name value]     Show or set a parameter")
+	fmt.Println("  /clear                Clear the conversation")
+	fmt.Println("  /save <file>          Save the conversation")
+	fmt.Println("  /load <file>          Load a conversation")
+	fmt.Println("  /model [path]         Show the model or switch to another one")
+	fmt.Println("  /stats                Show the statistics of the last answer and the session")
+	fmt.Println("  /bye                  Exit")
+	fmt.Println()
+	fmt.Println("Parameters:")
+	for _, name := range slices.Sorted(maps.Keys(optionArgs)) {
+		fmt.Printf("  %-16s  %s\n", name, optionArgs[name])
+	}
+	fmt.Println()
+	fmt.Println(`Use """ to begin a multi-line message.`)
+}
+
+// set changes a parameter, the previous value is kept when the context can
+// not be created with the new one
+func (r *repl) set(args []string) {
+	if len(args) == 0 {
+		if len(r.params) == 0 {
+			fmt.Println("No parameters set.")
+		}
+		for _, name := range slices.Sorted(maps.Keys(r.params)) {
+			fmt.Printf("  %-16s  %s\n", name, r.params[name])
+		}
+		return
+	}
+	if len(args) != 2 {
+		fmt.Println("Usage:\n  /set <name> <value>")
+		return
+	}
+	name, value := args[0], args[1]
+	if _, ok := optionArgs[name]; !ok {
+		fmt.Printf("Unknown parameter '%s'. Type /? for the parameters\n", name)
+		return
+	}
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		fmt.Printf("error: %s must be a number\n", name)
+		return
+	}
+	params := maps.Clone(r.params)
+	params[name] = value
+	if err := r.reset(params); err != nil {
+		fmt.Printf("error: %v\n", err)
+		return
+	}
+	fmt.Printf("Set parameter '%s' to '%s'\n", name, value)
+}
+
+// contextOptions are the options of the config with the parameters, which
+// override them
+func contextOptions(cfg *config.Config, params map[string]string) (*llama.ContextOptions, error) {
+	args, err := wrapper.SplitArgs(cfg.LlamaArgs)
+	if err != nil {
+		return nil, fmt.Errorf("llama-args: %w", err)
+	}
+	for _, name := range slices.Sorted(maps.Keys(params)) {
+		args = append(args, optionArgs[name], params[name])
+	}
+	return &llama.ContextOptions{
+		CtxSize:  cfg.CtxSize,
+		NPredict: cfg.NPredict,
+		Seed:     cfg.Seed,
+		Args:     args,
+	}, nil
+}
+
+// reset replaces the context by a new one with params, the conversation is
+// sent with the next message. The current context and parameters are kept
+// when the new context can not be created.
+func (r *repl) reset(params map[string]string) error {
+	opts, err := contextOptions(r.cfg, params)
+	if err != nil {
+		return err
+	}
+	c, err := r.model.NewContext(opts)
+	if err != nil {
+		return err
+	}
+	if r.ctx != nil {
+		r.ctx.Close()
+	}
+	r.ctx, r.params, r.fresh = c, params, true
+	return nil
+}
+
+// loadModel loads the model at path and moves the conversation to it, the
+// current model is kept when it fails
+func (r *repl) loadModel(path string) error {
+	m, err := llama.LoadModel(path, &llama.ModelOptions{NGpuLayers: &r.cfg.NGpuLayers})
+	if err != nil {
+		return err
+	}
+	opts, err := contextOptions(r.cfg, r.params)
+	if err != nil {
+		m.Close()
+		return err
+	}
+	c, err := m.NewContext(opts)
+	if err != nil {
+		m.Close()
+		return err
+	}
+	if r.model != nil {
+		r.model.Close()
+	}
+	r.model, r.ctx, r.modelPath, r.fresh = m, c, path, true
+	return nil
+}
+
+func (r *repl) save(path string) error {
+	conv := conversation{
+		Model:    r.modelPath,
+		System:   r.system,
+		Params:   r.params,
+		Messages: r.messages,
+	}
+	data, err := json.MarshalIndent(conv, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// load replaces the conversation, the system message and the parameters
+// with the ones of the file, they are kept when it fails. The model is not
+// changed
+func (r *repl) load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var conv conversation
+	if err := json.Unmarshal(data, &conv); err != nil {
+		return err
+	}
+	for name, value := range conv.Params {
+		if _, ok := optionArgs[name]; !ok {
+			return fmt.Errorf("unknown parameter '%s'", name)
+		}
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("parameter %s must be a number", name)
+		}
+	}
+	if conv.Params == nil {
+		conv.Params = map[string]string{}
+	}
+	if len(conv.Model) > 0 && conv.Model != r.modelPath {
+		fmt.Printf("The conversation was saved with model '%s', /model switches to it\n", conv.Model)
+	}
+	if err := r.reset(conv.Params); err != nil {
+		return err
+	}
+	r.system, r.messages = conv.System, conv.Messages
+	return nil
+}
+
+func (r *repl) printStats() {
+	fmt.Printf("Model: %s\n", r.modelPath)
+	if st := r.ctx.Status(); st.Ready {
+		fmt.Printf("Context: %d of %d tokens used, seed %d\n", st.NPast, st.CtxSize, st.Seed)
+	}
+	if r.last != nil {
+		fmt.Printf("Last answer: %d prompt tokens, %d generated tokens, first token after %s, %.2f tokens/s\n",
+			r.last.PromptTokens, r.last.GeneratedTokens, r.last.FirstTokenDuration, r.last.TokensPerSecond())
+	}
+	fmt.Printf("Session: %d messages, %d answers, %d prompt tokens, %d generated tokens\n",
+		len(r.messages), r.requests, r.promptToks, r.genToks)
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2017-2025 The qitmeer developers
+
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Qitmeer/llama.go/config"
+	"github.com/Qitmeer/llama.go/server"
+	"github.com/Qitmeer/llama.go/wrapper"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/urfave/cli/v2"
+	"io"
+	"os"
+	"time"
+)
+
+// replayDiffContext is the number of characters shown around the first difference
+const replayDiffContext = 60
+
+func replayCmd() *cli.Command {
+	return &cli.Command{
+		Name:      "replay",
+		Category:  "llama",
+		Usage:     "Run the requests of a recording against the model and compare the outputs",
+		ArgsUsage: "[recording.jsonl]",
+		Description: "Run the requests recorded with --record-file again against --model, with the seed, sampling and options of the recording. " +
+			"The requests answered by one runner are replayed in order on a new runner, since they shared its context. " +
+			"Exits with an error when an output differs.",
+		Action: func(ctx *cli.Context) error {
+			cfg := config.Conf
+			err := initLog(cfg)
+			if err != nil {
+				return err
+			}
+			err = cfg.Load()
+			if err != nil {
+				return err
+			}
+			path := ctx.Args().First()
+			if len(path) == 0 {
+				path = cfg.RecordFile
+			}
+			if len(path) == 0 {
+				return fmt.Errorf("No recording, pass its path or --record-file")
+			}
+			records, err := readRecords(path)
+			if err != nil {
+				return err
+			}
+			return replay(cfg, records)
+		},
+	}
+}
+
+// readRecords reads the records of a JSONL recording
+func readRecords(path string) ([]*server.Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []*server.Record
+	dec := json.NewDecoder(f)
+	for {
+		rec := &server.Record{}
+		err := dec.Decode(rec)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: record %d: %w", path, len(records)+1, err)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func replay(cfg *config.Config, records []*server.Record) error {
+	if len(records) == 0 {
+		return fmt.Errorf("The recording is empty")
+	}
+	digest, err := server.ModelDigest(cfg.Model)
+	if err != nil {
+		return err
+	}
+
+	var same, differ, failed int
+	for start := 0; start < len(records); {
+		end := start + 1
+		for end < len(records) && records[end].Runner == records[start].Runner {
+			end++
+		}
+		s, d, f, err := replayRunner(cfg, digest, records[start:end], start)
+		if err != nil {
+			return err
+		}
+		same, differ, failed = same+s, differ+d, failed+f
+		start = end
+	}
+	fmt.Printf("replayed %d requests: %d identical, %d different, %d failed\n", len(records), same, differ, failed)
+	if differ > 0 || failed > 0 {
+		return fmt.Errorf("%d of %d outputs differ", differ+failed, len(records))
+	}
+	return nil
+}
+
+// replayRunner replays the records of one runner on a new runner configured
+// like it, offset is the index of the first record in the recording
+func replayRunner(cfg *config.Config, digest string, records []*server.Record, offset int) (int, int, int, error) {
+	first := records[0]
+	rcfg := *cfg
+	rcfg.CtxSize = first.Options.CtxSize
+	rcfg.NPredict = first.Options.NPredict
+	rcfg.LlamaArgs = first.Options.LlamaArgs
+	rcfg.Seed = uint(first.Seed)
+	rcfg.Prompt = first.Options.Prompt
+	if len(first.ModelDigest) > 0 && first.ModelDigest != digest {
+		log.Warn("Replay with another model", "recorded", first.Model, "recorded_digest", first.ModelDigest, "model", cfg.Model, "digest", digest)
+	}
+
+	r, err := startRunner(&rcfg)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer r.Free()
+	if st := r.Status(); st.Seed != first.Seed || st.Sampling != first.Sampling {
+		log.Warn("Replay with another sampling", "recorded_seed", first.Seed, "seed", st.Seed,
+			"recorded", fmt.Sprintf("%+v", first.Sampling), "sampling", fmt.Sprintf("%+v", st.Sampling))
+	}
+
+	var same, differ, failed int
+	for i, rec := range records {
+		var content string
+		var err error
+		switch rec.Kind {
+		case server.RecordGenerate:
+			content, _, err = r.Generate(rec.Prompt, nil)
+		case server.RecordChat:
+			content, _, err = r.Chat(rec.Messages, nil)
+		default:
+			return 0, 0, 0, fmt.Errorf("record %d: unknown kind %s", offset+i+1, rec.Kind)
+		}
+		label := fmt.Sprintf("[%d] %s %s", offset+i+1, rec.Kind, rec.ID)
+		switch {
+		case err != nil && len(rec.Error) > 0:
+			fmt.Printf("%s: failed as recorded\n", label)
+			same++
+		case err != nil:
+			fmt.Printf("%s: failed: %s\n", label, err)
+			failed++
+		case len(rec.Error) > 0:
+			fmt.Printf("%s: recorded failure did not happen: %s\n", label, rec.Error)
+			differ++
+		case content == rec.Response:
+			fmt.Printf("%s: identical\n", label)
+			same++
+		default:
+			at, recorded, replayed := firstDiff(rec.Response, content)
+			fmt.Printf("%s: differs at character %d\n  recorded: %q\n  replayed: %q\n", label, at, recorded, replayed)
+			differ++
+		}
+	}
+	return same, differ, failed, nil
+}
+
+// startRunner starts a runner for cfg and waits until its model is loaded
+func startRunner(cfg *config.Config) (*wrapper.Runner, error) {
+	r, err := wrapper.NewRunner(cfg)
+	if err != nil {
+		return nil, err
+	}
+	started := make(chan error, 1)
+	go func() {
+		started <- r.Start()
+	}()
+
+	ticker := time.NewTicker(reloadPollInterval)
+	defer ticker.Stop()
+	for !r.Status().Ready {
+		select {
+		case err := <-started:
+			r.Free()
+			if err == nil {
+				err = fmt.Errorf("runner stopped while loading")
+			}
+			return nil, fmt.Errorf("Load model %s failed: %w", cfg.Model, err)
+		case <-ticker.C:
+		}
+	}
+	return r, nil
+}
+
+// firstDiff returns the index of the first different character of a and b
+// and both texts from a little before it
+func firstDiff(a, b string) (int, string, string) {
+	ra, rb := []rune(a), []rune(b)
+	i := 0
+	for i < len(ra) && i < len(rb) && ra[i] == rb[i] {
+		i++
+	}
+	from := max(i-replayDiffContext/2, 0)
+	return i, excerpt(ra, from), excerpt(rb, from)
+}
+
+func excerpt(r []rune, from int) string {
+	if from >= len(r) {
+		return ""
+	}
+	s := r[from:]
+	if len(s) > replayDiffContext {
+		return string(s[:replayDiffContext]) + "..."
+	}
+	return string(s)
+}
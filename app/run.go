@@ -7,6 +7,7 @@ import (
 	"github.com/Qitmeer/llama.go/system"
 	"github.com/Qitmeer/llama.go/system/limits"
 	"github.com/Qitmeer/llama.go/version"
+	"github.com/ethereum/go-ethereum/log"
 	"github.com/urfave/cli/v2"
 	"os"
 )
@@ -25,6 +26,9 @@ func Run() error {
 		Flags:                config.AppFlags,
 		EnableBashCompletion: true,
 		Commands:             commands(),
+		Before: func(c *cli.Context) error {
+			return config.Conf.LoadFile(c)
+		},
 		Action: func(c *cli.Context) error {
 			err := limits.SetLimits()
 			if err != nil {
@@ -38,7 +42,18 @@ func Run() error {
 				return err
 			}
 			if !config.Conf.IsLonely() {
-				<-interrupt
+				reload := system.ReloadListener()
+			wait:
+				for {
+					select {
+					case <-interrupt:
+						break wait
+					case <-reload:
+						if err := a.Reload(); err != nil {
+							log.Error(err.Error())
+						}
+					}
+				}
 			}
 			return a.Stop()
 		},
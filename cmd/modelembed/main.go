@@ -37,7 +37,7 @@ func main() {
 	flag.StringVar(&prompt, "p", "Hello! How can I help you today?", "Initial prompt")
 	flag.BoolVar(&interactive, "i", false, "Interactive mode")
 	flag.IntVar(&contextSize, "ctx", 2048, "Context size")
-	flag.IntVar(&nGpuLayers, "ngl", 0, "Number of GPU layers")
+	flag.IntVar(&nGpuLayers, "ngl", -1, "Number of GPU layers, -1 for the default")
 	flag.IntVar(&nPredict, "n", 512, "Number of tokens to predict")
 	flag.UintVar(&seed, "seed", 42, "Random seed")
 	flag.BoolVar(&useMemory, "memory", false, "Load model from memory buffer")
@@ -164,7 +164,7 @@ func main() {
 				break
 			}
 
-			response, err := wrapper.LlamaGenerate(input)
+			response, _, err := wrapper.LlamaGenerate(input)
 			if err != nil {
 				fmt.Printf("Error: %v\n", err)
 				continue
@@ -176,7 +176,7 @@ func main() {
 		fmt.Printf("\nPrompt: %s\n", prompt)
 		fmt.Println("-------------------------------")
 
-		response, err := wrapper.LlamaGenerate(prompt)
+		response, _, err := wrapper.LlamaGenerate(prompt)
 		if err != nil {
 			log.Fatalf("Generation failed: %v", err)
 		}
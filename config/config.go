@@ -3,23 +3,31 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/urfave/cli/v2"
 	"math"
 	"net"
 	"net/url"
+	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
-	defaultLogLevel = "info"
-	defaultNPredict = 512
-	DefaultHost     = "127.0.0.1:8081"
-	DefaultPort     = "8081"
+	defaultLogLevel        = "info"
+	defaultLogFormat       = "terminal"
+	defaultLogMaxSize      = 100
+	defaultLogMaxBackups   = 5
+	defaultNPredict        = 512
+	defaultShutdownTimeout = 30 * time.Second
+	DefaultHost            = "127.0.0.1:8081"
+	DefaultPort            = "8081"
 )
 
 var (
@@ -30,18 +38,79 @@ var (
 var (
 	Conf = &Config{}
 
+	ConfigFile = &cli.StringFlag{
+		Name:        "config",
+		Usage:       "Path of a YAML or TOML config file, its keys are the option names and a \"models\" table holds per-model sections selected by --model. Options and LLAMAGO_* environment variables take precedence",
+		EnvVars:     []string{"LLAMAGO_CONFIG"},
+		Destination: &Conf.ConfigFile,
+	}
+
 	LogLevel = &cli.StringFlag{
 		Name:        "log-level",
 		Aliases:     []string{"l"},
 		Usage:       "Logging level {trace, debug, info, warn, error}",
 		Value:       defaultLogLevel,
+		EnvVars:     []string{"LLAMAGO_LOG_LEVEL"},
 		Destination: &Conf.LogLevel,
 	}
 
+	LogFormat = &cli.StringFlag{
+		Name:        "log-format",
+		Usage:       "Logging format {terminal, json}",
+		Value:       defaultLogFormat,
+		EnvVars:     []string{"LLAMAGO_LOG_FORMAT"},
+		Destination: &Conf.LogFormat,
+	}
+
+	LogFile = &cli.StringFlag{
+		Name:        "log-file",
+		Usage:       "Write the logs to this file instead of the standard output",
+		EnvVars:     []string{"LLAMAGO_LOG_FILE"},
+		Destination: &Conf.LogFile,
+	}
+
+	LogMaxSize = &cli.IntFlag{
+		Name:        "log-max-size",
+		Usage:       "Size in MB at which the log file is rotated, 0 never rotates it",
+		Value:       defaultLogMaxSize,
+		EnvVars:     []string{"LLAMAGO_LOG_MAX_SIZE"},
+		Destination: &Conf.LogMaxSize,
+	}
+
+	LogMaxBackups = &cli.IntFlag{
+		Name:        "log-max-backups",
+		Usage:       "Number of rotated log files kept as <log-file>.1, <log-file>.2...",
+		Value:       defaultLogMaxBackups,
+		EnvVars:     []string{"LLAMAGO_LOG_MAX_BACKUPS"},
+		Destination: &Conf.LogMaxBackups,
+	}
+
+	AccessLogRedact = &cli.BoolFlag{
+		Name:        "access-log-redact",
+		Usage:       "Leave the prompt text out of the access log",
+		EnvVars:     []string{"LLAMAGO_ACCESS_LOG_REDACT"},
+		Destination: &Conf.AccessLogRedact,
+	}
+
+	RecordFile = &cli.StringFlag{
+		Name:        "record-file",
+		Usage:       "Append every generate and chat request with its sampling, seed, model digest and response to this JSONL file, for the replay command",
+		EnvVars:     []string{"LLAMAGO_RECORD_FILE"},
+		Destination: &Conf.RecordFile,
+	}
+
+	BatchDir = &cli.StringFlag{
+		Name:        "batch-dir",
+		Usage:       "Directory keeping the files and jobs of the batch API (/v1/files, /v1/batches), the API is disabled without it",
+		EnvVars:     []string{"LLAMAGO_BATCH_DIR"},
+		Destination: &Conf.BatchDir,
+	}
+
 	Model = &cli.StringFlag{
 		Name:        "model",
 		Aliases:     []string{"m"},
 		Usage:       "Specify the path to the LLaMA model file",
+		EnvVars:     []string{"LLAMAGO_MODEL"},
 		Destination: &Conf.Model,
 	}
 
@@ -50,6 +119,7 @@ var (
 		Aliases:     []string{"c"},
 		Usage:       "Set the size of the prompt context. The default is 4096, but if a LLaMA model was built with a longer context, increasing this value will provide better results for longer input/inference",
 		Value:       4096,
+		EnvVars:     []string{"LLAMAGO_CTX_SIZE"},
 		Destination: &Conf.CtxSize,
 	}
 
@@ -57,14 +127,24 @@ var (
 		Name:        "prompt",
 		Aliases:     []string{"p"},
 		Usage:       "Provide a prompt directly as a command-line option.",
+		EnvVars:     []string{"LLAMAGO_PROMPT"},
 		Destination: &Conf.Prompt,
 	}
 
+	File = &cli.StringFlag{
+		Name:        "file",
+		Aliases:     []string{"f"},
+		Usage:       "Read the prompt from this file, - reads it from the standard input",
+		EnvVars:     []string{"LLAMAGO_FILE"},
+		Destination: &Conf.File,
+	}
+
 	NGpuLayers = &cli.IntFlag{
 		Name:        "n-gpu-layers",
 		Aliases:     []string{"ngl"},
 		Usage:       "When compiled with GPU support, this option allows offloading some layers to the GPU for computation. Generally results in increased performance.",
 		Value:       -1,
+		EnvVars:     []string{"LLAMAGO_N_GPU_LAYERS"},
 		Destination: &Conf.NGpuLayers,
 	}
 
@@ -73,6 +153,7 @@ var (
 		Aliases:     []string{"n"},
 		Usage:       "Set the number of tokens to predict when generating text. Adjusting this value can influence the length of the generated text.",
 		Value:       defaultNPredict,
+		EnvVars:     []string{"LLAMAGO_N_PREDICT"},
 		Destination: &Conf.NPredict,
 	}
 
@@ -81,6 +162,7 @@ var (
 		Aliases:     []string{"i"},
 		Usage:       "Run the program in interactive mode, allowing you to provide input directly and receive real-time responses",
 		Value:       false,
+		EnvVars:     []string{"LLAMAGO_INTERACTIVE"},
 		Destination: &Conf.Interactive,
 	}
 
@@ -89,6 +171,7 @@ var (
 		Aliases:     []string{"s"},
 		Usage:       "Set the random number generator (RNG) seed (default: -1, -1 = random seed).",
 		Value:       math.MaxUint32,
+		EnvVars:     []string{"LLAMAGO_SEED"},
 		Destination: &Conf.Seed,
 	}
 
@@ -97,6 +180,7 @@ var (
 		Aliases:     []string{"o"},
 		Usage:       "pooling type for embeddings, use model default if unspecified {none,mean,cls,last,rank}",
 		Value:       "mean",
+		EnvVars:     []string{"LLAMAGO_POOLING"},
 		Destination: &Conf.Pooling,
 	}
 
@@ -105,6 +189,7 @@ var (
 		Aliases:     []string{"N"},
 		Usage:       "normalisation for embeddings (default: %d) (-1=none, 0=max absolute int16, 1=taxicab, 2=euclidean, >2=p-norm)",
 		Value:       2,
+		EnvVars:     []string{"LLAMAGO_EMBD_NORMALIZE"},
 		Destination: &Conf.EmbdNormalize,
 	}
 
@@ -113,6 +198,7 @@ var (
 		Aliases:     []string{"FORMAT"},
 		Usage:       "empty = default, \"array\" = [[],[]...], \"json\" = openai style, \"json+\" = same \"json\" + cosine similarity matrix",
 		Value:       "json",
+		EnvVars:     []string{"LLAMAGO_EMBD_OUTPUT_FORMAT"},
 		Destination: &Conf.EmbdOutputFormat,
 	}
 
@@ -121,6 +207,7 @@ var (
 		Aliases:     []string{"STRING"},
 		Usage:       "separator of embeddings (default \\n) for example \"<#sep#>\\",
 		Value:       "<#sep#>",
+		EnvVars:     []string{"LLAMAGO_EMBD_SEPARATOR"},
 		Destination: &Conf.EmbdSeparator,
 	}
 
@@ -129,6 +216,7 @@ var (
 		Aliases:     []string{"b"},
 		Usage:       "logical maximum batch size",
 		Value:       2048,
+		EnvVars:     []string{"LLAMAGO_BATCH_SIZE"},
 		Destination: &Conf.BatchSize,
 	}
 
@@ -137,25 +225,42 @@ var (
 		Aliases:     []string{"ub"},
 		Usage:       "physical maximum batch size",
 		Value:       512,
+		EnvVars:     []string{"LLAMAGO_UBATCH_SIZE"},
 		Destination: &Conf.UBatchSize,
 	}
 
+	LlamaArgs = &cli.StringFlag{
+		Name:        "llama-args",
+		Usage:       "Extra llama.cpp options of the runner separated by spaces, for example \"--threads 8 --flash-attn --cache-type-k q8_0 --mlock --keep 256\". They override the options above and unknown ones are rejected at startup",
+		EnvVars:     []string{"LLAMAGO_LLAMA_ARGS"},
+		Destination: &Conf.LlamaArgs,
+	}
+
 	OutputFile = &cli.StringFlag{
 		Name:        "output-file",
 		Aliases:     []string{"of"},
 		Usage:       "output file",
+		EnvVars:     []string{"LLAMAGO_OUTPUT_FILE"},
 		Destination: &Conf.OutputFile,
 	}
 
 	Host = &cli.StringFlag{
 		Name:        "host",
 		Aliases:     []string{"ho"},
-		Usage:       fmt.Sprintf("IP Address for the ollama server (default %s)", DefaultHost),
+		Usage:       fmt.Sprintf("A comma separated list of addresses for the ollama server, unix:///path/to.sock listens on a Unix domain socket (default %s)", DefaultHost),
 		Value:       DefaultHost,
 		EnvVars:     []string{"LLAMAGO_HOST"},
 		Destination: &Conf.Host,
 	}
 
+	UnixSocketMode = &cli.StringFlag{
+		Name:        "unix-socket-mode",
+		Usage:       "Octal file permissions of the Unix domain sockets of --host",
+		Value:       "0660",
+		EnvVars:     []string{"LLAMAGO_UNIX_SOCKET_MODE"},
+		Destination: &Conf.UnixSocketMode,
+	}
+
 	Origins = &cli.StringFlag{
 		Name:        "origins",
 		Aliases:     []string{"or"},
@@ -164,11 +269,126 @@ var (
 		Destination: &Conf.Origins,
 	}
 
+	AllowedHosts = &cli.StringFlag{
+		Name:        "allowed-hosts",
+		Usage:       "A comma separated list of allowed Host headers when listening on loopback, \".example.com\" allows subdomains and \"*\" any host (default localhost, the hostname, private IPs and .localhost/.local/.internal)",
+		EnvVars:     []string{"LLAMAGO_ALLOWED_HOSTS"},
+		Destination: &Conf.AllowedHosts,
+	}
+
+	AllowCIDRs = &cli.StringFlag{
+		Name:        "allow-cidrs",
+		Usage:       "A comma separated list of client CIDRs allowed to connect, empty allows all",
+		EnvVars:     []string{"LLAMAGO_ALLOW_CIDRS"},
+		Destination: &Conf.AllowCIDRs,
+	}
+
+	DenyCIDRs = &cli.StringFlag{
+		Name:        "deny-cidrs",
+		Usage:       "A comma separated list of client CIDRs denied to connect, takes precedence over --allow-cidrs",
+		EnvVars:     []string{"LLAMAGO_DENY_CIDRS"},
+		Destination: &Conf.DenyCIDRs,
+	}
+
+	TrustedProxies = &cli.StringFlag{
+		Name:        "trusted-proxies",
+		Usage:       "A comma separated list of reverse proxy IPs or CIDRs whose X-Forwarded-For header is trusted for the client IP",
+		EnvVars:     []string{"LLAMAGO_TRUSTED_PROXIES"},
+		Destination: &Conf.TrustedProxies,
+	}
+
+	BasePath = &cli.StringFlag{
+		Name:        "base-path",
+		Usage:       "URL path prefix of every route, for example /llm (default the path of --host)",
+		EnvVars:     []string{"LLAMAGO_BASE_PATH"},
+		Destination: &Conf.BasePath,
+	}
+
+	ApiKeys = &cli.StringFlag{
+		Name:        "api-keys",
+		Usage:       "A comma separated list of id:secret API keys with full access, enables bearer authentication",
+		EnvVars:     []string{"LLAMAGO_API_KEYS"},
+		Destination: &Conf.ApiKeys,
+	}
+
+	ApiKeysFile = &cli.StringFlag{
+		Name:        "api-keys-file",
+		Usage:       "Path of a JSON file of API keys with optional route and model scopes, reloaded when it changes",
+		EnvVars:     []string{"LLAMAGO_API_KEYS_FILE"},
+		Destination: &Conf.ApiKeysFile,
+	}
+
+	AdminModelPaths = &cli.BoolFlag{
+		Name:        "admin-model-paths",
+		Usage:       "Allow the admin reload to load a model path that is not a section of the config file when no API keys are configured",
+		EnvVars:     []string{"LLAMAGO_ADMIN_MODEL_PATHS"},
+		Destination: &Conf.AdminModelPaths,
+	}
+
+	TLSCert = &cli.StringFlag{
+		Name:        "tls-cert",
+		Usage:       "Path of the PEM certificate (chain) to serve HTTPS, reloaded when it changes",
+		EnvVars:     []string{"LLAMAGO_TLS_CERT"},
+		Destination: &Conf.TLSCert,
+	}
+
+	TLSKey = &cli.StringFlag{
+		Name:        "tls-key",
+		Usage:       "Path of the PEM private key of --tls-cert",
+		EnvVars:     []string{"LLAMAGO_TLS_KEY"},
+		Destination: &Conf.TLSKey,
+	}
+
+	TLSClientCA = &cli.StringFlag{
+		Name:        "tls-client-ca",
+		Usage:       "Path of a PEM CA bundle, requires and verifies client certificates (mTLS)",
+		EnvVars:     []string{"LLAMAGO_TLS_CLIENT_CA"},
+		Destination: &Conf.TLSClientCA,
+	}
+
+	RateLimitRPM = &cli.IntFlag{
+		Name:        "rate-limit-rpm",
+		Usage:       "Maximum requests per minute of each API key or client IP, 0 is unlimited",
+		EnvVars:     []string{"LLAMAGO_RATE_LIMIT_RPM"},
+		Destination: &Conf.RateLimitRPM,
+	}
+
+	RateLimitTPM = &cli.IntFlag{
+		Name:        "rate-limit-tpm",
+		Usage:       "Maximum generated tokens per minute of each API key or client IP, 0 is unlimited",
+		EnvVars:     []string{"LLAMAGO_RATE_LIMIT_TPM"},
+		Destination: &Conf.RateLimitTPM,
+	}
+
+	RateLimitFile = &cli.StringFlag{
+		Name:        "rate-limit-file",
+		Usage:       "Path of a file to persist the rate limit counters across restarts",
+		EnvVars:     []string{"LLAMAGO_RATE_LIMIT_FILE"},
+		Destination: &Conf.RateLimitFile,
+	}
+
+	ShutdownTimeout = &cli.DurationFlag{
+		Name:        "shutdown-timeout",
+		Usage:       "Grace period for in-flight requests to finish on shutdown before they are cancelled",
+		Value:       defaultShutdownTimeout,
+		EnvVars:     []string{"LLAMAGO_SHUTDOWN_TIMEOUT"},
+		Destination: &Conf.ShutdownTimeout,
+	}
+
 	AppFlags = []cli.Flag{
+		ConfigFile,
 		LogLevel,
+		LogFormat,
+		LogFile,
+		LogMaxSize,
+		LogMaxBackups,
+		AccessLogRedact,
+		RecordFile,
+		BatchDir,
 		Model,
 		CtxSize,
 		Prompt,
+		File,
 		NGpuLayers,
 		NPredict,
 		Interactive,
@@ -179,17 +399,43 @@ var (
 		EmbdSeparator,
 		BatchSize,
 		UBatchSize,
+		LlamaArgs,
 		OutputFile,
 		Host,
+		UnixSocketMode,
 		Origins,
+		AllowedHosts,
+		AllowCIDRs,
+		DenyCIDRs,
+		TrustedProxies,
+		BasePath,
+		ApiKeys,
+		ApiKeysFile,
+		AdminModelPaths,
+		TLSCert,
+		TLSKey,
+		TLSClientCA,
+		RateLimitRPM,
+		RateLimitTPM,
+		RateLimitFile,
+		ShutdownTimeout,
 	}
 )
 
 type Config struct {
+	ConfigFile       string
 	LogLevel         string
+	LogFormat        string
+	LogFile          string
+	LogMaxSize       int
+	LogMaxBackups    int
+	AccessLogRedact  bool
+	RecordFile       string
+	BatchDir         string
 	Model            string
 	CtxSize          int
 	Prompt           string
+	File             string
 	NGpuLayers       int
 	NPredict         int
 	Interactive      bool
@@ -200,21 +446,109 @@ type Config struct {
 	EmbdSeparator    string
 	BatchSize        int
 	UBatchSize       int
+	LlamaArgs        string
 	OutputFile       string
 	Host             string
+	UnixSocketMode   string
 	Origins          string
+	AllowedHosts     string
+	AllowCIDRs       string
+	DenyCIDRs        string
+	TrustedProxies   string
+	BasePath         string
+	ApiKeys          string
+	ApiKeysFile      string
+	AdminModelPaths  bool
+	TLSCert          string
+	TLSKey           string
+	TLSClientCA      string
+	RateLimitRPM     int
+	RateLimitTPM     int
+	RateLimitFile    string
+	ShutdownTimeout  time.Duration
+
+	// the options set on the command line or the environment, the config file does not override them
+	explicit map[string]bool
+	// the per-model section of the config file selected by --model
+	section string
 }
 
+// Load validates the config and reports every invalid option at once
 func (c *Config) Load() error {
 	log.Debug("Try to load config")
+	var errs []error
 	if len(c.Model) <= 0 {
-		return fmt.Errorf("No config model")
+		errs = append(errs, fmt.Errorf("No config model"))
+	}
+	if !slices.Contains([]string{"trace", "debug", "info", "warn", "error"}, c.LogLevel) {
+		errs = append(errs, fmt.Errorf("log-level %s is not one of trace, debug, info, warn, error", c.LogLevel))
+	}
+	if !slices.Contains([]string{"terminal", "json"}, c.LogFormat) {
+		errs = append(errs, fmt.Errorf("log-format %s is not one of terminal, json", c.LogFormat))
+	}
+	if c.LogMaxSize < 0 || c.LogMaxBackups < 0 {
+		errs = append(errs, fmt.Errorf("log-max-size and log-max-backups must not be negative"))
+	}
+	if c.CtxSize < 0 {
+		errs = append(errs, fmt.Errorf("ctx-size %d must be 0 (model default) or positive", c.CtxSize))
+	}
+	if c.NGpuLayers < -1 {
+		errs = append(errs, fmt.Errorf("n-gpu-layers %d must be -1 (the llama.cpp default) or more", c.NGpuLayers))
+	}
+	if c.NPredict < -2 {
+		errs = append(errs, fmt.Errorf("n-predict %d must be -2 (until context is full), -1 (infinite) or more", c.NPredict))
+	}
+	if c.BatchSize < 1 {
+		errs = append(errs, fmt.Errorf("batch-size %d must be positive", c.BatchSize))
+	}
+	if c.UBatchSize < 1 {
+		errs = append(errs, fmt.Errorf("ubatch-size %d must be positive", c.UBatchSize))
+	} else if c.UBatchSize > c.BatchSize {
+		errs = append(errs, fmt.Errorf("ubatch-size %d must not exceed batch-size %d", c.UBatchSize, c.BatchSize))
+	}
+	// empty uses the pooling of the model
+	if !slices.Contains([]string{"", "none", "mean", "cls", "last", "rank"}, c.Pooling) {
+		errs = append(errs, fmt.Errorf("pooling %s is not one of none, mean, cls, last, rank", c.Pooling))
+	}
+	if c.EmbdNormalize < -1 {
+		errs = append(errs, fmt.Errorf("embd-normalize %d must be -1 (none), 0 (int16), 1 (taxicab), 2 (euclidean) or a p-norm above 2", c.EmbdNormalize))
+	}
+	if !slices.Contains([]string{"", "array", "json", "json+"}, c.EmbdOutputFormat) {
+		errs = append(errs, fmt.Errorf("embd-output-format %s is not one of array, json, json+", c.EmbdOutputFormat))
+	}
+	if _, err := c.SocketMode(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.RateLimitRPM < 0 || c.RateLimitTPM < 0 {
+		errs = append(errs, fmt.Errorf("rate-limit-rpm and rate-limit-tpm must not be negative"))
+	}
+	if c.ShutdownTimeout < 0 {
+		errs = append(errs, fmt.Errorf("shutdown-timeout %s must not be negative", c.ShutdownTimeout))
+	}
+	if (len(c.TLSCert) > 0) != (len(c.TLSKey) > 0) {
+		errs = append(errs, fmt.Errorf("tls-cert and tls-key must be set together"))
 	}
-	return nil
+	https := slices.ContainsFunc(c.HostURLs(), func(u *url.URL) bool { return u.Scheme == "https" })
+	if https && !c.TLSEnabled() {
+		errs = append(errs, fmt.Errorf("https hosts need tls-cert and tls-key"))
+	} else if !https && c.TLSEnabled() {
+		errs = append(errs, fmt.Errorf("tls-cert is set but no host is https://"))
+	}
+	if len(c.File) > 0 && len(c.Prompt) > 0 {
+		errs = append(errs, fmt.Errorf("prompt and file must not be set together"))
+	}
+	return errors.Join(errs...)
+}
+
+// TLSEnabled reports whether the server serves HTTPS
+func (c *Config) TLSEnabled() bool {
+	return len(c.TLSCert) > 0 || len(c.TLSKey) > 0
 }
 
+// IsLonely reports whether the model runs a prompt or the interactive mode
+// instead of the server
 func (c *Config) IsLonely() bool {
-	return len(c.Prompt) > 0 || c.Interactive
+	return len(c.Prompt) > 0 || len(c.File) > 0 || c.Interactive
 }
 
 func defaultNGpuLayers() int {
@@ -225,13 +559,41 @@ func defaultNGpuLayers() int {
 	return 0
 }
 
+// HostURL returns the first address of the server
 func (c *Config) HostURL() *url.URL {
+	return c.HostURLs()[0]
+}
+
+// HostURLs returns every address of the server, the unix scheme keeps the socket path in Path
+func (c *Config) HostURLs() []*url.URL {
+	hosts := SplitList(c.Host)
+	if len(hosts) <= 0 {
+		hosts = []string{""}
+	}
+	urls := make([]*url.URL, 0, len(hosts))
+	for _, h := range hosts {
+		urls = append(urls, parseHostURL(h))
+	}
+	return urls
+}
+
+// SocketMode returns the file permissions of the Unix domain sockets
+func (c *Config) SocketMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(c.UnixSocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid unix socket mode %s", c.UnixSocketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+func parseHostURL(chost string) *url.URL {
 	defaultPort := DefaultPort
-	chost := c.Host
 	scheme, hostport, ok := strings.Cut(chost, "://")
 	switch {
 	case !ok:
 		scheme, hostport = "http", chost
+	case scheme == "unix":
+		return &url.URL{Scheme: scheme, Path: hostport}
 	case scheme == "http":
 		defaultPort = "80"
 	case scheme == "https":
@@ -261,6 +623,35 @@ func (c *Config) HostURL() *url.URL {
 	}
 }
 
+// URLPrefix returns the normalized base path of the routes, empty when served at the root
+func (c *Config) URLPrefix() string {
+	p := c.BasePath
+	if len(p) <= 0 {
+		for _, u := range c.HostURLs() {
+			if u.Scheme != "unix" {
+				p = u.Path
+				break
+			}
+		}
+	}
+	p = strings.Trim(p, "/")
+	if len(p) <= 0 {
+		return ""
+	}
+	return "/" + p
+}
+
+// SplitList splits a comma separated option, dropping empty entries
+func SplitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
 // AllowedOrigins returns a list of allowed origins. AllowedOrigins can be configured via the LLAMAGO_ORIGINS environment variable.
 func (c *Config) AllowedOrigins() []string {
 	origins := []string{}
@@ -0,0 +1,249 @@
+// Copyright (c) 2017-2025 The qitmeer developers
+
+package config
+
+import (
+	"fmt"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// modelsKey is the table of per-model sections in the config file
+const modelsKey = "models"
+
+type flagField struct {
+	index int
+	value any
+}
+
+// flagFields maps the option names to the fields of Config they set and their default
+var flagFields = func() map[string]flagField {
+	fields := map[string]flagField{}
+	conf := reflect.ValueOf(Conf).Elem()
+	for _, f := range AppFlags {
+		dest, value := flagDestination(f)
+		if dest == nil {
+			continue
+		}
+		for i := 0; i < conf.NumField(); i++ {
+			if conf.Field(i).CanAddr() && conf.Field(i).Addr().Pointer() == reflect.ValueOf(dest).Pointer() {
+				fields[f.Names()[0]] = flagField{index: i, value: value}
+			}
+		}
+	}
+	return fields
+}()
+
+func flagDestination(f cli.Flag) (any, any) {
+	switch f := f.(type) {
+	case *cli.StringFlag:
+		return f.Destination, f.Value
+	case *cli.IntFlag:
+		return f.Destination, f.Value
+	case *cli.UintFlag:
+		return f.Destination, f.Value
+	case *cli.BoolFlag:
+		return f.Destination, f.Value
+	case *cli.DurationFlag:
+		return f.Destination, f.Value
+	}
+	return nil, nil
+}
+
+// LoadFile applies the config file to the options not set on the command line
+// or in the environment
+func (c *Config) LoadFile(ctx *cli.Context) error {
+	c.explicit = map[string]bool{}
+	for name := range flagFields {
+		if ctx.IsSet(name) {
+			c.explicit[name] = true
+		}
+	}
+	if len(c.ConfigFile) <= 0 {
+		return nil
+	}
+	return c.applyFile(c.Model)
+}
+
+// Reread returns a copy of the config with the config file read again, model
+// selects a section of the file or else is the model path, empty keeps the current model
+func (c *Config) Reread(model string) (*Config, error) {
+	nc := *c
+	if len(model) <= 0 {
+		model = c.section
+		if len(model) <= 0 {
+			model = c.Model
+		}
+	}
+	if len(c.ConfigFile) <= 0 {
+		nc.Model = model
+		return &nc, nil
+	}
+	// forget the values of the previous file and model section
+	conf := reflect.ValueOf(&nc).Elem()
+	for name, f := range flagFields {
+		if !nc.explicit[name] && name != ConfigFile.Name {
+			if err := setField(conf.Field(f.index), f.value, ","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	nc.section = ""
+	nc.Model = model
+	if err := nc.applyFile(model); err != nil {
+		return nil, err
+	}
+	return &nc, nil
+}
+
+// Section returns the model section of the config file the config uses,
+// empty when the model is a path
+func (c *Config) Section() string {
+	return c.section
+}
+
+func readConfigFile(name string) (map[string]any, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]any{}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	default:
+		return nil, fmt.Errorf("config file %s: unknown format, use .yaml, .yml or .toml", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", name, err)
+	}
+	return values, nil
+}
+
+func (c *Config) applyFile(model string) error {
+	values, err := readConfigFile(c.ConfigFile)
+	if err != nil {
+		return err
+	}
+	var models map[string]any
+	if m, ok := values[modelsKey]; ok {
+		models, ok = m.(map[string]any)
+		if !ok {
+			return fmt.Errorf("config file %s: %s must be a table of model sections", c.ConfigFile, modelsKey)
+		}
+		delete(values, modelsKey)
+	}
+	if err := c.applyValues(values, false); err != nil {
+		return fmt.Errorf("config file %s: %w", c.ConfigFile, err)
+	}
+
+	// the model option names a section, or the file itself selects one
+	if len(model) <= 0 {
+		model = c.Model
+	}
+	if m, ok := models[model]; ok {
+		section, ok := m.(map[string]any)
+		if !ok {
+			return fmt.Errorf("config file %s: model section %s must be a table", c.ConfigFile, model)
+		}
+		c.section = model
+		c.Model = model
+		if err := c.applyValues(section, true); err != nil {
+			return fmt.Errorf("config file %s, model %s: %w", c.ConfigFile, model, err)
+		}
+	} else if len(model) > 0 {
+		c.Model = model
+	}
+	log.Debug("Load config file", "file", c.ConfigFile, "model", c.Model, "section", c.section)
+	return nil
+}
+
+// applyValues sets the options of the file, a model section also overrides the model path
+func (c *Config) applyValues(values map[string]any, section bool) error {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	conf := reflect.ValueOf(c).Elem()
+	for _, k := range keys {
+		f, ok := flagFields[k]
+		if !ok || k == ConfigFile.Name {
+			return fmt.Errorf("unknown option %s", k)
+		}
+		if c.explicit[k] && !(section && k == Model.Name) {
+			continue
+		}
+		if err := setField(conf.Field(f.index), values[k], listSeparator(k)); err != nil {
+			return fmt.Errorf("option %s: %w", k, err)
+		}
+	}
+	return nil
+}
+
+// listSeparator joins the items of a list in the config file, llama-args are
+// separated by spaces and the other list options by commas
+func listSeparator(name string) string {
+	if name == LlamaArgs.Name {
+		return " "
+	}
+	return ","
+}
+
+func setField(field reflect.Value, v any, sep string) error {
+	var s string
+	switch v := v.(type) {
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, fmt.Sprint(item))
+		}
+		s = strings.Join(items, sep)
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(s)
+	case int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("invalid integer %s", s)
+		}
+		field.SetInt(int64(n))
+	case uint:
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid unsigned integer %s", s)
+		}
+		field.SetUint(n)
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %s", s)
+		}
+		field.SetBool(b)
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid duration %s", s)
+		}
+		field.SetInt(int64(d))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
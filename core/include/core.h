@@ -1,6 +1,8 @@
 #pragma once
 
+#include "core_types.h"
 #include "generate.h"
 #include "interactive.h"
 #include "process.h"
-#include "embedding.h"
\ No newline at end of file
+#include "embedding.h"
+#include "tokenize.h"
\ No newline at end of file
@@ -0,0 +1,63 @@
+#ifndef CORE_TYPES_H
+#define CORE_TYPES_H
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+// Result codes of the functions taking a struct llama_core_error
+enum llama_core_code {
+    LLAMA_CORE_OK = 0,
+    LLAMA_CORE_ERR_ARGS = 1,        // invalid arguments or llama.cpp options
+    LLAMA_CORE_ERR_NOT_STARTED = 2, // no runner is started
+    LLAMA_CORE_ERR_LOAD = 3,        // the model could not be loaded
+    LLAMA_CORE_ERR_STOPPED = 4,     // the runner stopped before completing
+    LLAMA_CORE_ERR_RUN = 5,         // the request failed
+    LLAMA_CORE_ERR_MODEL_NOT_FOUND = 6,  // the model file does not exist
+    LLAMA_CORE_ERR_MODEL_INVALID = 7,    // the model file can not be read
+    LLAMA_CORE_ERR_OUT_OF_MEMORY = 8,    // a buffer could not be allocated
+    LLAMA_CORE_ERR_CONTEXT_OVERFLOW = 9, // the input does not fit the context
+    LLAMA_CORE_ERR_TOKENIZE = 10,        // the text could not be tokenized
+};
+
+// Error of a failed call, err arguments may be NULL or point to a zeroed
+// struct. The message is allocated by the library and released with
+// llama_core_error_free.
+struct llama_core_error {
+    int code;
+    char *message;
+};
+void llama_core_error_free(struct llama_core_error *err);
+
+// Releases the strings and buffers returned by the library
+void llama_core_free(void *ptr);
+
+// Levels of the log lines, the values of the matching ggml_log_level
+enum llama_core_log_level {
+    LLAMA_CORE_LOG_DEBUG = 1,
+    LLAMA_CORE_LOG_INFO = 2,
+    LLAMA_CORE_LOG_WARN = 3,
+    LLAMA_CORE_LOG_ERROR = 4,
+};
+
+// Receives the log lines of llama.cpp and of the library one at a time,
+// without their newline. It may be called from any thread.
+typedef void (*llama_core_log_callback)(int level, const char *text);
+
+// Sends the log lines from level up to callback, NULL restores the output of
+// llama.cpp. The console output of the interactive mode is not affected.
+void llama_core_log_set(llama_core_log_callback callback, int level);
+
+// Command line of a runner or an embedding: argv[0] is the program name and
+// every option and value is an item of its own, so values may contain
+// spaces. The items are copied by the callee.
+struct llama_args {
+    int argc;
+    const char **argv;
+};
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif // CORE_TYPES_H
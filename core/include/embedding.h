@@ -1,10 +1,17 @@
 #pragma once
 
+#include "core_types.h"
+
 #ifdef __cplusplus
 extern "C" {
 #endif
 
-const char * llama_embedding(const char * args,const char * prompt);
+// Computes the embeddings of the prompt, split by --embd-separator, and sets
+// result to them in the --embd-output-format. Returns a llama_core_code, the
+// result is released with llama_core_free.
+int llama_embedding(const struct llama_args * args, const char * prompt, char ** result, struct llama_core_error * err);
+// Same with a model of llama_core_model_load instead of the one of args
+int llama_core_model_embedding(void * model, const struct llama_args * args, const char * prompt, char ** result, struct llama_core_error * err);
 
 #ifdef __cplusplus
 }
@@ -1,23 +1,115 @@
 #ifndef PROCESS_H
 #define PROCESS_H
 
+#include "core_types.h"
 #include <stddef.h>
 
 #ifdef __cplusplus
 extern "C" {
 #endif
 
-// Original functions
-int llama_start(const char *args, int async, const char *prompt);
-int llama_stop();
-const char *llama_gen(const char *prompt);
-const char *llama_chat(const char **roles, const char **contents, int size);
+// Timings and token counts of one generation
+struct llama_gen_stats {
+    int n_prompt;      // prompt tokens evaluated
+    int n_gen;         // tokens generated
+    double t_queue_ms; // waiting in the queue
+    double t_first_ms; // from dequeue to the first generated token
+    double t_total_ms; // from dequeue to completion
+};
 
-// Memory-based loading functions
+// Called by the runner with the text of every generated token, returning
+// non-zero stops the generation like the end of text
+typedef int (*llama_token_callback)(const char *piece, void *user_data);
+
+// Functions of the current runner, they return a llama_core_code. The
+// results are allocated by the library and released with llama_core_free,
+// stats may be NULL.
+int llama_start(const struct llama_args *args, int async, const char *prompt,
+                struct llama_core_error *err);
+int llama_stop(struct llama_core_error *err);
+int llama_gen(const char *prompt, char **result, struct llama_gen_stats *stats,
+              struct llama_core_error *err);
+int llama_chat(const char **roles, const char **contents, int size,
+               char **result, struct llama_gen_stats *stats,
+               struct llama_core_error *err);
+
+// State of the running model
+struct llama_runner_status {
+    int running;     // the runner has been started and not stopped
+    int ready;       // the model is loaded and requests are processed
+    int busy;        // a request is being processed
+    int queue_depth; // requests waiting in the queue
+    int n_ctx;       // context size, 0 until the model is loaded
+    int n_past;      // tokens currently held in the context
+    unsigned long long n_prompt_total; // prompt tokens evaluated since start
+    unsigned long long n_gen_total;    // tokens generated since start
+    double t_load_ms;                  // time taken to load the model
+    long long t_loaded_unix_ms;        // wall clock time the model was loaded
+    // the sampling of the runner, set once it is ready
+    unsigned int seed;    // seed of the sampler, the drawn one for a random seed
+    float temp;
+    int top_k;
+    float top_p;
+    float min_p;
+    float repeat_penalty;
+};
+int llama_status(struct llama_runner_status *status);
+
+// Sets result to the prompt the runner would feed to the model for the
+// messages, without generating
+int llama_render(const char **roles, const char **contents, int size,
+                 char **result, int *n_tokens, struct llama_core_error *err);
+
+// Parses the runner arguments like llama_start without loading anything,
+// fails with LLAMA_CORE_ERR_ARGS for unknown options or invalid values
+int llama_check_args(const struct llama_args *args,
+                     struct llama_core_error *err);
+
+// Runner handles, to load a model next to the current one and swap the
+// traffic to it. llama_runner_start blocks until the runner is stopped.
+void *llama_runner_new(const struct llama_args *args, int async,
+                       const char *prompt);
+int llama_runner_start(void *runner, struct llama_core_error *err);
+int llama_runner_get_status(void *runner, struct llama_runner_status *status);
+// Makes the runner the current one used by llama_gen and llama_chat, returns
+// the previous one or NULL
+void *llama_runner_swap(void *runner);
+// Waits for the requests of the runner, stops and frees it
+void llama_runner_free(void *runner);
+// Requests to a runner handle, on_token and stats may be NULL
+int llama_runner_gen(void *runner, const char *prompt,
+                     llama_token_callback on_token, void *user_data,
+                     char **result, struct llama_gen_stats *stats,
+                     struct llama_core_error *err);
+int llama_runner_chat(void *runner, const char **roles, const char **contents,
+                      int size, llama_token_callback on_token, void *user_data,
+                      char **result, struct llama_gen_stats *stats,
+                      struct llama_core_error *err);
+// The next request of the runner starts from an empty context, without the
+// conversation of the previous ones
+void llama_runner_reset(void *runner);
+
+// Models loaded once and shared by several runners, each with its own
+// context. The model options of args (--model, --n-gpu-layers, ...) are used
+// to load it, llama_core_model_free releases it once its runners are freed.
+void *llama_core_model_load(const struct llama_args *args,
+                            struct llama_core_error *err);
+void *llama_core_model_load_from_memory(const void *data, size_t size,
+                                        int is_mmap,
+                                        const struct llama_args *args,
+                                        struct llama_core_error *err);
+void llama_core_model_free(void *model);
+// A runner using the model instead of loading the one of args
+void *llama_runner_new_with_model(void *model, const struct llama_args *args,
+                                  int async, const char *prompt);
+
+// Memory-based loading functions, the model options of args are ignored
 int llama_start_from_memory(const void *model_data, size_t size,
-                            const char *args, int async, const char *prompt);
-int llama_start_from_mmap(const void *addr, size_t size, const char *args,
-                          int async, const char *prompt);
+                            const struct llama_args *args, int async,
+                            const char *prompt, struct llama_core_error *err);
+int llama_start_from_mmap(const void *addr, size_t size,
+                          const struct llama_args *args, int async,
+                          const char *prompt, struct llama_core_error *err);
 
 #ifdef __cplusplus
 }
@@ -0,0 +1,27 @@
+#ifndef TOKENIZE_H
+#define TOKENIZE_H
+
+#include "core_types.h"
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+// Vocabulary-only model, used for tokenization when no runner is started
+int llama_vocab_only_load(const char *model_file, struct llama_core_error *err);
+void llama_vocab_only_free();
+
+// Tokenization with the vocabulary of the running model, or of the
+// vocabulary-only model. Returned buffers are released with llama_core_free,
+// on failure llama_text_tokenize returns -1, the others NULL, and err is set.
+int llama_text_tokenize(const char *text, int add_special, int parse_special,
+                        int **tokens, struct llama_core_error *err);
+char *llama_text_detokenize(const int *tokens, int n_tokens, int special,
+                            struct llama_core_error *err);
+char *llama_token_piece(int token, int special, struct llama_core_error *err);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif // TOKENIZE_H
@@ -0,0 +1,14 @@
+#pragma once
+
+// The LOG_* macros of llama.cpp common, written with core_log_add so that the
+// callback of llama_core_log_set receives them. Include it instead of log.h.
+#include "log.h"
+#include "core_util.h"
+
+#undef LOG_TMPL
+#define LOG_TMPL(level, verbosity, ...) \
+    do { \
+        if ((verbosity) <= common_log_verbosity_thold) { \
+            core_log_add((level), __VA_ARGS__); \
+        } \
+    } while (0)
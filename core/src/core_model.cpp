@@ -0,0 +1,91 @@
+#include "core_model.h"
+#include "arg.h"
+#include "common.h"
+#include "core_util.h"
+#include "core_log.h"
+#include "process.h"
+
+CoreModel * core_model_retain(CoreModel * m) {
+    m->refs++;
+    return m;
+}
+
+void core_model_release(CoreModel * m) {
+    if (--m->refs == 0) {
+        LOG_INF("Free shared model\n");
+        llama_model_free(m->model);
+        delete m;
+    }
+}
+
+// Parses the model options of args
+static bool model_params(const struct llama_args * args, common_params & params, struct llama_core_error * err) {
+    std::vector<std::string> v_args = args_vector(args);
+    std::vector<char *> v_argv;
+    for (auto & t : v_args) {
+        v_argv.push_back(const_cast<char *>(t.c_str()));
+    }
+    if (!common_params_parse((int) v_argv.size(), v_argv.data(), params, LLAMA_EXAMPLE_MAIN)) {
+        set_error(err, LLAMA_CORE_ERR_ARGS, "invalid llama.cpp arguments");
+        return false;
+    }
+    core_log_init();
+    llama_backend_init();
+    llama_numa_init(params.numa);
+    return true;
+}
+
+extern "C" {
+void * llama_core_model_load(const struct llama_args * args, struct llama_core_error * err) {
+    common_params params;
+    if (!model_params(args, params, err)) {
+        return nullptr;
+    }
+    if (model_file_missing(params)) {
+        LOG_ERR("%s: model file '%s' not found\n", __func__, params.model.path.c_str());
+        set_error(err, LLAMA_CORE_ERR_MODEL_NOT_FOUND, "model file not found: " + params.model.path);
+        return nullptr;
+    }
+    log_capture capture;
+    llama_model * model = llama_model_load_from_file(params.model.path.c_str(), common_model_params_to_llama(params));
+    if (model == nullptr) {
+        LOG_ERR("%s: unable to load model %s\n", __func__, params.model.path.c_str());
+        set_error(err, load_error_code(capture.errors, LLAMA_CORE_ERR_LOAD),
+                  capture.message("unable to load model " + params.model.path));
+        return nullptr;
+    }
+    CoreModel * m = new CoreModel;
+    m->model = model;
+    return m;
+}
+
+void * llama_core_model_load_from_memory(const void * data, size_t size, int is_mmap,
+                                         const struct llama_args * args, struct llama_core_error * err) {
+    common_params params;
+    if (!model_params(args, params, err)) {
+        return nullptr;
+    }
+    llama_model_params mparams = common_model_params_to_llama(params);
+    mparams.use_mmap = is_mmap > 0;
+
+    log_capture capture;
+    llama_model * model = is_mmap > 0 ? llama_model_load_from_mmap(data, size, mparams)
+                                      : llama_model_load_from_buffer(data, size, mparams);
+    if (model == nullptr) {
+        LOG_ERR("%s: failed to load model from memory buffer\n", __func__);
+        set_error(err, load_error_code(capture.errors, LLAMA_CORE_ERR_MODEL_INVALID),
+                  capture.message("failed to load model from memory buffer"));
+        return nullptr;
+    }
+    CoreModel * m = new CoreModel;
+    m->model = model;
+    return m;
+}
+
+void llama_core_model_free(void * model) {
+    if (model == nullptr) {
+        return;
+    }
+    core_model_release(static_cast<CoreModel *>(model));
+}
+}
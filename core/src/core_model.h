@@ -0,0 +1,14 @@
+#pragma once
+
+#include "llama.h"
+
+#include <atomic>
+
+// A model loaded once and shared by runners, freed with its last reference
+struct CoreModel {
+    llama_model *    model = nullptr;
+    std::atomic<int> refs{1};
+};
+
+CoreModel * core_model_retain(CoreModel * m);
+void core_model_release(CoreModel * m);
@@ -0,0 +1,189 @@
+#include "core_util.h"
+
+#include "log.h"
+
+#include <atomic>
+#include <cstdarg>
+#include <cstdlib>
+#include <cstring>
+#include <fstream>
+
+int set_error(llama_core_error * err, int code, const std::string & message) {
+    if (err != nullptr) {
+        free(err->message);
+        err->code = code;
+        err->message = copy_string(message);
+    }
+    return code;
+}
+
+char * copy_string(const std::string & s) {
+    char * arr = static_cast<char *>(malloc(s.size() + 1));
+    memcpy(arr, s.data(), s.size());
+    arr[s.size()] = '\0';
+    return arr;
+}
+
+std::vector<std::string> args_vector(const llama_args * args) {
+    std::vector<std::string> v_args;
+    if (args == nullptr) {
+        return v_args;
+    }
+    for (int i = 0; i < args->argc; i++) {
+        v_args.push_back(args->argv[i] ? args->argv[i] : "");
+    }
+    return v_args;
+}
+
+static std::atomic<llama_core_log_callback> g_log_callback{nullptr};
+static std::atomic<int> g_log_level{LLAMA_CORE_LOG_INFO};
+
+// the line being written by the current thread, the callback receives whole lines
+static thread_local std::string t_line;
+static thread_local int t_line_level = GGML_LOG_LEVEL_INFO;
+
+static void log_emit(llama_core_log_callback callback, int level, const std::string & line) {
+    if (line.empty() || level < g_log_level) {
+        return;
+    }
+    callback(level, line.c_str());
+}
+
+static void core_log_write(enum ggml_log_level level, const char * text) {
+    llama_core_log_callback callback = g_log_callback;
+    // the output of the console stays on stdout
+    if (callback == nullptr || level == GGML_LOG_LEVEL_NONE) {
+        common_log_add(common_log_main(), level, "%s", text);
+        return;
+    }
+    if (level == GGML_LOG_LEVEL_CONT) {
+        level = static_cast<ggml_log_level>(t_line_level);
+    } else if (!t_line.empty() && level != t_line_level) {
+        log_emit(callback, t_line_level, t_line);
+        t_line.clear();
+    }
+    t_line_level = level;
+    t_line += text;
+
+    size_t pos;
+    while ((pos = t_line.find('\n')) != std::string::npos) {
+        log_emit(callback, t_line_level, t_line.substr(0, pos));
+        t_line.erase(0, pos + 1);
+    }
+}
+
+void core_log_add(enum ggml_log_level level, const char * fmt, ...) {
+    va_list args;
+    va_start(args, fmt);
+    va_list args_copy;
+    va_copy(args_copy, args);
+    const int n = vsnprintf(nullptr, 0, fmt, args);
+    va_end(args);
+    if (n < 0) {
+        va_end(args_copy);
+        return;
+    }
+    std::string text(n, '\0');
+    vsnprintf(&text[0], n + 1, fmt, args_copy);
+    va_end(args_copy);
+    core_log_write(level, text.c_str());
+}
+
+// capture of the current thread, errors continued by GGML_LOG_LEVEL_CONT
+// lines are appended to it
+static thread_local log_capture * t_capture = nullptr;
+static thread_local bool t_capture_cont = false;
+
+static void core_log_callback(enum ggml_log_level level, const char * text, void * /* user_data */) {
+    if (t_capture != nullptr) {
+        if (level == GGML_LOG_LEVEL_ERROR || (level == GGML_LOG_LEVEL_CONT && t_capture_cont)) {
+            t_capture->errors += text;
+            t_capture_cont = true;
+        } else if (level != GGML_LOG_LEVEL_CONT) {
+            t_capture_cont = false;
+        }
+    }
+    if (LOG_DEFAULT_LLAMA <= common_log_verbosity_thold) {
+        core_log_write(level, text);
+    }
+}
+
+void core_log_init() {
+    llama_log_set(core_log_callback, nullptr);
+}
+
+log_capture::log_capture() {
+    t_capture = this;
+    t_capture_cont = false;
+}
+
+log_capture::~log_capture() {
+    if (t_capture == this) {
+        t_capture = nullptr;
+    }
+}
+
+std::string log_capture::message(const std::string & fallback) const {
+    std::string msg;
+    size_t start = 0;
+    while (start < errors.size()) {
+        size_t end = errors.find('\n', start);
+        if (end == std::string::npos) {
+            end = errors.size();
+        }
+        std::string line = errors.substr(start, end - start);
+        start = end + 1;
+        if (line.empty()) {
+            continue;
+        }
+        if (!msg.empty()) {
+            msg += "; ";
+        }
+        msg += line;
+    }
+    if (msg.empty()) {
+        return fallback;
+    }
+    return fallback + ": " + msg;
+}
+
+int load_error_code(const std::string & errors, int fallback) {
+    if (errors.find("out of memory") != std::string::npos ||
+        errors.find("failed to allocate") != std::string::npos) {
+        return LLAMA_CORE_ERR_OUT_OF_MEMORY;
+    }
+    if (errors.find("error loading model") != std::string::npos) {
+        return LLAMA_CORE_ERR_MODEL_INVALID;
+    }
+    return fallback;
+}
+
+bool model_file_missing(const common_params & params) {
+    if (params.model.path.empty() || !params.model.url.empty() || !params.model.hf_repo.empty()) {
+        return false;
+    }
+    std::ifstream f(params.model.path);
+    return !f.good();
+}
+
+extern "C" {
+void llama_core_error_free(struct llama_core_error *err) {
+    if (err == nullptr) {
+        return;
+    }
+    free(err->message);
+    err->message = nullptr;
+}
+
+void llama_core_free(void *ptr) {
+    free(ptr);
+}
+
+void llama_core_log_set(llama_core_log_callback callback, int level) {
+    g_log_level = level;
+    g_log_callback = callback;
+    // the debug lines are only formatted from the debug verbosity
+    common_log_set_verbosity_thold(level <= LLAMA_CORE_LOG_DEBUG ? LOG_DEFAULT_DEBUG : LOG_DEFAULT_LLAMA);
+    core_log_init();
+}
+}
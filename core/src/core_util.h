@@ -0,0 +1,46 @@
+#pragma once
+
+#include "core_types.h"
+#include "common.h"
+
+#include <stdexcept>
+#include <string>
+#include <vector>
+
+// Fills err when it is not NULL and returns the code
+int set_error(llama_core_error * err, int code, const std::string & message);
+
+// Copy of s allocated for the caller, released with llama_core_free
+char * copy_string(const std::string & s);
+
+std::vector<std::string> args_vector(const llama_args * args);
+
+// Failure of a request with its llama_core_code, thrown to the caller
+struct core_error : std::runtime_error {
+    int code;
+    core_error(int code, const std::string & message) : std::runtime_error(message), code(code) {}
+};
+
+// Routes the llama.cpp logs through the core log callback, again after
+// common_init which installs its own
+void core_log_init();
+
+// Writes a log line to the callback of llama_core_log_set, or to the log of
+// llama.cpp common when there is none. The LOG_* macros of core_log.h use it.
+void core_log_add(enum ggml_log_level level, const char * fmt, ...);
+
+// Records the errors logged by llama.cpp on this thread while it is alive
+struct log_capture {
+    std::string errors;
+    log_capture();
+    ~log_capture();
+    // the recorded errors on one line, or fallback when there are none
+    std::string message(const std::string & fallback) const;
+};
+
+// Code of a failed model or context creation from the errors llama.cpp
+// logged, fallback when they do not tell
+int load_error_code(const std::string & errors, int fallback);
+
+// The model of params is a local file that does not exist
+bool model_file_missing(const common_params & params);
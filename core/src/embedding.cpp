@@ -1,6 +1,8 @@
 #include "embedding.h"
 #include "arg.h"
-#include "log.h"
+#include "core_model.h"
+#include "core_util.h"
+#include "core_log.h"
 
 #include <ctime>
 #include <algorithm>
@@ -35,7 +37,8 @@ static void batch_add_seq(llama_batch & batch, const std::vector<int32_t> & toke
     }
 }
 
-static void batch_decode(llama_context * ctx, llama_batch & batch, float * output, int n_seq, int n_embd, int embd_norm) {
+// Returns the llama_decode result, the output is only filled when it is not negative
+static int batch_decode(llama_context * ctx, llama_batch & batch, float * output, int n_seq, int n_embd, int embd_norm) {
     const enum llama_pooling_type pooling_type = llama_pooling_type(ctx);
 
     // clear previous kv_cache values (irrelevant for embeddings)
@@ -43,8 +46,10 @@ static void batch_decode(llama_context * ctx, llama_batch & batch, float * outpu
 
     // run model
     LOG_INF("%s: n_tokens = %d, n_seq = %d\n", __func__, batch.n_tokens, n_seq);
-    if (llama_decode(ctx, batch) < 0) {
-        LOG_ERR("%s : failed to process\n", __func__);
+    const int ret = llama_decode(ctx, batch);
+    if (ret < 0) {
+        LOG_ERR("%s : failed to process, return code %d\n", __func__, ret);
+        return ret;
     }
 
     for (int i = 0; i < batch.n_tokens; i++) {
@@ -70,15 +75,19 @@ static void batch_decode(llama_context * ctx, llama_batch & batch, float * outpu
         float * out = output + embd_pos * n_embd;
         common_embd_normalize(embd, out, n_embd, embd_norm);
     }
+    return ret;
 }
 
-const char * llama_embedding(const char * args,const char * prompt) {
-    std::istringstream iss(args);
-    std::vector<std::string> v_args;
-    std::string v_a;
-    while (iss >> v_a) {
-        v_args.push_back(v_a);
-    }
+// Code of a failed batch_decode, -2 is a failed allocation
+static int decode_error(int ret, const log_capture & capture, struct llama_core_error * err) {
+    const int code = ret == -2 ? LLAMA_CORE_ERR_OUT_OF_MEMORY : LLAMA_CORE_ERR_RUN;
+    return set_error(err, code, capture.message("failed to compute the embeddings"));
+}
+
+// Computes the embeddings with the shared model, or the model of args when it is null
+static int embedding(const struct llama_args * args, const char * prompt, CoreModel * shared, char ** result_str, struct llama_core_error * err) {
+    *result_str = nullptr;
+    std::vector<std::string> v_args = args_vector(args);
     std::vector<char*> v_argv;
     for (auto& t : v_args) {
         v_argv.push_back(const_cast<char*>(t.c_str()));
@@ -89,10 +98,11 @@ const char * llama_embedding(const char * args,const char * prompt) {
     params.prompt=prompt;
 
     if (!common_params_parse(argc, v_argv.data(), params, LLAMA_EXAMPLE_EMBEDDING)) {
-        return "";
+        return set_error(err, LLAMA_CORE_ERR_ARGS, "invalid llama.cpp arguments");
     }
 
     common_init();
+    core_log_init();
 
     params.embedding = true;
 
@@ -117,14 +127,28 @@ const char * llama_embedding(const char * args,const char * prompt) {
     llama_numa_init(params.numa);
 
     // load the model
-    common_init_result llama_init = common_init_from_params(params);
-
-    llama_model * model = llama_init.model.get();
+    if (shared == nullptr && model_file_missing(params)) {
+        LOG_ERR("%s: model file '%s' not found\n", __func__, params.model.path.c_str());
+        return set_error(err, LLAMA_CORE_ERR_MODEL_NOT_FOUND, "model file not found: " + params.model.path);
+    }
+    // the errors llama.cpp logs while loading and computing tell why it failed
+    log_capture capture;
+    common_init_result llama_init;
+    llama_model * model = nullptr;
+    if (shared != nullptr) {
+        // the model stays owned by the caller, only the context is ours
+        llama_init.context.reset(llama_init_from_model(shared->model, common_context_params_to_llama(params)));
+        model = shared->model;
+    } else {
+        llama_init = common_init_from_params(params);
+        model = llama_init.model.get();
+    }
     llama_context * ctx = llama_init.context.get();
 
-    if (model == NULL) {
+    if (model == NULL || ctx == NULL) {
         LOG_ERR("%s: unable to load model\n", __func__);
-        return "";
+        return set_error(err, load_error_code(capture.errors, LLAMA_CORE_ERR_LOAD),
+                         capture.message("unable to load model " + params.model.path));
     }
 
     const llama_vocab * vocab = llama_model_get_vocab(model);
@@ -136,7 +160,7 @@ const char * llama_embedding(const char * args,const char * prompt) {
 
     if (llama_model_has_encoder(model) && llama_model_has_decoder(model)) {
         LOG_ERR("%s: computing embeddings in encoder-decoder models is not supported\n", __func__);
-        return "";
+        return set_error(err, LLAMA_CORE_ERR_LOAD, "computing embeddings in encoder-decoder models is not supported");
     }
 
     if (n_ctx > n_ctx_train) {
@@ -189,7 +213,8 @@ const char * llama_embedding(const char * args,const char * prompt) {
         if (inp.size() > n_batch) {
             LOG_ERR("%s: number of tokens in input line (%lld) exceeds batch size (%lld), increase batch size and re-run\n",
                     __func__, (long long int) inp.size(), (long long int) n_batch);
-            return "";
+            return set_error(err, LLAMA_CORE_ERR_CONTEXT_OVERFLOW, "number of tokens in input line (" + std::to_string(inp.size()) +
+                             ") exceeds batch size (" + std::to_string(n_batch) + ")");
         }
         inputs.push_back(inp);
     }
@@ -246,7 +271,11 @@ const char * llama_embedding(const char * args,const char * prompt) {
         // encode if at capacity
         if (batch.n_tokens + n_toks > n_batch) {
             float * out = emb + e * n_embd;
-            batch_decode(ctx, batch, out, s, n_embd, params.embd_normalize);
+            const int ret = batch_decode(ctx, batch, out, s, n_embd, params.embd_normalize);
+            if (ret < 0) {
+                llama_batch_free(batch);
+                return decode_error(ret, capture, err);
+            }
             e += pooling_type == LLAMA_POOLING_TYPE_NONE ? batch.n_tokens : s;
             s = 0;
             common_batch_clear(batch);
@@ -259,7 +288,11 @@ const char * llama_embedding(const char * args,const char * prompt) {
 
     // final batch
     float * out = emb + e * n_embd;
-    batch_decode(ctx, batch, out, s, n_embd, params.embd_normalize);
+    const int ret = batch_decode(ctx, batch, out, s, n_embd, params.embd_normalize);
+    if (ret < 0) {
+        llama_batch_free(batch);
+        return decode_error(ret, capture, err);
+    }
 
     std::ostringstream result;
 
@@ -397,7 +430,7 @@ const char * llama_embedding(const char * args,const char * prompt) {
 
                 for (int j = 0;;) { // at least two iteration (n_embd_count > 1)
                     float sim = common_embd_similarity_cos(emb + i * n_embd, emb + j * n_embd, n_embd);
-                    result<<std::fixed << std::setprecision(2) << std::setw(6) << sim;
+                    result<<std::fixed << std::setprecision(6) << std::setw(9) << sim;
                     j++;
                     if (j < n_embd_count) result<<", "; else break;
                 }
@@ -418,10 +451,14 @@ const char * llama_embedding(const char * args,const char * prompt) {
     llama_batch_free(batch);
     llama_backend_free();
 
-    std::string ret = result.str();
-    char* arr = new char[ret.size() + 1];
-    std::copy(ret.begin(), ret.end(), arr);
-    arr[ret.size()] = '\0';
+    *result_str = copy_string(result.str());
+    return LLAMA_CORE_OK;
+}
+
+int llama_embedding(const struct llama_args * args, const char * prompt, char ** result, struct llama_core_error * err) {
+    return embedding(args, prompt, nullptr, result, err);
+}
 
-    return arr;
-}
\ No newline at end of file
+int llama_core_model_embedding(void * model, const struct llama_args * args, const char * prompt, char ** result, struct llama_core_error * err) {
+    return embedding(args, prompt, static_cast<CoreModel *>(model), result, err);
+}
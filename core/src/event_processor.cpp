@@ -1,14 +1,23 @@
 #include "event_processor.h"
 #include <stdexcept>
 
-std::string EventProcessor::enqueue(const std::vector<Message>& data) {
+std::string EventProcessor::enqueue(const std::vector<Message>& data, llama_gen_stats * stats,
+                                    llama_token_callback on_token, void * user_data) {
     Event event;
     event.data = data;
+    event.enqueued = std::chrono::steady_clock::now();
+    event.stats = stats;
+    event.on_token = on_token;
+    event.user_data = user_data;
 
     std::future<std::string> resultFuture = event.result.get_future();
 
     {
         std::lock_guard<std::mutex> lock(m_mtx);
+        if (m_stop) {
+            // nobody dequeues after stop, fail instead of waiting forever
+            throw std::runtime_error("EventProcessor stopped");
+        }
         m_queue.push(std::move(event));
     }
 
@@ -30,6 +39,11 @@ bool EventProcessor::dequeue(Event& event) {
     return true;
 }
 
+size_t EventProcessor::size() {
+    std::lock_guard<std::mutex> lock(m_mtx);
+    return m_queue.size();
+}
+
 void EventProcessor::stop() {
     {
         std::lock_guard<std::mutex> lock(m_mtx);
@@ -2,19 +2,30 @@
 #include <queue>
 #include <mutex>
 #include <future>
+#include <chrono>
 #include "message.h"
+#include "process.h"
 
 class EventProcessor {
 public:
     struct Event {
         std::vector<Message> data;
         std::promise<std::string> result;
+        std::chrono::steady_clock::time_point enqueued;
+        // owned by the caller blocked in enqueue, filled before the result is set
+        llama_gen_stats * stats = nullptr;
+        // called by the runner with every generated token
+        llama_token_callback on_token = nullptr;
+        void * user_data = nullptr;
     };
 
-    std::string enqueue(const std::vector<Message>& data);
+    std::string enqueue(const std::vector<Message>& data, llama_gen_stats * stats = nullptr,
+                        llama_token_callback on_token = nullptr, void * user_data = nullptr);
 
     bool dequeue(Event& event);
 
+    size_t size();
+
     void stop();
 
 private:
@@ -1,79 +1,219 @@
 #include "process.h"
+#include "arg.h"
 #include "common.h"
+#include "core_util.h"
 #include "llama.h"
-#include "log.h"
+#include "core_log.h"
 #include "runner.h"
 #include <iostream>
-#include <sstream>
+#include <shared_mutex>
 #include <string>
 #include <vector>
 
 // Forward declaration
 int process(common_params &params);
 
-static Runner *g_runner;
+// NOT static so it can be accessed from tokenize.cpp
+Runner *g_runner = nullptr;
+// Shared by the calls using g_runner, exclusive to replace or delete it
+std::shared_mutex g_runner_mtx;
 static int g_idx = 0;
 
-// Global variables for memory-loaded model (NOT static so they can be accessed
-// from runner.cpp)
-const void *g_model_buffer = nullptr;
-size_t g_model_buffer_size = 0;
-bool g_use_mmap = false;
+// Take a reference on the current runner, it is not freed until released
+static Runner *acquire_runner() {
+    std::shared_lock<std::shared_mutex> lock(g_runner_mtx);
+    if (g_runner != nullptr) {
+        g_runner->acquire();
+    }
+    return g_runner;
+}
 
-extern "C" {
-int llama_start(const char *args, int async, const char *prompt) {
+struct runner_ref {
+    Runner *runner;
+    ~runner_ref() {
+        if (runner != nullptr) {
+            runner->release();
+        }
+    }
+};
+
+// Replace the current runner by a new one, the previous runner must be stopped
+static Runner *new_runner(const std::vector<std::string> &args, bool async,
+                          const std::string &prompt) {
+    std::unique_lock<std::shared_mutex> lock(g_runner_mtx);
     if (g_runner != nullptr) {
-        LOG("Delete last runner: id=%d\n", g_runner->getID());
+        LOG_INF("Delete last runner: id=%d\n", g_runner->getID());
         delete g_runner;
         g_runner = nullptr;
     }
-    std::istringstream iss(args);
-    std::vector<std::string> v_args;
-    std::string v_a;
-    while (iss >> v_a) {
-        v_args.push_back(v_a);
+    g_runner = new Runner(g_idx, args, async, prompt);
+    g_idx++;
+    return g_runner;
+}
+
+// Runs the runner until it is stopped, a failure to start fills err
+static int start_runner(Runner *runner, struct llama_core_error *err) {
+    try {
+        if (runner->start()) {
+            return LLAMA_CORE_OK;
+        }
+    } catch (const std::bad_alloc &e) {
+        LOG_ERR("%s: %s\n", __func__, e.what());
+        return set_error(err, LLAMA_CORE_ERR_OUT_OF_MEMORY, "out of memory");
+    } catch (const std::exception &e) {
+        LOG_ERR("%s: %s\n", __func__, e.what());
+        return set_error(err, LLAMA_CORE_ERR_RUN, e.what());
+    }
+    std::string message;
+    int code = runner->getError(message);
+    if (code == LLAMA_CORE_OK) {
+        code = LLAMA_CORE_ERR_RUN;
+        message = "runner failed";
     }
+    return set_error(err, code, message);
+}
 
-    g_runner = new Runner(g_idx, v_args, async > 0, std::string(prompt));
-    g_idx++;
-    if (g_runner->start()) {
-        return EXIT_SUCCESS;
+// A request failed, with the code the runner gave, because the runner stopped
+// or by itself
+static int request_error(Runner *runner, const std::exception &e,
+                         struct llama_core_error *err) {
+    if (auto *ce = dynamic_cast<const core_error *>(&e)) {
+        return set_error(err, ce->code, ce->what());
+    }
+    if (dynamic_cast<const std::bad_alloc *>(&e) != nullptr) {
+        return set_error(err, LLAMA_CORE_ERR_OUT_OF_MEMORY, "out of memory");
     }
-    return EXIT_FAILURE;
+    if (!runner->isRunning()) {
+        return set_error(err, LLAMA_CORE_ERR_STOPPED, e.what());
+    }
+    return set_error(err, LLAMA_CORE_ERR_RUN, e.what());
 }
 
-int llama_stop() {
-    if (g_runner == nullptr) {
-        LOG("Runner is already delete\n");
-        return EXIT_SUCCESS;
+static int runner_gen(Runner *runner, const char *prompt,
+                      llama_token_callback on_token, void *user_data,
+                      char **result, struct llama_gen_stats *stats,
+                      struct llama_core_error *err) {
+    if (runner == nullptr) {
+        LOG_ERR("Not init llama\n");
+        return set_error(err, LLAMA_CORE_ERR_NOT_STARTED, "runner is not started");
     }
-    bool ret = g_runner->stop();
-    LOG("Delete last runner: id=%d\n", g_runner->getID());
-    delete g_runner;
-    g_runner = nullptr;
-    if (ret) {
-        return EXIT_SUCCESS;
+    std::string ret;
+    try {
+        ret = runner->generate(std::string(prompt), stats, on_token, user_data);
+    } catch (const std::exception &e) {
+        LOG_ERR("%s: %s\n", __func__, e.what());
+        return request_error(runner, e, err);
     }
-    return EXIT_FAILURE;
+    *result = copy_string(ret);
+    return LLAMA_CORE_OK;
 }
 
-const char *llama_gen(const char *prompt) {
-    if (g_runner == nullptr) {
+static int runner_chat(Runner *runner, const char **roles,
+                       const char **contents, int size,
+                       llama_token_callback on_token, void *user_data,
+                       char **result, struct llama_gen_stats *stats,
+                       struct llama_core_error *err) {
+    if (runner == nullptr) {
         LOG_ERR("Not init llama\n");
-        return "";
+        return set_error(err, LLAMA_CORE_ERR_NOT_STARTED, "runner is not started");
+    }
+    std::vector<Message> msgs;
+
+    for (int i = 0; i < size; i++) {
+        Message msg;
+        msg.role = roles[i];
+        msg.content = contents[i];
+
+        msgs.push_back(msg);
     }
-    std::string result = g_runner->generate(std::string(prompt));
-    char *arr = new char[result.size() + 1];
-    std::copy(result.begin(), result.end(), arr);
-    arr[result.size()] = '\0';
 
-    return arr;
+    std::string ret;
+    try {
+        ret = runner->chat(msgs, stats, on_token, user_data);
+    } catch (const std::exception &e) {
+        LOG_ERR("%s: %s\n", __func__, e.what());
+        return request_error(runner, e, err);
+    }
+    *result = copy_string(ret);
+    return LLAMA_CORE_OK;
 }
 
-const char *llama_chat(const char **roles, const char **contents, int size) {
+// Global variables for memory-loaded model (NOT static so they can be accessed
+// from runner.cpp)
+const void *g_model_buffer = nullptr;
+size_t g_model_buffer_size = 0;
+bool g_use_mmap = false;
+
+extern "C" {
+int llama_start(const struct llama_args *args, int async, const char *prompt,
+                struct llama_core_error *err) {
+    Runner *runner = new_runner(args_vector(args), async > 0,
+                                prompt ? std::string(prompt) : "");
+    return start_runner(runner, err);
+}
+
+int llama_stop(struct llama_core_error *err) {
+    Runner *runner = nullptr;
+    {
+        std::shared_lock<std::shared_mutex> lock(g_runner_mtx);
+        runner = g_runner;
+    }
+    if (runner == nullptr) {
+        LOG_INF("Runner is already delete\n");
+        return LLAMA_CORE_OK;
+    }
+    // fail the queued and current requests, then let the main loop release the model
+    bool ret = runner->stop();
+    runner->wait();
+
+    {
+        std::unique_lock<std::shared_mutex> lock(g_runner_mtx);
+        if (g_runner == runner) {
+            g_runner = nullptr;
+        }
+    }
+    // the callers of generate or chat hold a reference until they return
+    runner->drain();
+    LOG_INF("Delete last runner: id=%d\n", runner->getID());
+    delete runner;
+    if (!ret) {
+        return set_error(err, LLAMA_CORE_ERR_NOT_STARTED, "runner is not started");
+    }
+    return LLAMA_CORE_OK;
+}
+
+int llama_gen(const char *prompt, char **result, struct llama_gen_stats *stats,
+              struct llama_core_error *err) {
+    *result = nullptr;
+    runner_ref ref{acquire_runner()};
+    return runner_gen(ref.runner, prompt, nullptr, nullptr, result, stats, err);
+}
+
+int llama_chat(const char **roles, const char **contents, int size,
+               char **result, struct llama_gen_stats *stats,
+               struct llama_core_error *err) {
+    *result = nullptr;
+    runner_ref ref{acquire_runner()};
+    return runner_chat(ref.runner, roles, contents, size, nullptr, nullptr,
+                       result, stats, err);
+}
+int llama_status(struct llama_runner_status *status) {
+    *status = llama_runner_status{};
+    std::shared_lock<std::shared_mutex> lock(g_runner_mtx);
+    if (g_runner == nullptr) {
+        return LLAMA_CORE_OK;
+    }
+    g_runner->getStatus(*status);
+    return LLAMA_CORE_OK;
+}
+
+int llama_render(const char **roles, const char **contents, int size,
+                 char **result, int *n_tokens, struct llama_core_error *err) {
+    *result = nullptr;
+    std::shared_lock<std::shared_mutex> lock(g_runner_mtx);
     if (g_runner == nullptr) {
         LOG_ERR("Not init llama\n");
-        return "";
+        return set_error(err, LLAMA_CORE_ERR_NOT_STARTED, "runner is not started");
     }
     std::vector<Message> msgs;
 
@@ -85,25 +225,122 @@ const char *llama_chat(const char **roles, const char **contents, int size) {
         msgs.push_back(msg);
     }
 
-    std::string result = g_runner->chat(msgs);
-    char *arr = new char[result.size() + 1];
-    std::copy(result.begin(), result.end(), arr);
-    arr[result.size()] = '\0';
+    std::string prompt;
+    int tokens = 0;
+    if (!g_runner->render(msgs, prompt, tokens)) {
+        LOG_ERR("Model is not loaded\n");
+        return set_error(err, LLAMA_CORE_ERR_NOT_STARTED, "model is not loaded");
+    }
+    *n_tokens = tokens;
+    *result = copy_string(prompt);
+    return LLAMA_CORE_OK;
+}
+
+int llama_check_args(const struct llama_args *args,
+                     struct llama_core_error *err) {
+    std::vector<std::string> v_args = args_vector(args);
+    std::vector<char *> v_argv;
+    for (auto &t : v_args) {
+        v_argv.push_back(const_cast<char *>(t.c_str()));
+    }
+    // the runner parses the same options, unknown ones are reported on stderr
+    common_params params;
+    if (!common_params_parse((int)v_argv.size(), v_argv.data(), params,
+                             LLAMA_EXAMPLE_MAIN)) {
+        return set_error(err, LLAMA_CORE_ERR_ARGS, "invalid llama.cpp arguments");
+    }
+    return LLAMA_CORE_OK;
+}
+
+void *llama_runner_new(const struct llama_args *args, int async,
+                       const char *prompt) {
+    std::unique_lock<std::shared_mutex> lock(g_runner_mtx);
+    Runner *runner = new Runner(g_idx, args_vector(args), async > 0,
+                                prompt ? std::string(prompt) : "");
+    g_idx++;
+    return runner;
+}
+
+void *llama_runner_new_with_model(void *model, const struct llama_args *args,
+                                  int async, const char *prompt) {
+    Runner *runner = static_cast<Runner *>(
+        llama_runner_new(args, async, prompt));
+    runner->setSharedModel(static_cast<CoreModel *>(model));
+    return runner;
+}
+
+int llama_runner_start(void *runner, struct llama_core_error *err) {
+    return start_runner(static_cast<Runner *>(runner), err);
+}
+
+int llama_runner_get_status(void *runner, struct llama_runner_status *status) {
+    *status = llama_runner_status{};
+    static_cast<Runner *>(runner)->getStatus(*status);
+    return LLAMA_CORE_OK;
+}
+
+void *llama_runner_swap(void *runner) {
+    std::unique_lock<std::shared_mutex> lock(g_runner_mtx);
+    Runner *prev = g_runner;
+    g_runner = static_cast<Runner *>(runner);
+    LOG_INF("Swap runner: id=%d -> id=%d\n", prev ? prev->getID() : -1,
+        g_runner->getID());
+    return prev;
+}
+
+int llama_runner_gen(void *runner, const char *prompt,
+                     llama_token_callback on_token, void *user_data,
+                     char **result, struct llama_gen_stats *stats,
+                     struct llama_core_error *err) {
+    *result = nullptr;
+    Runner *r = static_cast<Runner *>(runner);
+    r->acquire();
+    runner_ref ref{r};
+    return runner_gen(r, prompt, on_token, user_data, result, stats, err);
+}
+
+int llama_runner_chat(void *runner, const char **roles, const char **contents,
+                      int size, llama_token_callback on_token, void *user_data,
+                      char **result, struct llama_gen_stats *stats,
+                      struct llama_core_error *err) {
+    *result = nullptr;
+    Runner *r = static_cast<Runner *>(runner);
+    r->acquire();
+    runner_ref ref{r};
+    return runner_chat(r, roles, contents, size, on_token, user_data, result,
+                       stats, err);
+}
 
-    return arr;
+void llama_runner_reset(void *runner) {
+    static_cast<Runner *>(runner)->reset();
+}
+
+void llama_runner_free(void *runner) {
+    Runner *r = static_cast<Runner *>(runner);
+    if (r == nullptr) {
+        return;
+    }
+    {
+        std::unique_lock<std::shared_mutex> lock(g_runner_mtx);
+        if (g_runner == r) {
+            g_runner = nullptr;
+        }
+    }
+    // let the requests already taken by the runner finish before stopping it
+    r->drain();
+    r->stop();
+    r->wait();
+    LOG_INF("Delete runner: id=%d\n", r->getID());
+    delete r;
 }
 } // extern "C"
 
 // Common function to run model from memory
 static int llama_run_from_memory_internal(const void *buffer, size_t size,
-                                          bool is_mmap, const char *args,
-                                          int async, const char *prompt) {
-    if (g_runner != nullptr) {
-        LOG("Delete last runner: id=%d\n", g_runner->getID());
-        delete g_runner;
-        g_runner = nullptr;
-    }
-
+                                          bool is_mmap,
+                                          const struct llama_args *args,
+                                          int async, const char *prompt,
+                                          struct llama_core_error *err) {
     // Store the memory buffer in global variables for Runner to access
     g_model_buffer = buffer;
     g_model_buffer_size = size;
@@ -113,43 +350,39 @@ static int llama_run_from_memory_internal(const void *buffer, size_t size,
     std::vector<std::string> v_args;
     v_args.push_back("llama"); // dummy executable name
 
-    // Parse user-provided arguments (but skip model path)
-    std::istringstream iss(args);
-    std::string arg;
-    while (iss >> arg) {
+    // Copy user-provided arguments (but skip model path)
+    std::vector<std::string> user_args = args_vector(args);
+    for (size_t i = 1; i < user_args.size(); i++) {
         // Skip model path argument since we're loading from memory
-        if (arg != "-m" && arg != "--model") {
-            v_args.push_back(arg);
+        if (user_args[i] != "-m" && user_args[i] != "--model") {
+            v_args.push_back(user_args[i]);
         } else {
             // Skip the next argument (model path)
-            iss >> arg;
+            i++;
         }
     }
 
     // Create runner with the modified arguments
     std::string prompt_str = prompt ? std::string(prompt) : "";
-    g_runner = new Runner(g_idx, v_args, async > 0, prompt_str);
-    g_idx++;
-
-    if (g_runner->start()) {
-        return EXIT_SUCCESS;
-    }
+    Runner *runner = new_runner(v_args, async > 0, prompt_str);
 
-    return EXIT_FAILURE;
+    return start_runner(runner, err);
 }
 
 extern "C" int llama_start_from_memory(const void *model_data, size_t size,
-                                       const char *args, int async,
-                                       const char *prompt) {
-    LOG("Starting llama from memory buffer (size=%zu bytes)\n", size);
+                                       const struct llama_args *args, int async,
+                                       const char *prompt,
+                                       struct llama_core_error *err) {
+    LOG_INF("Starting llama from memory buffer (size=%zu bytes)\n", size);
     return llama_run_from_memory_internal(model_data, size, false, args, async,
-                                          prompt);
+                                          prompt, err);
 }
 
 extern "C" int llama_start_from_mmap(const void *addr, size_t size,
-                                     const char *args, int async,
-                                     const char *prompt) {
-    LOG("Starting llama from mmap'd memory (addr=%p, size=%zu)\n", addr, size);
+                                     const struct llama_args *args, int async,
+                                     const char *prompt,
+                                     struct llama_core_error *err) {
+    LOG_INF("Starting llama from mmap'd memory (addr=%p, size=%zu)\n", addr, size);
     return llama_run_from_memory_internal(addr, size, true, args, async,
-                                          prompt);
+                                          prompt, err);
 }
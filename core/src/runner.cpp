@@ -4,13 +4,14 @@
 #include "arg.h"
 #include "common.h"
 #include "console.h"
-#include "log.h"
+#include "core_log.h"
 #include "sampling.h"
 #include "llama.h"
 #include "llama-cpp.h"
 #include "chat.h"
 #include "chat.cpp"
 #include "message.h"
+#include "core_util.h"
 
 #include <cstdio>
 #include <cstring>
@@ -91,20 +92,42 @@ std::string common_chat_formats(
 Runner::Runner(int id,const std::vector<std::string>& args,bool async,const std::string& prompt) :
     m_id(id),m_args(args),m_async(async),m_prompt(prompt),
     m_params(nullptr),m_model(nullptr),m_smpl(nullptr),m_input_tokens(nullptr),m_output_ss(nullptr),m_output_tokens(nullptr) {
-    std::cout << "Runner Constructor:"<<id<<" args.size="<<args.size()<< std::endl;
+    LOG_DBG("Runner constructor: id=%d args=%zu\n", id, args.size());
 }
 
 Runner::~Runner() {
-    std::cout << "Runner Destructor:"<<m_id<< std::endl;
+    LOG_DBG("Runner destructor: id=%d\n", m_id);
+    if (m_shared_model != nullptr) {
+        core_model_release(m_shared_model);
+    }
+}
+
+void Runner::setSharedModel(CoreModel * model) {
+    m_shared_model = core_model_retain(model);
 }
 
 bool Runner::start() {
     if (isRunning()) {
-        std::cout << "Already Start:"<<m_id<< std::endl;
-        return false;
+        LOG_WRN("Runner already started: id=%d\n", m_id);
+        return fail(LLAMA_CORE_ERR_RUN, "runner already started");
     }
-    std::cout << "Runner Start:"<<m_id<< std::endl;
+    LOG_INF("Runner start: id=%d\n", m_id);
     m_running=true;
+    {
+        std::lock_guard<std::mutex> lock(m_done_mtx);
+        m_done = false;
+    }
+    struct done_guard {
+        Runner * r;
+        ~done_guard() {
+            {
+                std::lock_guard<std::mutex> lock(r->m_done_mtx);
+                r->m_done = true;
+            }
+            r->m_done_cv.notify_all();
+        }
+    } done{this};
+    const auto t_start = std::chrono::steady_clock::now();
 
     std::vector<char*> v_argv;
     for (auto& t : m_args) {
@@ -116,9 +139,10 @@ bool Runner::start() {
     params.prompt=m_prompt;
     m_params = &params;
     if (!common_params_parse(argc, v_argv.data(), params, LLAMA_EXAMPLE_MAIN, print_usage)) {
-        return false;
+        return fail(LLAMA_CORE_ERR_ARGS, "invalid llama.cpp arguments");
     }
     common_init();
+    core_log_init();
 
     auto & sparams = params.sampling;
 
@@ -132,7 +156,7 @@ bool Runner::start() {
         LOG_ERR("%s: please use the 'embedding' tool for embedding calculations\n", __func__);
         LOG_ERR("************\n\n");
 
-        return false;
+        return fail(LLAMA_CORE_ERR_ARGS, "embedding is not supported by the runner");
     }
 
     if (params.n_ctx != 0 && params.n_ctx < 8) {
@@ -167,81 +191,128 @@ bool Runner::start() {
     LOG_INF("%s: load the model and apply lora adapter, if any\n", __func__);
 
     common_init_result llama_init;
+    {
+        // the errors llama.cpp logs while loading tell why it failed
+        log_capture capture;
+
+        if (m_shared_model != nullptr) {
+            LOG_INF("%s: create a context of the shared model\n", __func__);
+
+            // the model stays owned by m_shared_model, only the context is ours
+            llama_context *raw_ctx = llama_init_from_model(m_shared_model->model, common_context_params_to_llama(params));
+            if (raw_ctx == nullptr) {
+                LOG_ERR("%s: failed to create context from shared model\n", __func__);
+                return fail(load_error_code(capture.errors, LLAMA_CORE_ERR_LOAD),
+                            capture.message("failed to create context from shared model"));
+            }
+            llama_init.context =
+                std::unique_ptr<llama_context, llama_context_deleter>(raw_ctx);
+        } else if (g_model_buffer != nullptr && g_model_buffer_size > 0) {
+            // Check if we should load from memory buffer
+            LOG_INF("%s: loading model from memory buffer (size=%zu, mmap=%d)\n",
+                    __func__, g_model_buffer_size, g_use_mmap);
+
+            // Load model from memory buffer
+            llama_model_params model_params = llama_model_default_params();
+            model_params.n_gpu_layers = params.n_gpu_layers;
+            model_params.use_mmap = g_use_mmap;
+
+            llama_model *raw_model = nullptr;
+            if (g_use_mmap) {
+                raw_model = llama_model_load_from_mmap(
+                    g_model_buffer, g_model_buffer_size, model_params);
+            } else {
+                raw_model = llama_model_load_from_buffer(
+                    g_model_buffer, g_model_buffer_size, model_params);
+            }
 
-    // Check if we should load from memory buffer
-    if (g_model_buffer != nullptr && g_model_buffer_size > 0) {
-        LOG_INF("%s: loading model from memory buffer (size=%zu, mmap=%d)\n",
-                __func__, g_model_buffer_size, g_use_mmap);
-
-        // Load model from memory buffer
-        llama_model_params model_params = llama_model_default_params();
-        model_params.n_gpu_layers = params.n_gpu_layers;
-        model_params.use_mmap = g_use_mmap;
-
-        llama_model *raw_model = nullptr;
-        if (g_use_mmap) {
-            raw_model = llama_model_load_from_mmap(
-                g_model_buffer, g_model_buffer_size, model_params);
-        } else {
-            raw_model = llama_model_load_from_buffer(
-                g_model_buffer, g_model_buffer_size, model_params);
-        }
-
-        if (raw_model == nullptr) {
-            LOG_ERR("%s: failed to load model from memory buffer\n", __func__);
-            return false;
-        }
+            if (raw_model == nullptr) {
+                LOG_ERR("%s: failed to load model from memory buffer\n", __func__);
+                return fail(load_error_code(capture.errors, LLAMA_CORE_ERR_MODEL_INVALID),
+                            capture.message("failed to load model from memory buffer"));
+            }
 
-        // Create context
-        llama_context_params ctx_params = llama_context_default_params();
-        ctx_params.n_ctx = params.n_ctx;
-        ctx_params.n_batch = params.n_batch;
-        ctx_params.n_ubatch = params.n_ubatch;
-        ctx_params.n_threads = params.cpuparams.n_threads;
-        ctx_params.n_threads_batch = params.cpuparams_batch.n_threads;
+            // Create context
+            llama_context_params ctx_params = llama_context_default_params();
+            ctx_params.n_ctx = params.n_ctx;
+            ctx_params.n_batch = params.n_batch;
+            ctx_params.n_ubatch = params.n_ubatch;
+            ctx_params.n_threads = params.cpuparams.n_threads;
+            ctx_params.n_threads_batch = params.cpuparams_batch.n_threads;
+
+            llama_context *raw_ctx = llama_init_from_model(raw_model, ctx_params);
+
+            if (raw_ctx == nullptr) {
+                LOG_ERR("%s: failed to create context from memory-loaded model\n",
+                        __func__);
+                llama_model_free(raw_model);
+                return fail(load_error_code(capture.errors, LLAMA_CORE_ERR_LOAD),
+                            capture.message("failed to create context from memory-loaded model"));
+            }
 
-        llama_context *raw_ctx = llama_init_from_model(raw_model, ctx_params);
+            // Wrap in unique_ptrs
+            llama_init.model =
+                std::unique_ptr<llama_model, llama_model_deleter>(raw_model);
+            llama_init.context =
+                std::unique_ptr<llama_context, llama_context_deleter>(raw_ctx);
 
-        if (raw_ctx == nullptr) {
-            LOG_ERR("%s: failed to create context from memory-loaded model\n",
-                    __func__);
-            llama_model_free(raw_model);
-            return false;
+            // Clear global variables after use
+            g_model_buffer = nullptr;
+            g_model_buffer_size = 0;
+            g_use_mmap = false;
+        } else {
+            // Normal file-based loading
+            if (model_file_missing(params)) {
+                LOG_ERR("%s: error: model file '%s' not found\n", __func__, params.model.path.c_str());
+                return fail(LLAMA_CORE_ERR_MODEL_NOT_FOUND, "model file not found: " + params.model.path);
+            }
+            llama_init = common_init_from_params(params);
+            if (llama_init.model == nullptr) {
+                LOG_ERR("%s: error: unable to load model\n", __func__);
+                return fail(load_error_code(capture.errors, LLAMA_CORE_ERR_LOAD),
+                            capture.message("unable to load model " + params.model.path));
+            }
         }
-
-        // Wrap in unique_ptrs
-        llama_init.model =
-            std::unique_ptr<llama_model, llama_model_deleter>(raw_model);
-        llama_init.context =
-            std::unique_ptr<llama_context, llama_context_deleter>(raw_ctx);
-
-        // Clear global variables after use
-        g_model_buffer = nullptr;
-        g_model_buffer_size = 0;
-        g_use_mmap = false;
-    } else {
-        // Normal file-based loading
-        llama_init = common_init_from_params(params);
     }
 
-    model = llama_init.model.get();
+    model = m_shared_model != nullptr ? m_shared_model->model : llama_init.model.get();
     ctx = llama_init.context.get();
-
-    if (model == NULL) {
-        LOG_ERR("%s: error: unable to load model\n", __func__);
-        return false;
-    }
     auto * mem = llama_get_memory(ctx);
 
     const llama_vocab * vocab = llama_model_get_vocab(model);
     auto chat_templates = common_chat_templates_init(model, params.chat_template);
 
+    m_model = model;
+    m_ctx = ctx;
+    m_chat_templates = chat_templates.get();
+    m_chat_msgs = &chat_msgs;
+
+    // forget the model before llama_init releases it, whatever path returns
+    struct model_guard {
+        Runner * runner;
+        ~model_guard() {
+            {
+                std::unique_lock<std::mutex> lock(runner->m_done_mtx);
+                runner->m_model = nullptr;
+                runner->m_done_cv.wait(lock, [this]() { return runner->m_vocab_refs == 0; });
+            }
+            std::lock_guard<std::mutex> lock(runner->m_chat_mtx);
+            runner->m_chat_msgs = nullptr;
+            runner->m_chat_templates = nullptr;
+            runner->m_ctx = nullptr;
+            runner->m_model = nullptr;
+            runner->m_n_past = 0;
+            runner->m_ready = false;
+            runner->m_busy = false;
+        }
+    } guard{this};
+
     LOG_INF("%s: llama threadpool init, n_threads = %d\n", __func__, (int) params.cpuparams.n_threads);
 
     auto * cpu_dev = ggml_backend_dev_by_type(GGML_BACKEND_DEVICE_TYPE_CPU);
     if (!cpu_dev) {
         LOG_ERR("%s: no CPU backend found\n", __func__);
-        return false;
+        return fail(LLAMA_CORE_ERR_LOAD, "no CPU backend found");
     }
     auto * reg = ggml_backend_dev_backend_reg(cpu_dev);
     auto * ggml_threadpool_new_fn = (decltype(ggml_threadpool_new) *) ggml_backend_reg_get_proc_address(reg, "ggml_threadpool_new");
@@ -259,7 +330,7 @@ bool Runner::start() {
         threadpool_batch = ggml_threadpool_new_fn(&tpp_batch);
         if (!threadpool_batch) {
             LOG_ERR("%s: batch threadpool create failed : n_threads %d\n", __func__, tpp_batch.n_threads);
-            return false;
+            return fail(LLAMA_CORE_ERR_LOAD, "batch threadpool create failed");
         }
 
         // Start the non-batch threadpool in the paused state
@@ -269,7 +340,7 @@ bool Runner::start() {
     struct ggml_threadpool * threadpool = ggml_threadpool_new_fn(&tpp);
     if (!threadpool) {
         LOG_ERR("%s: threadpool create failed : n_threads %d\n", __func__, tpp.n_threads);
-        return false;
+        return fail(LLAMA_CORE_ERR_LOAD, "threadpool create failed");
     }
 
     llama_attach_threadpool(ctx, threadpool, threadpool_batch);
@@ -332,7 +403,7 @@ bool Runner::start() {
             size_t n_token_count_out = 0;
             if (!llama_state_load_file(ctx, path_session.c_str(), session_tokens.data(), session_tokens.capacity(), &n_token_count_out)) {
                 LOG_ERR("%s: failed to load session file '%s'\n", __func__, path_session.c_str());
-                return false;
+                return fail(LLAMA_CORE_ERR_LOAD, "failed to load session file " + path_session);
             }
             session_tokens.resize(n_token_count_out);
             LOG_INF("%s: loaded a session with prompt size of %d tokens\n", __func__, (int)session_tokens.size());
@@ -357,6 +428,7 @@ bool Runner::start() {
             msg.fillMessage(cmsg);
             new_msg.push_back(cmsg);
         }
+        std::lock_guard<std::mutex> lock(m_chat_mtx);
         auto formatted = common_chat_formats(chat_templates.get(), chat_msgs, new_msg, m_params->use_jinja);
 
         for (const common_chat_msg& cmsg:new_msg) {
@@ -424,14 +496,14 @@ bool Runner::start() {
             LOG_WRN("embd_inp was considered empty and bos was added: %s\n", string_from(ctx, embd_inp).c_str());
         } else {
             LOG_ERR("input is empty\n");
-            return false;
+            return fail(LLAMA_CORE_ERR_ARGS, "input is empty");
         }
     }
 
     // Tokenize negative prompt
     if ((int) embd_inp.size() > n_ctx - 4) {
         LOG_ERR("%s: prompt is too long (%d tokens, max %d)\n", __func__, (int) embd_inp.size(), n_ctx - 4);
-        return false;
+        return fail(LLAMA_CORE_ERR_CONTEXT_OVERFLOW, "prompt is too long");
     }
 
     // debug message about similarity of saved session, if applicable
@@ -551,10 +623,13 @@ bool Runner::start() {
     smpl = common_sampler_init(model, sparams);
     if (!smpl) {
         LOG_ERR("%s: failed to initialize sampling subsystem\n", __func__);
-        return false;
+        return fail(LLAMA_CORE_ERR_ARGS, "failed to initialize sampling subsystem");
     }
 
-    LOG_INF("sampler seed: %u\n",     common_sampler_get_seed(smpl));
+    m_seed = common_sampler_get_seed(smpl);
+    m_sampling = sparams;
+
+    LOG_INF("sampler seed: %u\n",     m_seed);
     LOG_INF("sampler params: \n%s\n", sparams.print().c_str());
     LOG_INF("sampler chain: %s\n",    common_sampler_print(smpl).c_str());
 
@@ -578,6 +653,8 @@ bool Runner::start() {
 
     bool is_interacting  = false;
     bool need_insert_eot = false;
+    bool cancelled = false;
+    bool rejected = false;
 
     if (params.interactive) {
         const char * control_message;
@@ -639,7 +716,7 @@ bool Runner::start() {
 
         if (llama_encode(ctx, llama_batch_get_one(enc_input_buf, enc_input_size))) {
             LOG_ERR("%s : failed to eval\n", __func__);
-            return false;
+            return fail(LLAMA_CORE_ERR_RUN, "failed to eval");
         }
 
         llama_token decoder_start_token_id = llama_model_decoder_start_token(model);
@@ -651,8 +728,41 @@ bool Runner::start() {
         embd_inp.push_back(decoder_start_token_id);
     }
 
+    // the state before the first request, restored to forget the conversation
+    const bool first_input_start = waiting_for_first_input;
+    const std::vector<llama_token> embd_inp_start = first_input_start ? embd_inp : common_tokenize(ctx, "", true, true);
+    const std::vector<common_chat_msg> chat_msgs_start = first_input_start ? chat_msgs : std::vector<common_chat_msg>{};
+    auto start_over = [&]() {
+        llama_memory_clear(mem, true);
+        common_sampler_reset(smpl);
+        {
+            std::lock_guard<std::mutex> lock(m_chat_mtx);
+            chat_msgs = chat_msgs_start;
+        }
+        n_past = 0;
+        ga_i = 0;
+        embd_inp = embd_inp_start;
+        n_consumed = 0;
+        n_remain = params.n_predict;
+        session_tokens.clear();
+        n_session_consumed = 0;
+        path_session.clear();
+        assistant_ss.str("");
+        need_insert_eot = false;
+        embd.clear();
+        m_n_past = 0;
+        is_interacting = true;
+        waiting_for_first_input = true;
+    };
+
     EventProcessor::Event event;
 
+    m_t_load_ms = std::chrono::duration<double, std::milli>(std::chrono::steady_clock::now() - t_start).count();
+    m_t_loaded_unix_ms = std::chrono::duration_cast<std::chrono::milliseconds>(
+            std::chrono::system_clock::now().time_since_epoch()).count();
+    m_ready = true;
+    LOG_INF("%s: model loaded in %.2f ms\n", __func__, m_t_load_ms.load());
+
     while ((n_remain != 0 && !is_antiprompt) || params.interactive) {
         if (!m_running) {
             break;
@@ -682,6 +792,8 @@ bool Runner::start() {
                 if (n_past + (int) embd.size() >= n_ctx) {
                     if (!params.ctx_shift){
                         LOG_DBG("\n\n%s: context full and context shift is disabled => stopping\n", __func__);
+                        m_req_code = LLAMA_CORE_ERR_CONTEXT_OVERFLOW;
+                        m_req_error = "context is full and context shift is disabled";
                         break;
                     }
 
@@ -754,6 +866,7 @@ bool Runner::start() {
                 }
             }
 
+            bool decode_failed = false;
             for (int i = 0; i < (int) embd.size(); i += params.n_batch) {
                 int n_eval = (int) embd.size() - i;
                 if (n_eval > params.n_batch) {
@@ -762,9 +875,26 @@ bool Runner::start() {
 
                 LOG_DBG("eval: %s\n", string_from(ctx, embd).c_str());
 
-                if (llama_decode(ctx, llama_batch_get_one(&embd[i], n_eval))) {
-                    LOG_ERR("%s : failed to eval\n", __func__);
-                    return false;
+                log_capture capture;
+                const int ret = llama_decode(ctx, llama_batch_get_one(&embd[i], n_eval));
+                if (ret != 0) {
+                    LOG_ERR("%s : failed to eval, return code %d\n", __func__, ret);
+                    // 1: no KV cache slot for the batch, -2: buffers could not be allocated
+                    int code = LLAMA_CORE_ERR_RUN;
+                    if (ret == 1) {
+                        code = LLAMA_CORE_ERR_CONTEXT_OVERFLOW;
+                    } else if (ret == -2) {
+                        code = LLAMA_CORE_ERR_OUT_OF_MEMORY;
+                    }
+                    const std::string message = capture.message("failed to eval");
+                    if (!m_busy) {
+                        return fail(code, message);
+                    }
+                    // only the request fails, getPrompt answers it with the error
+                    m_req_code = code;
+                    m_req_error = message;
+                    decode_failed = true;
+                    break;
                 }
 
                 n_past += n_eval;
@@ -776,6 +906,12 @@ bool Runner::start() {
                 }
             }
 
+            if (decode_failed) {
+                // start over from an empty context and wait for the next request
+                start_over();
+                continue;
+            }
+
             if (!embd.empty() && !path_session.empty()) {
                 session_tokens.insert(session_tokens.end(), embd.begin(), embd.end());
                 n_session_consumed = session_tokens.size();
@@ -783,6 +919,7 @@ bool Runner::start() {
         }
 
         embd.clear();
+        m_n_past = n_past;
 
         if ((int) embd_inp.size() <= n_consumed && !is_interacting) {
             // optionally save the session on first sample (for faster prompt loading next time)
@@ -807,6 +944,20 @@ bool Runner::start() {
             // decrement remaining sampling budget
             --n_remain;
 
+            if (m_busy) {
+                if (m_cur.n_gen == 0) {
+                    m_t_first = std::chrono::steady_clock::now();
+                }
+                m_cur.n_gen++;
+
+                if (event.on_token != nullptr) {
+                    const std::string piece = common_token_to_piece(ctx, id, params.special);
+                    if (event.on_token(piece.c_str(), event.user_data) != 0) {
+                        cancelled = true;
+                    }
+                }
+            }
+
             LOG_DBG("n_remain: %d\n", n_remain);
         } else {
             // some user input remains from prompt or interaction, forward it to processing
@@ -929,6 +1080,17 @@ bool Runner::start() {
                 }
             }
 
+            // the caller stopped the generation, finish it like at the end of text
+            if (cancelled) {
+                LOG_DBG("generation stopped by the caller\n");
+                cancelled = false;
+                if (params.enable_chat_template) {
+                    chat_add_and_format("assistant", assistant_ss.str());
+                }
+                need_insert_eot = true;
+                is_interacting = true;
+            }
+
             if ((n_past > 0 || waiting_for_first_input) && is_interacting) {
                 LOG_DBG("waiting for user input\n");
 
@@ -956,6 +1118,9 @@ bool Runner::start() {
                 }
                 buffer=event.data;
                 event.data.clear();
+                if (m_reset.exchange(false) && n_past > 0) {
+                    start_over();
+                }
                 // done taking input, reset color
                 console::set_display(console::reset);
                 display = true;
@@ -999,6 +1164,7 @@ bool Runner::start() {
                     }
 
                     const size_t original_size = embd_inp.size();
+                    const size_t n_chat_msgs = chat_msgs.size();
 
                     bool format_chat = params.conversation_mode && params.enable_chat_template;
                     std::string user_inp = format_chat
@@ -1011,44 +1177,63 @@ bool Runner::start() {
 
                     LOG_DBG("input tokens: %s\n", string_from(ctx, line_inp).c_str());
 
-                    // if user stop generation mid-way, we must add EOT to finish model's last response
-                    if (need_insert_eot && format_chat) {
-                        llama_token eot = llama_vocab_eot(vocab);
-                        embd_inp.push_back(eot == LLAMA_TOKEN_NULL ? llama_vocab_eos(vocab) : eot);
-                        need_insert_eot = false;
-                    }
+                    // a request that can not fit in the context is answered with an
+                    // error instead of being truncated
+                    const int n_input = (int) (line_pfx.size() + line_inp.size() + line_sfx.size());
+                    if (m_busy && n_input > n_ctx - 4) {
+                        LOG_ERR("%s: input is too long (%d tokens, max %d)\n", __func__, n_input, n_ctx - 4);
+                        {
+                            std::lock_guard<std::mutex> lock(m_chat_mtx);
+                            chat_msgs.resize(n_chat_msgs);
+                        }
+                        m_req_code = LLAMA_CORE_ERR_CONTEXT_OVERFLOW;
+                        m_req_error = "input is too long: " + std::to_string(n_input) +
+                                      " tokens, the context holds " + std::to_string(n_ctx - 4);
+                        rejected = true;
+                    } else {
+                        // if user stop generation mid-way, we must add EOT to finish model's last response
+                        if (need_insert_eot && format_chat) {
+                            llama_token eot = llama_vocab_eot(vocab);
+                            embd_inp.push_back(eot == LLAMA_TOKEN_NULL ? llama_vocab_eos(vocab) : eot);
+                            need_insert_eot = false;
+                        }
 
-                    embd_inp.insert(embd_inp.end(), line_pfx.begin(), line_pfx.end());
-                    embd_inp.insert(embd_inp.end(), line_inp.begin(), line_inp.end());
-                    embd_inp.insert(embd_inp.end(), line_sfx.begin(), line_sfx.end());
+                        embd_inp.insert(embd_inp.end(), line_pfx.begin(), line_pfx.end());
+                        embd_inp.insert(embd_inp.end(), line_inp.begin(), line_inp.end());
+                        embd_inp.insert(embd_inp.end(), line_sfx.begin(), line_sfx.end());
+                        m_cur.n_prompt += line_pfx.size() + line_inp.size() + line_sfx.size();
 
 
-                    if (params.verbose_prompt) {
-                        LOG_INF("%s: number of tokens in prompt = %zu\n", __func__, embd_inp.size() - original_size);
-                    }
+                        if (params.verbose_prompt) {
+                            LOG_INF("%s: number of tokens in prompt = %zu\n", __func__, embd_inp.size() - original_size);
+                        }
 
-                    for (size_t i = original_size; i < embd_inp.size(); ++i) {
-                        const llama_token token = embd_inp[i];
-                        const std::string token_str = common_token_to_piece(ctx, token);
-                        output_tokens.push_back(token);
-                        output_ss << token_str;
+                        for (size_t i = original_size; i < embd_inp.size(); ++i) {
+                            const llama_token token = embd_inp[i];
+                            const std::string token_str = common_token_to_piece(ctx, token);
+                            output_tokens.push_back(token);
+                            output_ss << token_str;
 
-                        if (params.verbose_prompt) {
-                            LOG_INF("%6d -> '%s'\n", token, token_str.c_str());
+                            if (params.verbose_prompt) {
+                                LOG_INF("%6d -> '%s'\n", token, token_str.c_str());
+                            }
                         }
-                    }
 
-                    // reset assistant message
-                    assistant_ss.str("");
+                        // reset assistant message
+                        assistant_ss.str("");
 
-                    n_remain -= line_inp.size();
-                    LOG_DBG("n_remain: %d\n", n_remain);
+                        n_remain -= line_inp.size();
+                        LOG_DBG("n_remain: %d\n", n_remain);
+                    }
                 }
 
                 input_echo = false; // do not echo this again
             }
 
-            if (n_past > 0 || waiting_for_first_input) {
+            if (rejected) {
+                // wait for the next request, getPrompt answers this one with its error
+                rejected = false;
+            } else if (n_past > 0 || waiting_for_first_input) {
                 if (is_interacting) {
                     common_sampler_reset(smpl);
                 }
@@ -1075,6 +1260,12 @@ bool Runner::start() {
             is_interacting = true;
         }
     }
+    if (m_req_code != 0) {
+        failRequest(event, m_req_code, m_req_error);
+    } else {
+        // stopped in the middle of a request, its caller is still waiting
+        failRequest(event, LLAMA_CORE_ERR_STOPPED, "Runner stopped");
+    }
     if (!path_session.empty() && params.prompt_cache_all && !params.prompt_cache_ro) {
         LOG("\n%s: saving final output to session file '%s'\n", __func__, path_session.c_str());
         llama_state_save_file(ctx, path_session.c_str(), session_tokens.data(), session_tokens.size());
@@ -1094,10 +1285,10 @@ bool Runner::start() {
 
 bool Runner::stop() {
     if (!isRunning()) {
-        std::cout << "No Start:"<<m_id<< std::endl;
+        LOG_WRN("Runner not started: id=%d\n", m_id);
         return false;
     }
-    std::cout << "Runner Stop:"<<m_id<< std::endl;
+    LOG_INF("Runner stop: id=%d\n", m_id);
 
     m_running = false;
     m_eprocessor.stop();
@@ -1105,44 +1296,205 @@ bool Runner::stop() {
     return true;
 }
 
-const std::string Runner::generate(const std::string& prompt) {
+void Runner::wait() {
+    std::unique_lock<std::mutex> lock(m_done_mtx);
+    m_done_cv.wait(lock, [this]() { return m_done; });
+}
+
+void Runner::acquire() {
+    std::lock_guard<std::mutex> lock(m_done_mtx);
+    m_refs++;
+}
+
+void Runner::release() {
+    {
+        std::lock_guard<std::mutex> lock(m_done_mtx);
+        m_refs--;
+    }
+    m_done_cv.notify_all();
+}
+
+void Runner::drain() {
+    std::unique_lock<std::mutex> lock(m_done_mtx);
+    m_done_cv.wait(lock, [this]() { return m_refs == 0; });
+}
+
+bool Runner::fail(int code, const std::string& message) {
+    m_error_code = code;
+    m_error = message;
+    return false;
+}
+
+void Runner::failRequest(EventProcessor::Event& event, int code, const std::string& message) {
+    m_req_code = 0;
+    m_req_error.clear();
+    if (!m_busy) {
+        return;
+    }
+    try {
+        event.result.set_exception(std::make_exception_ptr(core_error(code, message)));
+    } catch (...) {
+    }
+    m_busy = false;
+}
+
+int Runner::getError(std::string& message) {
+    message = m_error;
+    return m_error_code;
+}
+
+const std::string Runner::generate(const std::string& prompt, llama_gen_stats * stats,
+                                   llama_token_callback on_token, void * user_data) {
     if (!isRunning()) {
-        std::cout << "No Start:"<<m_id<< std::endl;
-        return "";
+        LOG_WRN("Runner not started: id=%d\n", m_id);
+        throw std::runtime_error("Runner is not started");
     }
-    std::cout << "Runner generate id:"<<m_id<<" prompt:"<<prompt<< std::endl;
+    LOG_DBG("Runner generate: id=%d prompt=%s\n", m_id, prompt.c_str());
 
     std::vector<Message> mgs;
     Message mg{"user",prompt};
     mgs.push_back(mg);
 
-    return m_eprocessor.enqueue(mgs);
+    return m_eprocessor.enqueue(mgs, stats, on_token, user_data);
 }
 
-const std::string Runner::chat(const std::vector<Message>& mgs) {
+const std::string Runner::chat(const std::vector<Message>& mgs, llama_gen_stats * stats,
+                               llama_token_callback on_token, void * user_data) {
     if (!isRunning()) {
-        std::cout << "No Start:"<<m_id<< std::endl;
-        return "";
+        LOG_WRN("Runner not started: id=%d\n", m_id);
+        throw std::runtime_error("Runner is not started");
     }
-    std::cout << "Runner chat id:"<<m_id<<" message.size:"<<mgs.size()<< std::endl;
+    LOG_DBG("Runner chat: id=%d messages=%zu\n", m_id, mgs.size());
 
-    return m_eprocessor.enqueue(mgs);
+    return m_eprocessor.enqueue(mgs, stats, on_token, user_data);
 }
 
 int Runner::getID() {
     return m_id;
 }
 
+bool Runner::render(const std::vector<Message>& mgs, std::string& prompt, int& n_tokens) {
+    std::lock_guard<std::mutex> lock(m_chat_mtx);
+    llama_context * ctx = m_ctx;
+    if (ctx == nullptr || m_chat_msgs == nullptr) {
+        return false;
+    }
+    const common_params & params = *m_params;
+
+    // the same steps the main loop applies to an event
+    std::vector<common_chat_msg> new_msg;
+    std::string buffer_content;
+    for (Message msg:mgs) {
+        if (!msg.content.empty() && msg.content.back() == '\n') {
+            msg.content.pop_back();
+        }
+        if (params.escape) {
+            string_process_escapes(msg.content);
+        }
+        if (!buffer_content.empty()) {
+            buffer_content +="\n";
+        }
+        buffer_content +=msg.content;
+
+        common_chat_msg cmsg;
+        msg.fillMessage(cmsg);
+        new_msg.push_back(cmsg);
+    }
+
+    bool format_chat = params.conversation_mode && params.enable_chat_template;
+    std::string user_inp = format_chat
+                           ? common_chat_formats(m_chat_templates, *m_chat_msgs, new_msg, params.use_jinja)
+                           : buffer_content;
+
+    n_tokens = common_tokenize(ctx, params.input_prefix, false, true).size() +
+               common_tokenize(ctx, user_inp,            false, format_chat).size() +
+               common_tokenize(ctx, params.input_suffix, false, true).size();
+    prompt = params.input_prefix + user_inp + params.input_suffix;
+    return true;
+}
+
+int Runner::getCtxSize() {
+    llama_context * ctx = m_ctx;
+    if (ctx == nullptr) {
+        return 0;
+    }
+    return llama_n_ctx(ctx);
+}
+
+int Runner::getNPast() {
+    return m_n_past;
+}
+
+const llama_vocab * Runner::acquireVocab() {
+    std::lock_guard<std::mutex> lock(m_done_mtx);
+    llama_model * model = m_model;
+    if (model == nullptr) {
+        return nullptr;
+    }
+    m_vocab_refs++;
+    return llama_model_get_vocab(model);
+}
+
+void Runner::releaseVocab() {
+    {
+        std::lock_guard<std::mutex> lock(m_done_mtx);
+        m_vocab_refs--;
+    }
+    m_done_cv.notify_all();
+}
+
+void Runner::reset() {
+    m_reset = true;
+}
+
 bool Runner::isRunning() {
     return m_running;
 }
 
+void Runner::getStatus(llama_runner_status& status) {
+    status.running = isRunning() ? 1 : 0;
+    status.ready = m_ready ? 1 : 0;
+    status.busy = m_busy ? 1 : 0;
+    status.queue_depth = (int) m_eprocessor.size();
+    status.n_ctx = getCtxSize();
+    status.n_past = getNPast();
+    status.n_prompt_total = m_n_prompt_total;
+    status.n_gen_total = m_n_gen_total;
+    status.t_load_ms = m_t_load_ms;
+    status.t_loaded_unix_ms = m_t_loaded_unix_ms;
+    if (m_ready) {
+        status.seed = m_seed;
+        status.temp = m_sampling.temp;
+        status.top_k = m_sampling.top_k;
+        status.top_p = m_sampling.top_p;
+        status.min_p = m_sampling.min_p;
+        status.repeat_penalty = m_sampling.penalty_repeat;
+    }
+}
+
 bool Runner::getPrompt(EventProcessor::Event& event) {
     if (!isRunning()) {
         return false;
     }
     if (m_async) {
-        if (!m_output_ss->str().empty()) {
+        if (m_req_code != 0) {
+            failRequest(event, m_req_code, m_req_error);
+            m_output_ss->str("");
+            m_output_ss->clear();
+        }
+        if (m_busy || !m_output_ss->str().empty()) {
+            if (m_busy) {
+                const auto now = std::chrono::steady_clock::now();
+                m_cur.t_total_ms = std::chrono::duration<double, std::milli>(now - m_t_dequeue).count();
+                if (m_cur.n_gen > 0) {
+                    m_cur.t_first_ms = std::chrono::duration<double, std::milli>(m_t_first - m_t_dequeue).count();
+                }
+                m_n_prompt_total += m_cur.n_prompt;
+                m_n_gen_total += m_cur.n_gen;
+                if (event.stats != nullptr) {
+                    *event.stats = m_cur;
+                }
+            }
             try {
                 event.result.set_value(m_output_ss->str());
             } catch (...) {
@@ -1151,7 +1503,15 @@ bool Runner::getPrompt(EventProcessor::Event& event) {
             m_output_ss->str("");
             m_output_ss->clear();
         }
-        return m_eprocessor.dequeue(event);
+        m_busy = false;
+        if (!m_eprocessor.dequeue(event)) {
+            return false;
+        }
+        m_t_dequeue = std::chrono::steady_clock::now();
+        m_cur = llama_gen_stats{};
+        m_cur.t_queue_ms = std::chrono::duration<double, std::milli>(m_t_dequeue - event.enqueued).count();
+        m_busy = true;
+        return true;
     }
     std::string line;
     std::string buffer;
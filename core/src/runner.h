@@ -3,6 +3,8 @@
 #include "event_processor.h"
 #include "sampling.h"
 #include "message.h"
+#include "core_types.h"
+#include "core_model.h"
 
 class Runner {
 private:
@@ -12,12 +14,60 @@ private:
     std::atomic<bool> m_running;
     bool m_async;
 
-    llama_context           * m_ctx;
-    llama_model             * m_model;
+    // m_done is false while start() runs and m_refs counts the callers using
+    // the runner, both are waited on before freeing it. m_vocab_refs counts
+    // the callers using the vocab, waited on before freeing the model
+    std::mutex              m_done_mtx;
+    std::condition_variable m_done_cv;
+    bool                    m_done = true;
+    int                     m_refs = 0;
+    int                     m_vocab_refs = 0;
+
+    // the model shared with other runners, loaded by start() when null
+    CoreModel * m_shared_model = nullptr;
+
+    std::atomic<llama_context *> m_ctx;
+    std::atomic<llama_model *>   m_model;
     common_sampler          * m_smpl;
     common_params           * m_params;
     std::string               m_prompt;
 
+    common_chat_templates        * m_chat_templates = nullptr;
+    std::vector<common_chat_msg> * m_chat_msgs = nullptr;
+    std::mutex                     m_chat_mtx;
+    std::atomic<int>               m_n_past{0};
+
+    std::atomic<bool>               m_ready{false};
+    std::atomic<bool>               m_busy{false};
+    // set by reset(), the main loop starts over before the next request
+    std::atomic<bool>               m_reset{false};
+    std::atomic<unsigned long long> m_n_prompt_total{0};
+    std::atomic<unsigned long long> m_n_gen_total{0};
+    std::atomic<double>             m_t_load_ms{0};
+    std::atomic<long long>          m_t_loaded_unix_ms{0};
+
+    // the sampling, written once before m_ready is set
+    unsigned int m_seed = 0;
+    common_params_sampling m_sampling;
+
+    // the request being processed, only touched by the main loop
+    llama_gen_stats                       m_cur{};
+    std::chrono::steady_clock::time_point m_t_dequeue;
+    std::chrono::steady_clock::time_point m_t_first;
+
+    // why start() failed, read once it returned
+    int         m_error_code = 0;
+    std::string m_error;
+
+    bool fail(int code, const std::string& message);
+
+    // why the current request was rejected, answered by getPrompt
+    int         m_req_code = 0;
+    std::string m_req_error;
+
+    // answer the current request with the error, if there is one
+    void failRequest(EventProcessor::Event& event, int code, const std::string& message);
+
     std::vector<llama_token> * m_input_tokens;
     std::ostringstream       * m_output_ss;
     std::vector<llama_token> * m_output_tokens;
@@ -25,12 +75,31 @@ private:
 public:
     Runner(int id,const std::vector<std::string>& args,bool async= false,const std::string& prompt="");
     ~Runner();
+    // use the shared model, the runner holds a reference until it is deleted
+    void setSharedModel(CoreModel * model);
     bool start();
     bool stop();
-    const std::string generate(const std::string& prompt);
-    const std::string chat(const std::vector<Message>& mgs);
+    void wait();
+    void acquire();
+    void release();
+    void drain();
+    const std::string generate(const std::string& prompt, llama_gen_stats * stats = nullptr,
+                               llama_token_callback on_token = nullptr, void * user_data = nullptr);
+    const std::string chat(const std::vector<Message>& mgs, llama_gen_stats * stats = nullptr,
+                           llama_token_callback on_token = nullptr, void * user_data = nullptr);
+    bool render(const std::vector<Message>& mgs, std::string& prompt, int& n_tokens);
+    // the next request starts from an empty context, without the conversation
+    void reset();
     int getID();
+    int getError(std::string& message);
+    int getCtxSize();
+    int getNPast();
+    // the vocab of the loaded model or null, the model is not freed until
+    // releaseVocab is called
+    const llama_vocab * acquireVocab();
+    void releaseVocab();
     bool isRunning();
+    void getStatus(llama_runner_status& status);
 
     bool getPrompt(EventProcessor::Event& event);
 };
\ No newline at end of file
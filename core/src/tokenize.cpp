@@ -0,0 +1,146 @@
+#include "tokenize.h"
+#include "common.h"
+#include "core_util.h"
+#include "llama.h"
+#include "core_log.h"
+#include "runner.h"
+#include <cstdlib>
+#include <cstring>
+#include <shared_mutex>
+#include <string>
+#include <vector>
+
+// Runner owned by process.cpp
+extern Runner *g_runner;
+extern std::shared_mutex g_runner_mtx;
+
+static llama_model *g_vocab_model = nullptr;
+
+// The vocab of the runner or of the vocab only model, the model of the runner
+// is not freed until the vocab_ref is destroyed. The caller holds g_runner_mtx
+// shared, so the runner itself is not deleted meanwhile.
+struct vocab_ref {
+    Runner *runner = nullptr;
+    const llama_vocab *vocab = nullptr;
+    ~vocab_ref() {
+        if (runner != nullptr) {
+            runner->releaseVocab();
+        }
+    }
+};
+
+static bool current_vocab(vocab_ref &ref, struct llama_core_error *err) {
+    if (g_runner != nullptr && g_runner->isRunning()) {
+        ref.vocab = g_runner->acquireVocab();
+        if (ref.vocab != nullptr) {
+            ref.runner = g_runner;
+            return true;
+        }
+    }
+    if (g_vocab_model != nullptr) {
+        ref.vocab = llama_model_get_vocab(g_vocab_model);
+        return true;
+    }
+    LOG_ERR("%s: no model is loaded\n", __func__);
+    set_error(err, LLAMA_CORE_ERR_NOT_STARTED, "no model is loaded");
+    return false;
+}
+
+extern "C" {
+int llama_vocab_only_load(const char *model_file,
+                          struct llama_core_error *err) {
+    llama_vocab_only_free();
+
+    common_params cparams;
+    cparams.model.path = model_file;
+    if (model_file_missing(cparams)) {
+        LOG_ERR("%s: model file '%s' not found\n", __func__, model_file);
+        return set_error(err, LLAMA_CORE_ERR_MODEL_NOT_FOUND,
+                         std::string("model file not found: ") + model_file);
+    }
+
+    core_log_init();
+    llama_backend_init();
+
+    llama_model_params params = llama_model_default_params();
+    params.vocab_only = true;
+
+    log_capture capture;
+    g_vocab_model = llama_model_load_from_file(model_file, params);
+    if (g_vocab_model == nullptr) {
+        LOG_ERR("%s: unable to load vocabulary from '%s'\n", __func__, model_file);
+        return set_error(err, load_error_code(capture.errors, LLAMA_CORE_ERR_MODEL_INVALID),
+                         capture.message(std::string("unable to load vocabulary from ") + model_file));
+    }
+    return LLAMA_CORE_OK;
+}
+
+void llama_vocab_only_free() {
+    if (g_vocab_model != nullptr) {
+        llama_model_free(g_vocab_model);
+        g_vocab_model = nullptr;
+    }
+}
+
+int llama_text_tokenize(const char *text, int add_special, int parse_special,
+                        int **tokens, struct llama_core_error *err) {
+    *tokens = nullptr;
+    std::shared_lock<std::shared_mutex> lock(g_runner_mtx);
+    vocab_ref ref;
+    if (!current_vocab(ref, err)) {
+        return -1;
+    }
+    const llama_vocab *vocab = ref.vocab;
+    std::vector<llama_token> result;
+    try {
+        result = common_tokenize(vocab, text, add_special > 0, parse_special > 0);
+    } catch (const std::exception &e) {
+        LOG_ERR("%s: %s\n", __func__, e.what());
+        set_error(err, LLAMA_CORE_ERR_TOKENIZE, e.what());
+        return -1;
+    }
+    if (result.empty()) {
+        return 0;
+    }
+    *tokens = static_cast<int *>(malloc(result.size() * sizeof(int)));
+    std::copy(result.begin(), result.end(), *tokens);
+    return (int)result.size();
+}
+
+char *llama_text_detokenize(const int *tokens, int n_tokens, int special,
+                            struct llama_core_error *err) {
+    std::shared_lock<std::shared_mutex> lock(g_runner_mtx);
+    vocab_ref ref;
+    if (!current_vocab(ref, err)) {
+        return nullptr;
+    }
+    const llama_vocab *vocab = ref.vocab;
+    const int n_vocab = llama_vocab_n_tokens(vocab);
+    std::vector<llama_token> v_tokens(tokens, tokens + n_tokens);
+    for (llama_token token : v_tokens) {
+        if (token < 0 || token >= n_vocab) {
+            LOG_ERR("%s: invalid token %d\n", __func__, token);
+            set_error(err, LLAMA_CORE_ERR_TOKENIZE,
+                      "invalid token " + std::to_string(token));
+            return nullptr;
+        }
+    }
+    return copy_string(common_detokenize(vocab, v_tokens, special > 0));
+}
+
+char *llama_token_piece(int token, int special, struct llama_core_error *err) {
+    std::shared_lock<std::shared_mutex> lock(g_runner_mtx);
+    vocab_ref ref;
+    if (!current_vocab(ref, err)) {
+        return nullptr;
+    }
+    const llama_vocab *vocab = ref.vocab;
+    if (token < 0 || token >= llama_vocab_n_tokens(vocab)) {
+        LOG_ERR("%s: invalid token %d\n", __func__, token);
+        set_error(err, LLAMA_CORE_ERR_TOKENIZE,
+                  "invalid token " + std::to_string(token));
+        return nullptr;
+    }
+    return copy_string(common_token_to_piece(vocab, token, special > 0));
+}
+} // extern "C"
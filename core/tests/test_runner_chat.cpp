@@ -33,7 +33,7 @@ int main() {
         const char* contents[] = {"llama","why sky is blue"};
         int size = 2;
 
-        std::string content = llama_chat(roles,contents,size);
+        std::string content = llama_chat(roles,contents,size,nullptr);
         if (content.empty()) {
             return;
         }
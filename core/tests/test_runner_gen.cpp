@@ -30,14 +30,14 @@ int main() {
 
     std::future<void> ll_gen = std::async(std::launch::async, [](){
         std::string prompt="why sky is blue";
-        std::string content = llama_gen(prompt.c_str());
+        std::string content = llama_gen(prompt.c_str(), nullptr);
         if (content.empty()) {
             return;
         }
         std::cout<<"Response:"<<content<<std::endl;
 
         prompt="what color is water";
-        content = llama_gen(prompt.c_str());
+        content = llama_gen(prompt.c_str(), nullptr);
         if (content.empty()) {
             return;
         }
@@ -0,0 +1,190 @@
+// Copyright (c) 2017-2025 The qitmeer developers
+
+package llama
+
+import (
+	"context"
+	"fmt"
+	"github.com/Qitmeer/llama.go/wrapper"
+	"github.com/ollama/ollama/api"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// readyPollInterval is how often a new context is checked for readiness
+const readyPollInterval = 10 * time.Millisecond
+
+// ContextOptions are the options of a context, nil uses the defaults
+type ContextOptions struct {
+	// CtxSize is the size of the prompt context, 0 uses the size of the model
+	CtxSize int
+	// NPredict is the number of tokens to generate, 0 keeps the llama.cpp
+	// default and -1 generates until the end of text
+	NPredict int
+	// Seed is the RNG seed, 0 keeps the llama.cpp default
+	Seed uint
+	// Args are extra llama.cpp options, for example []string{"--temp", "0.2"}
+	Args []string
+}
+
+func (o *ContextOptions) args() []string {
+	args := []string{program, "-i"}
+	if o == nil {
+		return args
+	}
+	if o.CtxSize > 0 {
+		args = append(args, "--ctx-size", strconv.Itoa(o.CtxSize))
+	}
+	if o.NPredict != 0 {
+		args = append(args, "--n-predict", strconv.Itoa(o.NPredict))
+	}
+	if o.Seed > 0 {
+		args = append(args, "--seed", strconv.FormatUint(uint64(o.Seed), 10))
+	}
+	return append(args, o.Args...)
+}
+
+// Message is a chat message
+type Message struct {
+	Role    string
+	Content string
+}
+
+// Context generates with a model, it has its own KV cache and runs its
+// requests one after the other. Chat keeps the conversation in the context,
+// so only the new messages are sent each time.
+type Context struct {
+	model *Model
+	r     *wrapper.Runner
+
+	// mu is held shared by the requests and exclusively by Close
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewContext creates a context of the model and waits until it is ready
+func (m *Model) NewContext(opts *ContextOptions) (*Context, error) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("model is closed")
+	}
+	m.busy.Add(1)
+	m.mu.Unlock()
+	defer m.busy.Done()
+
+	// the runner holds a reference on the model while it loads
+	r := m.m.NewRunner(opts.args())
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Start()
+	}()
+
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+	for !r.Status().Ready {
+		select {
+		case err := <-done:
+			r.Free()
+			if err == nil {
+				err = fmt.Errorf("context stopped while loading")
+			}
+			return nil, err
+		case <-ticker.C:
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		r.Free()
+		return nil, fmt.Errorf("model is closed")
+	}
+	c := &Context{model: m, r: r}
+	m.contexts[c] = struct{}{}
+	return c, nil
+}
+
+// Generate completes the prompt, onToken receives the generated tokens and
+// may be nil. When ctx is done the generation stops and its text so far is
+// returned with the error of ctx.
+func (c *Context) Generate(ctx context.Context, prompt string, onToken TokenFunc) (string, *Stats, error) {
+	return c.run(ctx, onToken, func(fn wrapper.TokenFunc) (string, *Stats, error) {
+		return c.r.Generate(prompt, fn)
+	})
+}
+
+// Chat continues the conversation of the context with the messages, onToken
+// receives the generated tokens and may be nil. When ctx is done the
+// generation stops and its text so far is returned with the error of ctx.
+// Any other error clears the conversation of the context, the next call
+// must send it again.
+func (c *Context) Chat(ctx context.Context, msgs []Message, onToken TokenFunc) (string, *Stats, error) {
+	amsgs := make([]api.Message, len(msgs))
+	for i, m := range msgs {
+		amsgs[i] = api.Message{Role: m.Role, Content: m.Content}
+	}
+	return c.run(ctx, onToken, func(fn wrapper.TokenFunc) (string, *Stats, error) {
+		return c.r.Chat(amsgs, fn)
+	})
+}
+
+func (c *Context) run(ctx context.Context, onToken TokenFunc, call func(wrapper.TokenFunc) (string, *Stats, error)) (string, *Stats, error) {
+	if err := ctx.Err(); err != nil {
+		return "", nil, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return "", nil, fmt.Errorf("context is closed")
+	}
+
+	content, stats, err := call(func(piece string) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		return onToken == nil || onToken(piece)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return content, stats, ctx.Err()
+}
+
+// Reset forgets the conversation, the next request starts from an empty
+// context. It reuses the context for unrelated requests without loading a
+// new one.
+func (c *Context) Reset() {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.closed {
+		c.r.Reset()
+	}
+}
+
+// Status returns the state of the context
+func (c *Context) Status() wrapper.Status {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return wrapper.Status{}
+	}
+	return c.r.Status()
+}
+
+// Close waits for the requests in progress and releases the context
+func (c *Context) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.r.Free()
+	c.mu.Unlock()
+
+	c.model.mu.Lock()
+	delete(c.model.contexts, c)
+	c.model.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,225 @@
+// Copyright (c) 2017-2025 The qitmeer developers
+
+// Package llama embeds the inference in Go programs without the HTTP server.
+// A Model is loaded once and shared by its contexts, every Context has its
+// own KV cache and processes its requests in order. Several models and
+// contexts can be used at the same time.
+package llama
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Qitmeer/llama.go/wrapper"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// program is argv[0] of the llama.cpp command lines
+const program = "llama"
+
+// embdSeparator joins the texts of one embedding call
+const embdSeparator = "<#sep#>"
+
+// Stats are the token counts and timings of one generation
+type Stats = wrapper.GenStats
+
+// Error is the failure of a call to llama.cpp, its Message is the reason
+// llama.cpp gave. Test its cause with errors.Is and the Err* values.
+type Error = wrapper.Error
+
+// Causes of the errors returned by the package
+var (
+	ErrInvalidArgs     = wrapper.ErrInvalidArgs
+	ErrNotStarted      = wrapper.ErrNotStarted
+	ErrLoadFailed      = wrapper.ErrLoadFailed
+	ErrStopped         = wrapper.ErrStopped
+	ErrRunFailed       = wrapper.ErrRunFailed
+	ErrModelNotFound   = wrapper.ErrModelNotFound
+	ErrModelInvalid    = wrapper.ErrModelInvalid
+	ErrOutOfMemory     = wrapper.ErrOutOfMemory
+	ErrContextOverflow = wrapper.ErrContextOverflow
+	ErrTokenize        = wrapper.ErrTokenize
+)
+
+// TokenFunc receives the text of every generated token, returning false
+// stops the generation
+type TokenFunc func(piece string) bool
+
+// ModelOptions are the options to load a model, nil uses the defaults
+type ModelOptions struct {
+	// NGpuLayers is the number of layers offloaded to the GPU, 0 runs on the
+	// CPU and nil keeps the llama.cpp default
+	NGpuLayers *int
+	// Args are extra llama.cpp model options, for example []string{"--no-mmap"}
+	Args []string
+}
+
+func (o *ModelOptions) args() []string {
+	var args []string
+	if o == nil {
+		return args
+	}
+	if o.NGpuLayers != nil {
+		args = append(args, "--n-gpu-layers", strconv.Itoa(*o.NGpuLayers))
+	}
+	return append(args, o.Args...)
+}
+
+// EmbedOptions are the options of Model.Embed, nil uses the defaults
+type EmbedOptions struct {
+	// Pooling is none, mean, cls, last or rank, empty uses the model default
+	Pooling string
+	// BatchSize is the maximum number of tokens of a text, 0 keeps the llama.cpp default
+	BatchSize int
+	// Args are extra llama.cpp embedding options, for example []string{"--embd-normalize", "-1"}
+	Args []string
+}
+
+// Model is a loaded model, Close releases it with its contexts
+type Model struct {
+	mu       sync.Mutex
+	m        *wrapper.Model
+	contexts map[*Context]struct{}
+	closed   bool
+	// busy counts the embeddings and the contexts being created
+	busy sync.WaitGroup
+	// release frees the memory the model was loaded from
+	release func()
+}
+
+// LoadModel loads the model file at path
+func LoadModel(path string, opts *ModelOptions) (*Model, error) {
+	if len(path) <= 0 {
+		return nil, fmt.Errorf("No model")
+	}
+	args := append([]string{program, "--model", path}, opts.args()...)
+	m, err := wrapper.LoadModel(args)
+	if err != nil {
+		return nil, err
+	}
+	return newModel(m, nil), nil
+}
+
+// LoadModelFromBytes loads a model from its GGUF data, which is kept in place
+// until the model is closed and must not be modified
+func LoadModelFromBytes(data []byte, opts *ModelOptions) (*Model, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty model data")
+	}
+	// the model reads the buffer while it is loaded, the GC must not move it
+	var pin runtime.Pinner
+	pin.Pin(&data[0])
+
+	args := append([]string{program}, opts.args()...)
+	m, err := wrapper.LoadModelFromMemory(unsafe.Pointer(&data[0]), len(data), false, args)
+	if err != nil {
+		pin.Unpin()
+		return nil, err
+	}
+	return newModel(m, pin.Unpin), nil
+}
+
+// LoadModelFromMmap maps the model file at path into memory and loads it
+// from the mapping, which is unmapped when the model is closed
+func LoadModelFromMmap(path string, opts *ModelOptions) (*Model, error) {
+	_, data, err := wrapper.MmapModel(path)
+	if err != nil {
+		return nil, err
+	}
+	args := append([]string{program}, opts.args()...)
+	m, err := wrapper.LoadModelFromMemory(unsafe.Pointer(&data[0]), len(data), true, args)
+	if err != nil {
+		wrapper.UnmapModel(data)
+		return nil, err
+	}
+	return newModel(m, func() { wrapper.UnmapModel(data) }), nil
+}
+
+func newModel(m *wrapper.Model, release func()) *Model {
+	return &Model{
+		m:        m,
+		contexts: map[*Context]struct{}{},
+		release:  release,
+	}
+}
+
+// Embed returns the embeddings of the texts, computed with a context of
+// their own. ctx is only checked before the computation starts.
+func (m *Model) Embed(ctx context.Context, texts []string, opts *EmbedOptions) ([][]float32, error) {
+	if len(texts) == 0 {
+		return [][]float32{}, nil
+	}
+	for _, t := range texts {
+		if len(t) == 0 {
+			return nil, fmt.Errorf("texts must not contain empty strings")
+		}
+		if strings.Contains(t, embdSeparator) {
+			return nil, fmt.Errorf("texts must not contain %s", embdSeparator)
+		}
+	}
+	args := []string{program, "--embd-output-format", "array", "--embd-separator", embdSeparator}
+	if opts != nil {
+		if len(opts.Pooling) > 0 {
+			args = append(args, "--pooling", opts.Pooling)
+		}
+		if opts.BatchSize > 0 {
+			args = append(args, "--batch-size", strconv.Itoa(opts.BatchSize))
+		}
+		args = append(args, opts.Args...)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("model is closed")
+	}
+	m.busy.Add(1)
+	m.mu.Unlock()
+	defer m.busy.Done()
+
+	ret, err := m.m.Embedding(args, strings.Join(texts, embdSeparator))
+	if err != nil {
+		return nil, err
+	}
+	var embeddings [][]float32
+	err = json.Unmarshal([]byte(ret), &embeddings)
+	if err != nil {
+		return nil, err
+	}
+	if len(embeddings) != len(texts) {
+		return nil, fmt.Errorf("%d embeddings for %d texts", len(embeddings), len(texts))
+	}
+	return embeddings, nil
+}
+
+// Close closes the contexts of the model and releases it
+func (m *Model) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	contexts := make([]*Context, 0, len(m.contexts))
+	for c := range m.contexts {
+		contexts = append(contexts, c)
+	}
+	m.mu.Unlock()
+
+	for _, c := range contexts {
+		c.Close()
+	}
+	m.busy.Wait()
+	m.m.Free()
+	if m.release != nil {
+		m.release()
+	}
+	return nil
+}
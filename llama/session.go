@@ -0,0 +1,78 @@
+// Copyright (c) 2017-2025 The qitmeer developers
+
+package llama
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// Session is a conversation on a context of its own. The context keeps the
+// tokens of the conversation in its cache, the session keeps its messages.
+type Session struct {
+	c *Context
+
+	mu       sync.Mutex
+	system   string
+	messages []Message
+	// stale is set once a failed request cleared the context, the next
+	// request sends the whole conversation again
+	stale bool
+}
+
+// NewSession starts a conversation with the model, system may be empty
+func (m *Model) NewSession(opts *ContextOptions, system string) (*Session, error) {
+	c, err := m.NewContext(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{c: c, system: system}, nil
+}
+
+// Send adds the user message to the conversation and returns the answer,
+// onToken receives the generated tokens and may be nil. An answer stopped by
+// ctx is kept in the conversation as far as it was generated, a failed one is
+// not and the conversation is sent again with the next message.
+func (s *Session) Send(ctx context.Context, content string, onToken TokenFunc) (string, *Stats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return "", nil, err
+	}
+	turn := []Message{{Role: "user", Content: content}}
+	if len(s.messages) == 0 && len(s.system) > 0 {
+		turn = append([]Message{{Role: "system", Content: s.system}}, turn...)
+	}
+	msgs := turn
+	if s.stale {
+		msgs = append(slices.Clone(s.messages), turn...)
+	}
+	answer, stats, err := s.c.Chat(ctx, msgs, onToken)
+	if stats == nil {
+		s.stale = true
+		return "", nil, err
+	}
+	s.stale = false
+	s.messages = append(s.messages, turn...)
+	s.messages = append(s.messages, Message{Role: "assistant", Content: answer})
+	return answer, stats, err
+}
+
+// Messages returns the messages of the conversation
+func (s *Session) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.messages)
+}
+
+// Context returns the context of the session
+func (s *Session) Context() *Context {
+	return s.c
+}
+
+// Close ends the conversation and releases its context
+func (s *Session) Close() error {
+	return s.c.Close()
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/Qitmeer/llama.go/wrapper"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/gin-gonic/gin"
+	"time"
+)
+
+// requestIDHeader carries the ID of a request, taken from the client or generated
+const requestIDHeader = "X-Request-ID"
+
+// requestIDContextKey is the gin context key of the request ID
+const requestIDContextKey = "llamago.request_id"
+
+// statsContextKey is the gin context key of the stats of the generation
+const statsContextKey = "llamago.stats"
+
+// maxRequestIDLength bounds the IDs accepted from clients
+const maxRequestIDLength = 128
+
+// maxLoggedPrompt is the number of characters of the prompt in the access log
+const maxLoggedPrompt = 200
+
+// requestID returns the ID of the request
+func requestID(c *gin.Context) string {
+	return c.GetString(requestIDContextKey)
+}
+
+// validRequestID accepts the IDs made of letters, digits and -_.:
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-' || r == '_' || r == '.' || r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// accessLogMiddleware sets the request ID and writes one line per request
+// with its route, model, status, token counts and timings
+func (s *Service) accessLogMiddleware() gin.HandlerFunc {
+	redact := s.cfg.AccessLogRedact
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Set(requestIDContextKey, id)
+		c.Header(requestIDHeader, id)
+
+		c.Next()
+		model, prompt := requestSummary(c)
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		ctx := []interface{}{
+			"id", id,
+			"method", c.Request.Method,
+			"route", route,
+			"status", c.Writer.Status(),
+			"client", c.ClientIP(),
+		}
+		if len(model) > 0 {
+			ctx = append(ctx, "model", model)
+		}
+		if v, ok := c.Get(statsContextKey); ok {
+			stats := v.(*wrapper.GenStats)
+			ctx = append(ctx,
+				"queue", stats.QueueDuration,
+				"prompt_tokens", stats.PromptTokens,
+				"completion_tokens", stats.GeneratedTokens)
+		}
+		ctx = append(ctx, "duration", time.Since(start))
+		if len(prompt) > 0 && !redact {
+			ctx = append(ctx, "prompt", truncate(prompt, maxLoggedPrompt))
+		}
+		log.Info("Request", ctx...)
+	}
+}
+
+// requestSummary is the model and the prompt of the JSON request body read
+// by peekBody, the prompt of a chat is its last message. Requests whose body
+// was not read, or was too large, have none.
+func requestSummary(c *gin.Context) (string, string) {
+	v, ok := c.Get(peekedBodyContextKey)
+	if !ok || len(v.(peekedBody).data) == 0 {
+		return "", ""
+	}
+	data := v.(peekedBody).data
+	var body struct {
+		Model    string          `json:"model"`
+		Prompt   json.RawMessage `json:"prompt"`
+		Text     string          `json:"text"`
+		Messages []struct {
+			Content json.RawMessage `json:"content"`
+		} `json:"messages"`
+	}
+	_ = json.Unmarshal(data, &body)
+
+	prompt := jsonText(body.Prompt)
+	if len(body.Messages) > 0 {
+		prompt = jsonText(body.Messages[len(body.Messages)-1].Content)
+	}
+	if len(prompt) == 0 {
+		prompt = body.Text
+	}
+	return body.Model, prompt
+}
+
+// jsonText is the value of a JSON string, or of the first string of an array
+func jsonText(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var list []json.RawMessage
+	if json.Unmarshal(raw, &list) == nil && len(list) > 0 {
+		return jsonText(list[0])
+	}
+	// a content part of the OpenAI API
+	var part struct {
+		Text string `json:"text"`
+	}
+	_ = json.Unmarshal(raw, &part)
+	return part.Text
+}
+
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n]) + "..."
+}
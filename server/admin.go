@@ -0,0 +1,142 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Qitmeer/llama.go/config"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// ReloadFunc loads the model of the config next to the current one and swaps
+// the traffic to it, the current model keeps serving if it fails
+type ReloadFunc func(cfg *config.Config) error
+
+type ReloadRequest struct {
+	// Model is a model section of the config file or a model path
+	Model      string `json:"model,omitempty"`
+	CtxSize    *int   `json:"ctx_size,omitempty"`
+	NGpuLayers *int   `json:"n_gpu_layers,omitempty"`
+	NPredict   *int   `json:"n_predict,omitempty"`
+	Seed       *uint  `json:"seed,omitempty"`
+}
+
+type ReloadResponse struct {
+	Model        string        `json:"model"`
+	CtxSize      int           `json:"ctx_size"`
+	LoadDuration time.Duration `json:"load_duration"`
+}
+
+// modelState is the config of the model being served, it changes on reload
+type modelState struct {
+	mu       sync.RWMutex
+	cfg      *config.Config
+	reloader ReloadFunc
+}
+
+// ModelConfig returns the config of the model being served
+func (s *Service) ModelConfig() *config.Config {
+	s.model.mu.RLock()
+	defer s.model.mu.RUnlock()
+	if s.model.cfg == nil {
+		return s.cfg
+	}
+	return s.model.cfg
+}
+
+// SetModelConfig records the config of the model swapped in by a reload
+func (s *Service) SetModelConfig(cfg *config.Config) {
+	s.model.mu.Lock()
+	defer s.model.mu.Unlock()
+	s.model.cfg = cfg
+}
+
+// SetReloader enables the reload endpoint
+func (s *Service) SetReloader(fn ReloadFunc) {
+	s.model.mu.Lock()
+	defer s.model.mu.Unlock()
+	s.model.reloader = fn
+}
+
+// adminMiddleware only allows local clients to use the admin routes when
+// authentication is disabled, with authentication only admin keys
+func (s *Service) adminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.auth.Enabled() {
+			if key := requestKey(c); key == nil || !key.isAdmin() {
+				id := ""
+				if key != nil {
+					id = key.ID
+				}
+				log.Warn("Reject admin request of a key without admin scope", "key", id, "route", s.route(c))
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("API key '%s' is not an admin key, its routes must include %s*", id, adminRoute)})
+				return
+			}
+			c.Next()
+			return
+		}
+		if isUnixConn(localAddr(c)) {
+			c.Next()
+			return
+		}
+		if addr, err := netip.ParseAddr(c.ClientIP()); err == nil && addr.IsLoopback() {
+			c.Next()
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin routes are only served to local clients without API keys"})
+	}
+}
+
+func (s *Service) ReloadHandler(c *gin.Context) {
+	var req ReloadRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.model.mu.RLock()
+	reloader := s.model.reloader
+	s.model.mu.RUnlock()
+	if reloader == nil {
+		c.AbortWithStatusJSON(http.StatusNotImplemented, gin.H{"error": "reload is not supported"})
+		return
+	}
+
+	// the model is a section of the config file or a model path
+	cfg, err := s.ModelConfig().Reread(req.Model)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// a path loads any file of the host, without API keys every local client
+	// is an admin so only the sections of the config file are allowed
+	if len(req.Model) > 0 && len(cfg.Section()) <= 0 && !s.auth.Enabled() && !s.cfg.AdminModelPaths {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("model '%s' is not a section of the config file, set --admin-model-paths to load model paths without API keys", req.Model)})
+		return
+	}
+	if req.CtxSize != nil {
+		cfg.CtxSize = *req.CtxSize
+	}
+	if req.NGpuLayers != nil {
+		cfg.NGpuLayers = *req.NGpuLayers
+	}
+	if req.NPredict != nil {
+		cfg.NPredict = *req.NPredict
+	}
+	if req.Seed != nil {
+		cfg.Seed = *req.Seed
+	}
+
+	log.Info("Reload requested", "model", cfg.Model, "ctx-size", cfg.CtxSize)
+	start := time.Now()
+	if err := reloader(cfg); err != nil {
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, ReloadResponse{Model: cfg.Model, CtxSize: cfg.CtxSize, LoadDuration: time.Since(start)})
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiKeyContextKey is the gin context key of the authenticated API key
+const apiKeyContextKey = "llamago.api_key"
+
+// adminRoute prefixes the admin routes, only keys listing it in their routes
+// may use them, a key without routes is not an admin key
+const adminRoute = "/api/admin"
+
+// authReloadInterval is how often the keys file is checked for changes
+const authReloadInterval = time.Second
+
+// APIKey is a bearer token allowed to use the service. Empty Routes or Models
+// mean no restriction, a route ending with "*" matches every route with that prefix.
+// RPM and TPM override the default rate limits of the key, 0 keeps the default.
+type APIKey struct {
+	ID     string   `json:"id"`
+	Key    string   `json:"key"`
+	Routes []string `json:"routes,omitempty"`
+	Models []string `json:"models,omitempty"`
+	RPM    int      `json:"rpm,omitempty"`
+	TPM    int      `json:"tpm,omitempty"`
+}
+
+type apiKeysFile struct {
+	Keys []APIKey `json:"keys"`
+}
+
+// authExempt are the routes served without a key
+var authExempt = []string{"/", "/api/version", "/healthz", "/readyz"}
+
+// Auth authenticates requests against the configured API keys. The keys file
+// is reloaded when its modification time changes so keys rotate without restart.
+type Auth struct {
+	static []APIKey
+	file   string
+
+	mu        sync.RWMutex
+	fileKeys  []APIKey
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newAuth(keys string, file string) (*Auth, error) {
+	a := &Auth{file: file}
+	for _, kv := range strings.Split(keys, ",") {
+		kv = strings.TrimSpace(kv)
+		if len(kv) <= 0 {
+			continue
+		}
+		id, secret, ok := strings.Cut(kv, ":")
+		if !ok || len(id) <= 0 || len(secret) <= 0 {
+			return nil, fmt.Errorf("invalid API key entry, expected id:secret")
+		}
+		a.static = append(a.static, APIKey{ID: id, Key: secret})
+	}
+	if len(file) > 0 {
+		if err := a.reload(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Enabled reports whether any key source is configured
+func (a *Auth) Enabled() bool {
+	return len(a.static) > 0 || len(a.file) > 0
+}
+
+func (a *Auth) reload() error {
+	fi, err := os.Stat(a.file)
+	if err != nil {
+		return err
+	}
+	a.mu.RLock()
+	unchanged := fi.ModTime().Equal(a.modTime)
+	a.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(a.file)
+	if err != nil {
+		return err
+	}
+	var kf apiKeysFile
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return fmt.Errorf("parse API keys file %s: %w", a.file, err)
+	}
+	ids := map[string]bool{}
+	for _, k := range kf.Keys {
+		if len(k.ID) <= 0 || len(k.Key) <= 0 {
+			return fmt.Errorf("API keys file %s: every key needs an id and a key", a.file)
+		}
+		if ids[k.ID] {
+			return fmt.Errorf("API keys file %s: duplicate key id %s", a.file, k.ID)
+		}
+		ids[k.ID] = true
+	}
+
+	a.mu.Lock()
+	a.fileKeys = kf.Keys
+	a.modTime = fi.ModTime()
+	a.mu.Unlock()
+	log.Info("Load API keys", "file", a.file, "keys", len(kf.Keys))
+	return nil
+}
+
+// maybeReload checks the keys file at most once per authReloadInterval, a
+// broken file keeps the previous keys
+func (a *Auth) maybeReload() {
+	if len(a.file) <= 0 {
+		return
+	}
+	a.mu.Lock()
+	if time.Since(a.lastCheck) < authReloadInterval {
+		a.mu.Unlock()
+		return
+	}
+	a.lastCheck = time.Now()
+	a.mu.Unlock()
+
+	if err := a.reload(); err != nil {
+		log.Error("Reload API keys failed, keeping the previous keys", "error", err)
+	}
+}
+
+// lookup returns the key matching the secret
+func (a *Auth) lookup(secret string) *APIKey {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var found *APIKey
+	for _, keys := range [][]APIKey{a.static, a.fileKeys} {
+		for i := range keys {
+			// compare every key so the timing does not depend on which one matches
+			if subtle.ConstantTimeCompare([]byte(keys[i].Key), []byte(secret)) == 1 && found == nil {
+				k := keys[i]
+				found = &k
+			}
+		}
+	}
+	return found
+}
+
+// byID returns the current key with the id, nil once it was removed
+func (a *Auth) byID(id string) *APIKey {
+	a.maybeReload()
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, keys := range [][]APIKey{a.static, a.fileKeys} {
+		for i := range keys {
+			if keys[i].ID == id {
+				k := keys[i]
+				return &k
+			}
+		}
+	}
+	return nil
+}
+
+func (k *APIKey) allowRoute(route string) bool {
+	if len(k.Routes) <= 0 {
+		return true
+	}
+	for _, r := range k.Routes {
+		if prefix, ok := strings.CutSuffix(r, "*"); ok {
+			if strings.HasPrefix(route, prefix) {
+				return true
+			}
+		} else if r == route {
+			return true
+		}
+	}
+	return false
+}
+
+// isAdmin reports whether the routes of the key explicitly include the admin routes
+func (k *APIKey) isAdmin() bool {
+	for _, r := range k.Routes {
+		if strings.HasPrefix(r, adminRoute) {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *APIKey) allowModel(model string, defaultModel string) bool {
+	if len(k.Models) <= 0 {
+		return true
+	}
+	if len(model) <= 0 {
+		model = defaultModel
+	}
+	return slices.Contains(k.Models, model) || slices.Contains(k.Models, filepath.Base(model))
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// requestModel peeks the model of a JSON request body and restores the body for the handler
+func requestModel(c *gin.Context) string {
+	if c.Request.Body == nil || c.Request.Method == http.MethodGet {
+		return c.Param("model")
+	}
+	data, err := peekBody(c)
+	if err != nil || len(data) == 0 {
+		return ""
+	}
+	var body struct {
+		Model string `json:"model"`
+	}
+	_ = json.Unmarshal(data, &body)
+	return body.Model
+}
+
+// requestKey returns the API key of the request, nil without authentication
+func requestKey(c *gin.Context) *APIKey {
+	if v, ok := c.Get(apiKeyContextKey); ok {
+		return v.(*APIKey)
+	}
+	return nil
+}
+
+func (s *Service) authMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.auth.Enabled() || c.Request.Method == http.MethodOptions || slices.Contains(authExempt, s.route(c)) {
+			c.Next()
+			return
+		}
+		s.auth.maybeReload()
+
+		token := bearerToken(c.Request)
+		if len(token) <= 0 {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing API key"})
+			return
+		}
+		key := s.auth.lookup(token)
+		if key == nil {
+			log.Warn("Reject request with unknown API key", "path", c.Request.URL.Path, "client", c.ClientIP())
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid API key"})
+			return
+		}
+		c.Set(apiKeyContextKey, key)
+		if !s.allowScope(c, key) {
+			return
+		}
+		log.Debug("Authenticated request", "key", key.ID, "route", s.route(c))
+		c.Next()
+	}
+}
+
+// allowScope checks the route and the model of the request against the
+// scopes of the key, it ends the request when they do not allow it
+func (s *Service) allowScope(c *gin.Context, key *APIKey) bool {
+	route := s.route(c)
+	if !key.allowRoute(route) {
+		log.Warn("Reject request out of key scope", "key", key.ID, "route", route)
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("API key '%s' is not allowed to use %s", key.ID, route)})
+		return false
+	}
+	if len(key.Models) > 0 {
+		// the model of a body too large to be read can not be checked
+		if _, err := peekBody(c); err != nil {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return false
+		}
+		model := requestModel(c)
+		if !key.allowModel(model, s.ModelConfig().Model) {
+			log.Warn("Reject request out of key scope", "key", key.ID, "model", model)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("API key '%s' is not allowed to use model '%s'", key.ID, model)})
+			return false
+		}
+	}
+	return true
+}
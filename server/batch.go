@@ -0,0 +1,557 @@
+package server
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/gin-gonic/gin"
+	"github.com/ollama/ollama/openai"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBatchFileSize bounds the uploaded files, like the OpenAI API
+const maxBatchFileSize = 200 << 20
+
+// batchWindow is the only completion window accepted
+const batchWindow = "24h"
+
+// Statuses of a batch
+const (
+	batchValidating = "validating"
+	batchFailed     = "failed"
+	batchInProgress = "in_progress"
+	batchFinalizing = "finalizing"
+	batchCompleted  = "completed"
+	batchExpired    = "expired"
+	batchCancelling = "cancelling"
+	batchCancelled  = "cancelled"
+)
+
+// batchEndpoints are the routes the requests of a batch can be sent to
+var batchEndpoints = []string{"/v1/chat/completions", "/v1/completions", "/v1/embeddings"}
+
+// batchFile is an uploaded file, or an output or error file of a batch
+type batchFile struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int64  `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+	// Owner is the id of the API key that uploaded the file or created its
+	// batch, it is only kept on disk
+	Owner string `json:"owner,omitempty"`
+}
+
+// public returns the file as shown to its owner
+func (f batchFile) public() batchFile {
+	f.Owner = ""
+	return f
+}
+
+// Batch is a job running the requests of an input file, as returned by the API
+type Batch struct {
+	ID               string            `json:"id"`
+	Object           string            `json:"object"`
+	Endpoint         string            `json:"endpoint"`
+	Errors           *batchErrors      `json:"errors"`
+	InputFileID      string            `json:"input_file_id"`
+	CompletionWindow string            `json:"completion_window"`
+	Status           string            `json:"status"`
+	OutputFileID     *string           `json:"output_file_id"`
+	ErrorFileID      *string           `json:"error_file_id"`
+	CreatedAt        int64             `json:"created_at"`
+	InProgressAt     *int64            `json:"in_progress_at"`
+	ExpiresAt        *int64            `json:"expires_at"`
+	FinalizingAt     *int64            `json:"finalizing_at"`
+	CompletedAt      *int64            `json:"completed_at"`
+	FailedAt         *int64            `json:"failed_at"`
+	ExpiredAt        *int64            `json:"expired_at"`
+	CancellingAt     *int64            `json:"cancelling_at"`
+	CancelledAt      *int64            `json:"cancelled_at"`
+	RequestCounts    batchCounts       `json:"request_counts"`
+	Metadata         map[string]string `json:"metadata"`
+}
+
+type batchErrors struct {
+	Object string            `json:"object"`
+	Data   []batchInputError `json:"data"`
+}
+
+// batchInputError is an invalid line of the input file
+type batchInputError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Param   any    `json:"param"`
+	Line    int    `json:"line"`
+}
+
+type batchCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// batchJob is a batch with its progress, saved to disk after every request
+// so that it resumes where it stopped after a restart
+type batchJob struct {
+	Batch
+	// NextLine is the index of the next line of the input to run
+	NextLine int `json:"next_line"`
+	// OutputSize and ErrorSize are the sizes of the output and error files
+	// with the results of the lines before NextLine
+	OutputSize int64 `json:"output_size"`
+	ErrorSize  int64 `json:"error_size"`
+	// Owner is the id of the API key that created the batch, its requests
+	// run with the scopes and the limits of the key, or of Client, the IP
+	// address of the creator, without authentication
+	Owner  string `json:"owner,omitempty"`
+	Client string `json:"client,omitempty"`
+}
+
+func (j *batchJob) terminal() bool {
+	switch j.Status {
+	case batchFailed, batchCompleted, batchExpired, batchCancelled:
+		return true
+	}
+	return false
+}
+
+// batchStore keeps the files and the jobs of the batch API in a directory,
+// files/<id> and files/<id>.json for the files, batches/<id>.json for the jobs
+type batchStore struct {
+	dir string
+
+	mu    sync.Mutex
+	files map[string]*batchFile
+	jobs  map[string]*batchJob
+	// active is the job being run
+	active string
+
+	// wake signals the runner that a job was created
+	wake chan struct{}
+}
+
+func newBatchStore(dir string) (*batchStore, error) {
+	st := &batchStore{
+		dir:   dir,
+		files: map[string]*batchFile{},
+		jobs:  map[string]*batchJob{},
+		wake:  make(chan struct{}, 1),
+	}
+	for _, sub := range []string{"files", "batches"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, fmt.Errorf("batch-dir: %w", err)
+		}
+	}
+	metas, err := filepath.Glob(filepath.Join(dir, "files", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range metas {
+		f := &batchFile{}
+		if err := readJSONFile(path, f); err != nil {
+			return nil, fmt.Errorf("batch-dir: %w", err)
+		}
+		st.files[f.ID] = f
+	}
+	jobs, err := filepath.Glob(filepath.Join(dir, "batches", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range jobs {
+		j := &batchJob{}
+		if err := readJSONFile(path, j); err != nil {
+			return nil, fmt.Errorf("batch-dir: %w", err)
+		}
+		st.jobs[j.ID] = j
+	}
+	return st, nil
+}
+
+func (st *batchStore) filePath(id string) string {
+	return filepath.Join(st.dir, "files", id)
+}
+
+// saveFile writes the metadata of the file, st.mu is held
+func (st *batchStore) saveFile(f *batchFile) error {
+	return writeJSONFile(st.filePath(f.ID)+".json", f)
+}
+
+// saveJob writes the job, st.mu is held
+func (st *batchStore) saveJob(j *batchJob) error {
+	return writeJSONFile(filepath.Join(st.dir, "batches", j.ID+".json"), j)
+}
+
+// next returns the oldest job that is not finished and makes it the active one
+func (st *batchStore) next() *batchJob {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var next *batchJob
+	for _, j := range st.jobs {
+		if j.terminal() {
+			continue
+		}
+		if next == nil || j.CreatedAt < next.CreatedAt || (j.CreatedAt == next.CreatedAt && j.ID < next.ID) {
+			next = j
+		}
+	}
+	if next != nil {
+		st.active = next.ID
+	}
+	return next
+}
+
+// update changes the job with fn and saves it
+func (st *batchStore) update(j *batchJob, fn func(j *batchJob)) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	fn(j)
+	return st.saveJob(j)
+}
+
+func (st *batchStore) status(j *batchJob) string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return j.Status
+}
+
+func newBatchID(prefix string) string {
+	var b [12]byte
+	_, _ = rand.Read(b[:])
+	return prefix + hex.EncodeToString(b[:])
+}
+
+func unixNow() *int64 {
+	now := time.Now().Unix()
+	return &now
+}
+
+func readJSONFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// writeJSONFile replaces the file at once, it is complete or not changed
+func writeJSONFile(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// requestOwner returns the id of the API key of the request, the files and
+// batches of a key are only visible to it. It is empty without authentication.
+func requestOwner(c *gin.Context) string {
+	if key := requestKey(c); key != nil {
+		return key.ID
+	}
+	return ""
+}
+
+func batchError(c *gin.Context, code int, format string, args ...any) {
+	c.AbortWithStatusJSON(code, openai.NewError(code, fmt.Sprintf(format, args...)))
+}
+
+// UploadFileHandler stores a JSONL file of requests for a batch
+func (s *Service) UploadFileHandler(c *gin.Context) {
+	if purpose := c.PostForm("purpose"); purpose != "batch" {
+		batchError(c, http.StatusBadRequest, "purpose must be batch, not '%s'", purpose)
+		return
+	}
+	header, err := c.FormFile("file")
+	if err != nil {
+		batchError(c, http.StatusBadRequest, "missing file: %s", err)
+		return
+	}
+	if header.Size > maxBatchFileSize {
+		batchError(c, http.StatusBadRequest, "file of %d bytes exceeds %d bytes", header.Size, maxBatchFileSize)
+		return
+	}
+	src, err := header.Open()
+	if err != nil {
+		batchError(c, http.StatusBadRequest, "%s", err)
+		return
+	}
+	defer src.Close()
+
+	f := &batchFile{
+		ID:        newBatchID("file-"),
+		Object:    "file",
+		CreatedAt: time.Now().Unix(),
+		Filename:  filepath.Base(header.Filename),
+		Purpose:   "batch",
+		Owner:     requestOwner(c),
+	}
+	dst, err := os.OpenFile(s.batches.filePath(f.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		batchError(c, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	f.Bytes, err = io.Copy(dst, io.LimitReader(src, maxBatchFileSize))
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(s.batches.filePath(f.ID))
+		batchError(c, http.StatusInternalServerError, "%s", err)
+		return
+	}
+
+	st := s.batches
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err := st.saveFile(f); err != nil {
+		os.Remove(st.filePath(f.ID))
+		batchError(c, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	st.files[f.ID] = f
+	log.Info("Uploaded batch file", "id", f.ID, "filename", f.Filename, "bytes", f.Bytes, "owner", f.Owner)
+	c.JSON(http.StatusOK, f.public())
+}
+
+// ListFilesHandler lists the files, the newest first
+func (s *Service) ListFilesHandler(c *gin.Context) {
+	st := s.batches
+	owner := requestOwner(c)
+	st.mu.Lock()
+	files := make([]batchFile, 0, len(st.files))
+	for _, f := range st.files {
+		if purpose := c.Query("purpose"); f.Owner == owner && (len(purpose) == 0 || f.Purpose == purpose) {
+			files = append(files, f.public())
+		}
+	}
+	st.mu.Unlock()
+	slices.SortFunc(files, func(a, b batchFile) int {
+		return cmp.Or(cmp.Compare(b.CreatedAt, a.CreatedAt), strings.Compare(b.ID, a.ID))
+	})
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": files})
+}
+
+// fileOf returns the file of the :file_id parameter if the key of the
+// request owns it, or ends the request
+func (s *Service) fileOf(c *gin.Context) (batchFile, bool) {
+	st := s.batches
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	f, ok := st.files[c.Param("file_id")]
+	if !ok || f.Owner != requestOwner(c) {
+		batchError(c, http.StatusNotFound, "file '%s' not found", c.Param("file_id"))
+		return batchFile{}, false
+	}
+	return *f, true
+}
+
+func (s *Service) GetFileHandler(c *gin.Context) {
+	if f, ok := s.fileOf(c); ok {
+		c.JSON(http.StatusOK, f.public())
+	}
+}
+
+// FileContentHandler returns the content of a file, the output and error
+// files of a running batch grow as its requests finish
+func (s *Service) FileContentHandler(c *gin.Context) {
+	f, ok := s.fileOf(c)
+	if !ok {
+		return
+	}
+	c.Header("Content-Type", "application/jsonl")
+	c.File(s.batches.filePath(f.ID))
+}
+
+// DeleteFileHandler deletes a file that no unfinished batch uses
+func (s *Service) DeleteFileHandler(c *gin.Context) {
+	st := s.batches
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	id := c.Param("file_id")
+	if f, ok := st.files[id]; !ok || f.Owner != requestOwner(c) {
+		batchError(c, http.StatusNotFound, "file '%s' not found", id)
+		return
+	}
+	for _, j := range st.jobs {
+		used := j.InputFileID == id || (j.OutputFileID != nil && *j.OutputFileID == id) ||
+			(j.ErrorFileID != nil && *j.ErrorFileID == id)
+		if used && !j.terminal() {
+			batchError(c, http.StatusBadRequest, "file '%s' is used by batch %s which is %s", id, j.ID, j.Status)
+			return
+		}
+	}
+	if err := os.Remove(st.filePath(id) + ".json"); err != nil {
+		batchError(c, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	os.Remove(st.filePath(id))
+	delete(st.files, id)
+	c.JSON(http.StatusOK, gin.H{"id": id, "object": "file", "deleted": true})
+}
+
+type createBatchRequest struct {
+	InputFileID      string            `json:"input_file_id"`
+	Endpoint         string            `json:"endpoint"`
+	CompletionWindow string            `json:"completion_window"`
+	Metadata         map[string]string `json:"metadata"`
+}
+
+// CreateBatchHandler creates a job running the requests of an uploaded file,
+// it is validated and run after the jobs created before it
+func (s *Service) CreateBatchHandler(c *gin.Context) {
+	var req createBatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		batchError(c, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if !slices.Contains(batchEndpoints, req.Endpoint) {
+		batchError(c, http.StatusBadRequest, "endpoint must be one of %s", strings.Join(batchEndpoints, ", "))
+		return
+	}
+	if req.CompletionWindow != batchWindow {
+		batchError(c, http.StatusBadRequest, "completion_window must be %s", batchWindow)
+		return
+	}
+	// the requests run with the scopes of the key
+	if key := requestKey(c); key != nil && !key.allowRoute(req.Endpoint) {
+		batchError(c, http.StatusForbidden, "API key '%s' is not allowed to use %s", key.ID, req.Endpoint)
+		return
+	}
+
+	st := s.batches
+	owner := requestOwner(c)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if f, ok := st.files[req.InputFileID]; !ok || f.Purpose != "batch" || f.Owner != owner {
+		batchError(c, http.StatusBadRequest, "input file '%s' not found", req.InputFileID)
+		return
+	}
+	now := time.Now()
+	expires := now.Add(24 * time.Hour).Unix()
+	j := &batchJob{Batch: Batch{
+		ID:               newBatchID("batch_"),
+		Object:           "batch",
+		Endpoint:         req.Endpoint,
+		InputFileID:      req.InputFileID,
+		CompletionWindow: req.CompletionWindow,
+		Status:           batchValidating,
+		CreatedAt:        now.Unix(),
+		ExpiresAt:        &expires,
+		Metadata:         req.Metadata,
+	}, Owner: owner, Client: c.ClientIP()}
+	if err := st.saveJob(j); err != nil {
+		batchError(c, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	st.jobs[j.ID] = j
+	select {
+	case st.wake <- struct{}{}:
+	default:
+	}
+	log.Info("Created batch", "id", j.ID, "input_file_id", j.InputFileID, "endpoint", j.Endpoint, "owner", j.Owner)
+	c.JSON(http.StatusOK, j.Batch)
+}
+
+// ListBatchesHandler lists the batches, the newest first, limit and after
+// page through them
+func (s *Service) ListBatchesHandler(c *gin.Context) {
+	limit := 20
+	if v := c.Query("limit"); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			batchError(c, http.StatusBadRequest, "limit must be between 1 and 100")
+			return
+		}
+		limit = n
+	}
+	st := s.batches
+	owner := requestOwner(c)
+	st.mu.Lock()
+	batches := make([]Batch, 0, len(st.jobs))
+	for _, j := range st.jobs {
+		if j.Owner == owner {
+			batches = append(batches, j.Batch)
+		}
+	}
+	st.mu.Unlock()
+	slices.SortFunc(batches, func(a, b Batch) int {
+		return cmp.Or(cmp.Compare(b.CreatedAt, a.CreatedAt), strings.Compare(b.ID, a.ID))
+	})
+	if after := c.Query("after"); len(after) > 0 {
+		i := slices.IndexFunc(batches, func(b Batch) bool { return b.ID == after })
+		batches = batches[i+1:]
+	}
+	hasMore := len(batches) > limit
+	batches = batches[:min(limit, len(batches))]
+	res := gin.H{"object": "list", "data": batches, "has_more": hasMore}
+	if len(batches) > 0 {
+		res["first_id"] = batches[0].ID
+		res["last_id"] = batches[len(batches)-1].ID
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+func (s *Service) GetBatchHandler(c *gin.Context) {
+	st := s.batches
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	j, ok := st.jobs[c.Param("batch_id")]
+	if !ok || j.Owner != requestOwner(c) {
+		batchError(c, http.StatusNotFound, "batch '%s' not found", c.Param("batch_id"))
+		return
+	}
+	c.JSON(http.StatusOK, j.Batch)
+}
+
+// CancelBatchHandler cancels a batch, a running one stops after its current
+// request and keeps the results so far
+func (s *Service) CancelBatchHandler(c *gin.Context) {
+	st := s.batches
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	j, ok := st.jobs[c.Param("batch_id")]
+	if !ok || j.Owner != requestOwner(c) {
+		batchError(c, http.StatusNotFound, "batch '%s' not found", c.Param("batch_id"))
+		return
+	}
+	switch {
+	case j.Status == batchCancelling || j.Status == batchCancelled:
+	case j.terminal():
+		batchError(c, http.StatusBadRequest, "batch %s is %s", j.ID, j.Status)
+		return
+	case j.Status == batchValidating && st.active != j.ID:
+		// not started yet
+		j.Status = batchCancelled
+		j.CancellingAt = unixNow()
+		j.CancelledAt = j.CancellingAt
+	default:
+		j.Status = batchCancelling
+		j.CancellingAt = unixNow()
+	}
+	if err := st.saveJob(j); err != nil {
+		batchError(c, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	log.Info("Cancel batch", "id", j.ID, "status", j.Status)
+	c.JSON(http.StatusOK, j.Batch)
+}
@@ -0,0 +1,454 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Qitmeer/llama.go/wrapper"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/gin-gonic/gin"
+	"github.com/ollama/ollama/openai"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// batchPollInterval is how often a batch checks whether the model is idle
+const batchPollInterval = 100 * time.Millisecond
+
+// maxBatchRequests bounds the requests of a batch, like the OpenAI API
+const maxBatchRequests = 50000
+
+// maxBatchErrors is the number of invalid lines reported for a batch
+const maxBatchErrors = 100
+
+// batchInput is a line of the input file of a batch
+type batchInput struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// batchOutput is a line of the output or error file of a batch
+type batchOutput struct {
+	ID       string         `json:"id"`
+	CustomID string         `json:"custom_id"`
+	Response *batchResponse `json:"response"`
+	Error    any            `json:"error"`
+}
+
+type batchResponse struct {
+	StatusCode int             `json:"status_code"`
+	RequestID  string          `json:"request_id"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// batchResponseWriter keeps the response of a request of a batch
+type batchResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *batchResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *batchResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *batchResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+// batchOwnerContextKey is the request context key of the owner of the batch
+type batchOwnerContextKey struct{}
+
+// batchRoutes serves the requests of the batches with the handlers of the
+// API, with the scopes and the rate limits of the key that created the batch
+func (s *Service) batchRoutes() *gin.Engine {
+	e := gin.New()
+	e.Use(gin.Recovery(), func(c *gin.Context) {
+		c.Set(requestIDContextKey, c.GetHeader(requestIDHeader))
+		if owner, _ := c.Request.Context().Value(batchOwnerContextKey{}).(string); len(owner) > 0 {
+			key := s.auth.byID(owner)
+			if key == nil {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("API key '%s' was removed", owner)})
+				return
+			}
+			c.Set(apiKeyContextKey, key)
+			if !s.allowScope(c, key) {
+				return
+			}
+		}
+		c.Next()
+	}, s.rateLimitMiddleware())
+	e.POST("/v1/chat/completions", openai.ChatMiddleware(), s.ChatHandler)
+	e.POST("/v1/completions", openai.CompletionsMiddleware(), s.GenerateHandler)
+	e.POST("/v1/embeddings", openai.EmbeddingsMiddleware(), s.EmbedHandler)
+	return e
+}
+
+// runBatches runs the jobs one after the other in the order they were
+// created until quit is closed, an interrupted job resumes on the next start
+func (s *Service) runBatches(quit <-chan struct{}) {
+	st := s.batches
+	routes := s.batchRoutes()
+	for {
+		j := st.next()
+		if j == nil {
+			select {
+			case <-st.wake:
+				continue
+			case <-quit:
+				return
+			}
+		}
+		if err := s.runBatch(j, routes, quit); err != nil {
+			log.Error("Batch failed", "id", j.ID, "err", err)
+			st.update(j, func(j *batchJob) {
+				j.Status = batchFailed
+				j.FailedAt = unixNow()
+				j.Errors = &batchErrors{Object: "list", Data: []batchInputError{{Code: "internal_error", Message: err.Error()}}}
+			})
+		}
+		select {
+		case <-quit:
+			return
+		default:
+		}
+	}
+}
+
+// runBatch validates the job if needed and runs its requests, it returns
+// without error when quit is closed
+func (s *Service) runBatch(j *batchJob, routes *gin.Engine, quit <-chan struct{}) error {
+	st := s.batches
+	if st.status(j) == batchCancelling && j.OutputFileID == nil {
+		// cancelled while it was validated
+		return st.update(j, func(j *batchJob) {
+			j.Status = batchCancelled
+			j.CancelledAt = unixNow()
+		})
+	}
+	data, err := os.ReadFile(st.filePath(j.InputFileID))
+	if err != nil {
+		return err
+	}
+	reqs, errs := parseBatchInput(data, j.Endpoint)
+
+	if st.status(j) == batchValidating {
+		if len(errs) > 0 {
+			log.Warn("Batch input is invalid", "id", j.ID, "errors", len(errs))
+			return st.update(j, func(j *batchJob) {
+				j.Status = batchFailed
+				j.FailedAt = unixNow()
+				j.Errors = &batchErrors{Object: "list", Data: errs}
+			})
+		}
+		if err := s.startBatch(j, len(reqs)); err != nil {
+			return err
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("input file %s changed", j.InputFileID)
+	}
+
+	out, err := openBatchOutput(st.filePath(*j.OutputFileID), j.OutputSize)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	errf, err := openBatchOutput(st.filePath(*j.ErrorFileID), j.ErrorSize)
+	if err != nil {
+		return err
+	}
+	defer errf.Close()
+
+	for j.NextLine < len(reqs) {
+		if st.status(j) == batchCancelling {
+			return s.finishBatch(j, batchCancelled)
+		}
+		if time.Now().Unix() > *j.ExpiresAt {
+			return s.finishBatch(j, batchExpired)
+		}
+		if !s.waitIdle(j, quit) {
+			select {
+			case <-quit:
+				return nil
+			default:
+				continue
+			}
+		}
+
+		// Stop fails the request in progress, see Service.Stop
+		s.batchBusy.Store(true)
+		select {
+		case <-quit:
+			s.batchBusy.Store(false)
+			return nil
+		default:
+		}
+		res, retry := runBatchRequest(routes, j, reqs[j.NextLine])
+		s.batchBusy.Store(false)
+		select {
+		case <-quit:
+			if res.Response.StatusCode >= http.StatusInternalServerError {
+				// stopped by the shutdown, it runs again on resume
+				return nil
+			}
+		default:
+		}
+		if res.Response.StatusCode == http.StatusTooManyRequests {
+			// over the limits of the owner, the request runs again later
+			log.Debug("Batch request rate limited", "id", j.ID, "retry", retry)
+			s.batchSleep(j, quit, retry)
+			continue
+		}
+		line, err := json.Marshal(res)
+		if err != nil {
+			return err
+		}
+		line = append(line, '\n')
+		ok := res.Response.StatusCode < http.StatusMultipleChoices
+		file := out
+		if !ok {
+			file = errf
+		}
+		if _, err := file.Write(line); err != nil {
+			return err
+		}
+		err = st.update(j, func(j *batchJob) {
+			if ok {
+				j.OutputSize += int64(len(line))
+				j.RequestCounts.Completed++
+				st.files[*j.OutputFileID].Bytes = j.OutputSize
+			} else {
+				j.ErrorSize += int64(len(line))
+				j.RequestCounts.Failed++
+				st.files[*j.ErrorFileID].Bytes = j.ErrorSize
+			}
+			j.NextLine++
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return s.finishBatch(j, batchCompleted)
+}
+
+// parseBatchInput returns the requests of the input file, or why its lines
+// are invalid
+func parseBatchInput(data []byte, endpoint string) ([]batchInput, []batchInputError) {
+	var reqs []batchInput
+	var errs []batchInputError
+	ids := map[string]bool{}
+	invalid := func(line int, format string, args ...any) {
+		if len(errs) < maxBatchErrors {
+			errs = append(errs, batchInputError{Code: "invalid_request", Message: fmt.Sprintf(format, args...), Line: line})
+		}
+	}
+	for i, raw := range bytes.Split(data, []byte("\n")) {
+		line := i + 1
+		if len(bytes.TrimSpace(raw)) == 0 {
+			continue
+		}
+		var in batchInput
+		if err := json.Unmarshal(raw, &in); err != nil {
+			invalid(line, "invalid JSON: %s", err)
+			continue
+		}
+		var body map[string]any
+		switch {
+		case len(in.CustomID) == 0:
+			invalid(line, "custom_id is missing")
+		case ids[in.CustomID]:
+			invalid(line, "custom_id %s is not unique", in.CustomID)
+		case in.Method != http.MethodPost:
+			invalid(line, "method must be POST")
+		case in.URL != endpoint:
+			invalid(line, "url %s is not the endpoint %s of the batch", in.URL, endpoint)
+		case json.Unmarshal(in.Body, &body) != nil || body == nil:
+			invalid(line, "body must be a JSON object")
+		case body["stream"] == true:
+			invalid(line, "stream is not supported in a batch")
+		}
+		ids[in.CustomID] = true
+		reqs = append(reqs, in)
+	}
+	if len(reqs) == 0 && len(errs) == 0 {
+		invalid(0, "the input file has no requests")
+	}
+	if len(reqs) > maxBatchRequests {
+		invalid(0, "the input file has %d requests, more than %d", len(reqs), maxBatchRequests)
+	}
+	return reqs, errs
+}
+
+// startBatch creates the output and error files of a validated job
+func (s *Service) startBatch(j *batchJob, total int) error {
+	st := s.batches
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now().Unix()
+	var ids [2]string
+	for i, suffix := range []string{"output", "error"} {
+		f := &batchFile{
+			ID:        newBatchID("file-"),
+			Object:    "file",
+			CreatedAt: now,
+			Filename:  fmt.Sprintf("%s_%s.jsonl", j.ID, suffix),
+			Purpose:   "batch_output",
+			Owner:     j.Owner,
+		}
+		if err := os.WriteFile(st.filePath(f.ID), nil, 0600); err != nil {
+			return err
+		}
+		if err := st.saveFile(f); err != nil {
+			return err
+		}
+		st.files[f.ID] = f
+		ids[i] = f.ID
+	}
+	j.OutputFileID, j.ErrorFileID = &ids[0], &ids[1]
+	if j.Status == batchValidating {
+		j.Status = batchInProgress
+	}
+	j.InProgressAt = &now
+	j.RequestCounts.Total = total
+	log.Info("Start batch", "id", j.ID, "requests", total)
+	return st.saveJob(j)
+}
+
+// finishBatch ends the job with the status, the error file is removed when
+// no request failed
+func (s *Service) finishBatch(j *batchJob, status string) error {
+	st := s.batches
+	if status == batchCompleted {
+		if err := st.update(j, func(j *batchJob) {
+			j.Status = batchFinalizing
+			j.FinalizingAt = unixNow()
+		}); err != nil {
+			return err
+		}
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, id := range []*string{j.OutputFileID, j.ErrorFileID} {
+		if f, ok := st.files[*id]; ok {
+			if err := st.saveFile(f); err != nil {
+				return err
+			}
+		}
+	}
+	if j.ErrorSize == 0 {
+		os.Remove(st.filePath(*j.ErrorFileID) + ".json")
+		os.Remove(st.filePath(*j.ErrorFileID))
+		delete(st.files, *j.ErrorFileID)
+		j.ErrorFileID = nil
+	}
+	j.Status = status
+	switch status {
+	case batchCompleted:
+		j.CompletedAt = unixNow()
+	case batchCancelled:
+		j.CancelledAt = unixNow()
+	case batchExpired:
+		j.ExpiredAt = unixNow()
+	}
+	log.Info("Batch finished", "id", j.ID, "status", status,
+		"completed", j.RequestCounts.Completed, "failed", j.RequestCounts.Failed, "total", j.RequestCounts.Total)
+	return st.saveJob(j)
+}
+
+// openBatchOutput opens the file for appending after the first size bytes,
+// the results written after them were not recorded in the job
+func openBatchOutput(path string, size int64) (*os.File, error) {
+	if err := os.Truncate(path, size); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+}
+
+// waitIdle waits until the model is ready and no other request is running or
+// queued, so that the batches run at a lower priority than the requests of
+// the clients. It returns false when quit is closed or the job is cancelled.
+func (s *Service) waitIdle(j *batchJob, quit <-chan struct{}) bool {
+	ticker := time.NewTicker(batchPollInterval)
+	defer ticker.Stop()
+	for {
+		if state, _ := s.state(); state == stateReady {
+			if st := wrapper.LlamaStatus(); !st.Busy && st.QueueDepth == 0 {
+				return true
+			}
+		}
+		select {
+		case <-quit:
+			return false
+		case <-ticker.C:
+		}
+		if s.batches.status(j) == batchCancelling {
+			return false
+		}
+	}
+}
+
+// batchSleep waits for d, it returns early when quit is closed or the job
+// is cancelled
+func (s *Service) batchSleep(j *batchJob, quit <-chan struct{}, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	ticker := time.NewTicker(batchPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-timer.C:
+			return
+		case <-ticker.C:
+			if s.batches.status(j) == batchCancelling {
+				return
+			}
+		}
+	}
+}
+
+// runBatchRequest sends the request to the handler of its endpoint as the
+// owner of the job, it also returns when to retry a rate limited request
+func runBatchRequest(routes *gin.Engine, j *batchJob, in batchInput) (*batchOutput, time.Duration) {
+	id := newBatchID("batch_req_")
+	res := &batchOutput{ID: id, CustomID: in.CustomID}
+	ctx := context.WithValue(context.Background(), batchOwnerContextKey{}, j.Owner)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, in.URL, bytes.NewReader(in.Body))
+	if err != nil {
+		res.Response = &batchResponse{StatusCode: http.StatusBadRequest, RequestID: id}
+		res.Error = openai.NewError(http.StatusBadRequest, err.Error()).Error
+		return res, 0
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(requestIDHeader, id)
+	// the limits of a client without key apply to its IP address
+	req.RemoteAddr = net.JoinHostPort(j.Client, "0")
+
+	w := &batchResponseWriter{header: http.Header{}}
+	routes.ServeHTTP(w, req)
+	body := w.body.Bytes()
+	if !json.Valid(body) {
+		body, _ = json.Marshal(string(body))
+	}
+	res.Response = &batchResponse{StatusCode: w.status, RequestID: id, Body: body}
+	retry := rateLimitWindow
+	if secs, err := strconv.Atoi(w.header.Get("Retry-After")); err == nil {
+		retry = time.Duration(secs) * time.Second
+	}
+	return res, retry
+}
@@ -41,7 +41,7 @@ func (s *Service) GenerateHandler(c *gin.Context) {
 	}
 
 	if len(req.Model) > 0 {
-		if s.cfg.Model != req.Model {
+		if s.ModelConfig().Model != req.Model {
 			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
 			return
 		}
@@ -89,6 +89,52 @@ func (s *Service) GenerateHandler(c *gin.Context) {
 		return
 	}
 
+	prompt, err := s.generatePrompt(&req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	content, stats, err := wrapper.LlamaGenerate(prompt)
+	s.record(c, &Record{Kind: RecordGenerate, Prompt: prompt, Response: content}, &req, stats, err)
+	if err != nil {
+		abortModelError(c, err)
+		return
+	}
+	s.observeGeneration(c, stats)
+	res := api.GenerateResponse{
+		Model:     req.Model,
+		CreatedAt: time.Now().UTC(),
+		Response:  content,
+		Done:      true,
+		Metrics:   genMetrics(stats),
+	}
+	res.TotalDuration = time.Since(checkpointStart)
+	res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+	if req.Stream == nil || !*req.Stream {
+		c.JSON(http.StatusOK, res)
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Stream(func(w io.Writer) bool {
+		bts, err := json.Marshal(res)
+		if err != nil {
+			log.Info(fmt.Sprintf("streamResponse: json.Marshal failed with %s", err))
+			return false
+		}
+
+		// Delineate chunks with new-line delimiter
+		bts = append(bts, '\n')
+		if _, err := w.Write(bts); err != nil {
+			log.Info(fmt.Sprintf("streamResponse: w.Write failed with %s", err))
+			return false
+		}
+		return true
+	})
+}
+
+// generatePrompt applies the prompt template to a generate request unless it is raw
+func (s *Service) generatePrompt(req *api.GenerateRequest) (string, error) {
 	images := make([]ImageData, len(req.Images))
 	for i := range req.Images {
 		images[i] = ImageData{ID: i, Data: req.Images[i]}
@@ -100,8 +146,7 @@ func (s *Service) GenerateHandler(c *gin.Context) {
 		if req.Template != "" {
 			tm, err := template.Parse(req.Template)
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
+				return "", err
 			}
 			tmpl = tm
 		}
@@ -129,46 +174,12 @@ func (s *Service) GenerateHandler(c *gin.Context) {
 
 		var b bytes.Buffer
 		if err := tmpl.Execute(&b, values); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+			return "", err
 		}
 
 		prompt = b.String()
 	}
-	content, err := wrapper.LlamaGenerate(prompt)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-	res := api.GenerateResponse{
-		Model:     req.Model,
-		CreatedAt: time.Now().UTC(),
-		Response:  content,
-		Done:      true,
-	}
-	res.TotalDuration = time.Since(checkpointStart)
-	res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
-	if req.Stream == nil || !*req.Stream {
-		c.JSON(http.StatusOK, res)
-		return
-	}
-
-	c.Header("Content-Type", "application/x-ndjson")
-	c.Stream(func(w io.Writer) bool {
-		bts, err := json.Marshal(res)
-		if err != nil {
-			log.Info(fmt.Sprintf("streamResponse: json.Marshal failed with %s", err))
-			return false
-		}
-
-		// Delineate chunks with new-line delimiter
-		bts = append(bts, '\n')
-		if _, err := w.Write(bts); err != nil {
-			log.Info(fmt.Sprintf("streamResponse: w.Write failed with %s", err))
-			return false
-		}
-		return true
-	})
+	return prompt, nil
 }
 
 func (s *Service) ChatHandler(c *gin.Context) {
@@ -216,16 +227,19 @@ func (s *Service) ChatHandler(c *gin.Context) {
 		return
 	}
 
-	content, err := wrapper.LlamaChat(req.Messages)
+	content, stats, err := wrapper.LlamaChat(req.Messages)
+	s.record(c, &Record{Kind: RecordChat, Messages: req.Messages, Response: content}, &req, stats, err)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		abortModelError(c, err)
 		return
 	}
+	s.observeGeneration(c, stats)
 	res := api.ChatResponse{
 		Model:     req.Model,
 		CreatedAt: time.Now().UTC(),
 		Message:   api.Message{Role: "assistant", Content: content},
 		Done:      true,
+		Metrics:   genMetrics(stats),
 	}
 
 	res.TotalDuration = time.Since(checkpointStart)
@@ -295,17 +309,19 @@ func (s *Service) EmbedHandler(c *gin.Context) {
 		return
 	}
 
+	s.metrics.ObserveEmbedding(len(input))
+	cfg := s.ModelConfig()
 	prompts := ""
 	for k, i := range input {
 		if k > 0 {
-			prompts += s.cfg.EmbdSeparator
+			prompts += cfg.EmbdSeparator
 		}
 		prompts += i
 	}
 
-	ret, err := wrapper.LlamaEmbedding(s.cfg, s.cfg.Model, prompts, "array")
+	ret, err := wrapper.LlamaEmbedding(cfg, cfg.Model, prompts, "array")
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": strings.TrimSpace(err.Error())})
+		abortModelError(c, err)
 		return
 	}
 	var embeddings [][]float32
@@ -344,9 +360,10 @@ func (s *Service) EmbeddingsHandler(c *gin.Context) {
 		return
 	}
 
-	ret, err := wrapper.LlamaEmbedding(s.cfg, s.cfg.Model, req.Prompt, "array")
+	cfg := s.ModelConfig()
+	ret, err := wrapper.LlamaEmbedding(cfg, cfg.Model, req.Prompt, "array")
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": strings.TrimSpace(err.Error())})
+		abortModelError(c, err)
 		return
 	}
 	var embeddings [][]float64
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"github.com/Qitmeer/llama.go/wrapper"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+const (
+	stateLoading  = "loading"
+	stateReady    = "ready"
+	stateFailed   = "failed"
+	stateDraining = "draining"
+)
+
+// SetLoadError marks the model as failed to load, the service is never ready after it
+func (s *Service) SetLoadError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loadErr = err
+}
+
+// state returns the model load state and the load error if it failed
+func (s *Service) state() (string, error) {
+	s.mu.RLock()
+	err := s.loadErr
+	s.mu.RUnlock()
+	if err != nil {
+		return stateFailed, err
+	}
+	if s.draining.Load() {
+		return stateDraining, nil
+	}
+	if wrapper.LlamaStatus().Ready {
+		return stateReady, nil
+	}
+	return stateLoading, nil
+}
+
+// HealthzHandler reports that the process is alive
+func (s *Service) HealthzHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// ReadyzHandler reports whether the model is loaded and the runner accepts work
+func (s *Service) ReadyzHandler(c *gin.Context) {
+	state, err := s.state()
+	switch state {
+	case stateReady:
+		c.JSON(http.StatusOK, gin.H{"status": state})
+	case stateFailed:
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": state, "error": err.Error()})
+	default:
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": state})
+	}
+}
+
+// readyMiddleware rejects inference requests until the model is loaded and once shutdown started
+func (s *Service) readyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		state, err := s.state()
+		switch state {
+		case stateReady:
+			c.Next()
+		case stateFailed:
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "model failed to load: " + err.Error()})
+		case stateDraining:
+			c.Header("Connection", "close")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "server is shutting down"})
+		default:
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "model is loading"})
+		}
+	}
+}
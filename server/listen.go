@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"github.com/ethereum/go-ethereum/log"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket activation
+const listenFdsStart = 3
+
+// activatedListeners returns the sockets passed by systemd-style socket
+// activation through LISTEN_PID and LISTEN_FDS, nil without activation
+func activatedListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	// the sockets belong to this process only, do not pass them to children
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	lns := make([]net.Listener, 0, n)
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			closeListeners(lns)
+			return nil, fmt.Errorf("socket activation fd %d: %w", fd, err)
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// hostListener is a listener of the service, secure ones serve HTTPS
+type hostListener struct {
+	net.Listener
+	secure bool
+}
+
+// listenUnix listens on a Unix domain socket, replacing a stale socket file
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("unix socket %s is already in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	// the socket is created without the permissions mode denies, so that no
+	// client connects before the chmod
+	var ln net.Listener
+	err := withUmask(int(0777&^mode), func() (err error) {
+		ln, err = net.Listen("unix", path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// listen opens every listener of the service, socket activation takes
+// precedence over --host. The https hosts serve HTTPS, the activated TCP
+// sockets too when a certificate is set.
+func (s *Service) listen() ([]hostListener, error) {
+	activated, err := activatedListeners()
+	if err != nil {
+		return nil, err
+	}
+	var lns []hostListener
+	if len(activated) > 0 {
+		log.Info("Use socket activation", "listeners", len(activated))
+		for _, ln := range activated {
+			// Unix domain sockets are local, they are served without TLS
+			lns = append(lns, hostListener{Listener: ln, secure: s.cfg.TLSEnabled() && !isUnixConn(ln.Addr())})
+		}
+		return lns, nil
+	}
+
+	mode, err := s.cfg.SocketMode()
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range s.cfg.HostURLs() {
+		var ln net.Listener
+		if u.Scheme == "unix" {
+			ln, err = listenUnix(u.Path, mode)
+		} else {
+			ln, err = net.Listen("tcp", u.Host)
+		}
+		if err != nil {
+			closeListeners(lns)
+			return nil, err
+		}
+		lns = append(lns, hostListener{Listener: ln, secure: u.Scheme == "https"})
+	}
+	return lns, nil
+}
+
+func closeListeners[L net.Listener](lns []L) {
+	for _, ln := range lns {
+		ln.Close()
+	}
+}
+
+// isUnixConn reports whether the request came through a Unix domain socket
+func isUnixConn(addr net.Addr) bool {
+	return addr != nil && addr.Network() == "unix"
+}
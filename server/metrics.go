@@ -0,0 +1,175 @@
+package server
+
+import (
+	"github.com/Qitmeer/llama.go/wrapper"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"strconv"
+	"time"
+)
+
+const metricsNamespace = "llamago"
+
+// Metrics are the prometheus collectors of the service, exposed on /metrics
+type Metrics struct {
+	reg *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	queueWait       prometheus.Histogram
+	firstToken      prometheus.Histogram
+	tokensPerSecond prometheus.Histogram
+	embedBatch      prometheus.Histogram
+}
+
+func newMetrics() *Metrics {
+	m := &Metrics{
+		reg: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests by route, method and status.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests by route, method and status.",
+			Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		}, []string{"route", "method", "status"}),
+		queueWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "queue_wait_seconds",
+			Help:      "Time requests waited for the runner.",
+			Buckets:   prometheus.ExponentialBuckets(.001, 4, 10),
+		}),
+		firstToken: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "time_to_first_token_seconds",
+			Help:      "Time from the runner picking up a request to its first generated token.",
+			Buckets:   prometheus.ExponentialBuckets(.01, 2, 12),
+		}),
+		tokensPerSecond: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "generation_tokens_per_second",
+			Help:      "Generation speed of requests after the first token.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+		}),
+		embedBatch: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "embedding_batch_size",
+			Help:      "Number of inputs per embedding request.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+		}),
+	}
+
+	status := func(f func(st wrapper.Status) float64) func() float64 {
+		return func() float64 {
+			return f(wrapper.LlamaStatus())
+		}
+	}
+	m.reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.queueWait,
+		m.firstToken,
+		m.tokensPerSecond,
+		m.embedBatch,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "queue_depth",
+			Help:      "Requests waiting for the runner.",
+		}, status(func(st wrapper.Status) float64 { return float64(st.QueueDepth) })),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "active_slots",
+			Help:      "Requests being processed by the runner.",
+		}, status(func(st wrapper.Status) float64 { return boolFloat(st.Busy) })),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "model_loaded",
+			Help:      "Whether the model is loaded and accepting requests.",
+		}, status(func(st wrapper.Status) float64 { return boolFloat(st.Ready) })),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "model_load_duration_seconds",
+			Help:      "Time taken to load the model.",
+		}, status(func(st wrapper.Status) float64 { return st.LoadDuration.Seconds() })),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "model_load_timestamp_seconds",
+			Help:      "Unix time the model finished loading.",
+		}, status(func(st wrapper.Status) float64 {
+			if st.LoadedAt.IsZero() {
+				return 0
+			}
+			return float64(st.LoadedAt.UnixMilli()) / 1000
+		})),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "context_tokens",
+			Help:      "Tokens currently held in the context.",
+		}, status(func(st wrapper.Status) float64 { return float64(st.NPast) })),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "prompt_tokens_total",
+			Help:      "Prompt tokens evaluated by the runner.",
+		}, status(func(st wrapper.Status) float64 { return float64(st.PromptTokensTotal) })),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "generated_tokens_total",
+			Help:      "Tokens generated by the runner.",
+		}, status(func(st wrapper.Status) float64 { return float64(st.GeneratedTokensTotal) })),
+	)
+	return m
+}
+
+// Handler serves the metrics in the prometheus text format
+func (m *Metrics) Handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{}))
+}
+
+// Middleware counts requests and their latency by route and status
+func (m *Metrics) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		m.requests.WithLabelValues(route, c.Request.Method, status).Inc()
+		m.requestDuration.WithLabelValues(route, c.Request.Method, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// ObserveGeneration records the timings of one generation
+func (m *Metrics) ObserveGeneration(stats *wrapper.GenStats) {
+	if stats == nil {
+		return
+	}
+	m.queueWait.Observe(stats.QueueDuration.Seconds())
+	if stats.GeneratedTokens > 0 {
+		m.firstToken.Observe(stats.FirstTokenDuration.Seconds())
+	}
+	if tps := stats.TokensPerSecond(); tps > 0 {
+		m.tokensPerSecond.Observe(tps)
+	}
+}
+
+// ObserveEmbedding records the number of inputs of one embedding request
+func (m *Metrics) ObserveEmbedding(n int) {
+	m.embedBatch.Observe(float64(n))
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
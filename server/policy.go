@@ -0,0 +1,90 @@
+package server
+
+import (
+	"fmt"
+	"github.com/Qitmeer/llama.go/config"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// accessPolicy filters clients by their IP, resolved through the trusted proxies
+type accessPolicy struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, v := range list {
+		if !strings.Contains(v, "/") {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP or CIDR %s", v)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP or CIDR %s", v)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func newAccessPolicy(cfg *config.Config) (*accessPolicy, error) {
+	allow, err := parsePrefixes(config.SplitList(cfg.AllowCIDRs))
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parsePrefixes(config.SplitList(cfg.DenyCIDRs))
+	if err != nil {
+		return nil, err
+	}
+	return &accessPolicy{allow: allow, deny: deny}, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether the client IP passes the deny and allow lists
+func (p *accessPolicy) allowed(ip string) bool {
+	if len(p.allow) <= 0 && len(p.deny) <= 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	if containsAddr(p.deny, addr) {
+		return false
+	}
+	return len(p.allow) <= 0 || containsAddr(p.allow, addr)
+}
+
+func (p *accessPolicy) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isUnixConn(localAddr(c)) && !p.allowed(c.ClientIP()) {
+			log.Warn("Reject client by access policy", "client", c.ClientIP(), "path", c.Request.URL.Path)
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		c.Next()
+	}
+}
+
+// route returns the matched route of the request without the base path
+func (s *Service) route(c *gin.Context) string {
+	return strings.TrimPrefix(c.FullPath(), s.cfg.URLPrefix())
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Qitmeer/llama.go/wrapper"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitWindow is the length of the fixed window of the rate limits
+const rateLimitWindow = time.Minute
+
+// rateLimitSaveInterval is how often the counters are persisted
+const rateLimitSaveInterval = 10 * time.Second
+
+// usageContextKey is the gin context key of the generated tokens of the request
+const usageContextKey = "llamago.usage"
+
+type rateWindow struct {
+	Start    int64 `json:"start"`
+	Requests int   `json:"requests"`
+	Tokens   int   `json:"tokens"`
+}
+
+// RateLimiter limits the requests and generated tokens per minute of each
+// client, a client is its API key or else its IP address
+type RateLimiter struct {
+	rpm  int
+	tpm  int
+	file string
+
+	mu      sync.Mutex
+	windows map[string]*rateWindow
+	dirty   bool
+	// pruned is the start of the window when the older ones were last removed
+	pruned int64
+}
+
+func newRateLimiter(rpm int, tpm int, file string) (*RateLimiter, error) {
+	l := &RateLimiter{rpm: rpm, tpm: tpm, file: file, windows: map[string]*rateWindow{}}
+	if len(file) > 0 {
+		data, err := os.ReadFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &l.windows); err != nil {
+				return nil, fmt.Errorf("parse rate limit file %s: %w", file, err)
+			}
+		}
+	}
+	return l, nil
+}
+
+// window returns the current window of the client, l.mu must be held. The
+// windows of the other clients are removed once they are over.
+func (l *RateLimiter) window(client string, now time.Time) *rateWindow {
+	start := now.Truncate(rateLimitWindow).Unix()
+	l.prune(start)
+	w, ok := l.windows[client]
+	if !ok || w.Start != start {
+		w = &rateWindow{Start: start}
+		l.windows[client] = w
+	}
+	return w
+}
+
+// prune removes the windows started before start once per window, l.mu
+// must be held
+func (l *RateLimiter) prune(start int64) {
+	if l.pruned == start {
+		return
+	}
+	for client, w := range l.windows {
+		if w.Start < start {
+			delete(l.windows, client)
+			l.dirty = true
+		}
+	}
+	l.pruned = start
+}
+
+// limits returns the request and token limits of the request, 0 is unlimited
+func (l *RateLimiter) limits(c *gin.Context) (string, int, int) {
+	rpm, tpm := l.rpm, l.tpm
+	if key := requestKey(c); key != nil {
+		if key.RPM > 0 {
+			rpm = key.RPM
+		}
+		if key.TPM > 0 {
+			tpm = key.TPM
+		}
+		return "key:" + key.ID, rpm, tpm
+	}
+	return "ip:" + c.ClientIP(), rpm, tpm
+}
+
+// Enabled reports whether any limit can apply
+func (l *RateLimiter) Enabled(auth *Auth) bool {
+	return l.rpm > 0 || l.tpm > 0 || auth.Enabled()
+}
+
+// allow counts the request and reports whether it is within the limits
+func (l *RateLimiter) allow(c *gin.Context) bool {
+	client, rpm, tpm := l.limits(c)
+	if rpm <= 0 && tpm <= 0 {
+		return true
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	w := l.window(client, now)
+	reset := time.Unix(w.Start, 0).Add(rateLimitWindow).Sub(now)
+	requests, tokens := w.Requests, w.Tokens
+	limited := (rpm > 0 && requests >= rpm) || (tpm > 0 && tokens >= tpm)
+	if !limited {
+		w.Requests++
+		requests++
+		l.dirty = true
+	}
+	l.mu.Unlock()
+
+	resetSecs := strconv.Itoa(int(reset.Seconds()) + 1)
+	if rpm > 0 {
+		c.Header("X-RateLimit-Limit-Requests", strconv.Itoa(rpm))
+		c.Header("X-RateLimit-Remaining-Requests", strconv.Itoa(max(rpm-requests, 0)))
+		c.Header("X-RateLimit-Reset-Requests", resetSecs+"s")
+	}
+	if tpm > 0 {
+		c.Header("X-RateLimit-Limit-Tokens", strconv.Itoa(tpm))
+		c.Header("X-RateLimit-Remaining-Tokens", strconv.Itoa(max(tpm-tokens, 0)))
+		c.Header("X-RateLimit-Reset-Tokens", resetSecs+"s")
+	}
+	if limited {
+		c.Header("Retry-After", resetSecs)
+	}
+	return !limited
+}
+
+// consume adds the generated tokens of a finished request
+func (l *RateLimiter) consume(c *gin.Context, tokens int) {
+	if tokens <= 0 {
+		return
+	}
+	client, _, tpm := l.limits(c)
+	if tpm <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.window(client, time.Now()).Tokens += tokens
+	l.dirty = true
+}
+
+// Save writes the current windows to the rate limit file
+func (l *RateLimiter) Save() error {
+	if len(l.file) <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	if !l.dirty {
+		l.mu.Unlock()
+		return nil
+	}
+	l.prune(time.Now().Truncate(rateLimitWindow).Unix())
+	data, err := json.Marshal(l.windows)
+	l.dirty = false
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := l.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.file)
+}
+
+// run persists the counters periodically until quit is closed
+func (l *RateLimiter) run(quit <-chan struct{}) {
+	if len(l.file) <= 0 {
+		return
+	}
+	ticker := time.NewTicker(rateLimitSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.Save(); err != nil {
+				log.Error("Save rate limits failed", "error", err)
+			}
+		case <-quit:
+			if err := l.Save(); err != nil {
+				log.Error("Save rate limits failed", "error", err)
+			}
+			return
+		}
+	}
+}
+
+// setUsage records the generated tokens of the request for the token quota
+func setUsage(c *gin.Context, stats *wrapper.GenStats) {
+	if stats != nil {
+		c.Set(usageContextKey, stats.GeneratedTokens)
+	}
+}
+
+func (s *Service) rateLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.limiter.Enabled(s.auth) {
+			c.Next()
+			return
+		}
+		if !s.limiter.allow(c) {
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+			return
+		}
+		c.Next()
+		s.limiter.consume(c, c.GetInt(usageContextKey))
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/Qitmeer/llama.go/wrapper"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/gin-gonic/gin"
+	"github.com/ollama/ollama/api"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Kinds of the recorded requests
+const (
+	RecordGenerate = "generate"
+	RecordChat     = "chat"
+)
+
+// recordQueueSize is the number of records waiting to be written before the
+// requests wait for the recorder
+const recordQueueSize = 256
+
+// Record is one inference request of a recording, with everything needed to
+// run it again: the prompt or messages passed to the model, the options and
+// the sampling of the runner and the model it was answered by
+type Record struct {
+	Time  time.Time `json:"time"`
+	ID    string    `json:"id"`
+	Route string    `json:"route"`
+	Kind  string    `json:"kind"`
+
+	Model       string `json:"model"`
+	ModelDigest string `json:"model_digest,omitempty"`
+	// Runner is the load time in unix milliseconds of the runner that answered,
+	// the requests of a runner share its context and must be replayed together
+	Runner   int64            `json:"runner"`
+	Seed     uint32           `json:"seed"`
+	Sampling wrapper.Sampling `json:"sampling"`
+	Options  RecordOptions    `json:"options"`
+
+	// Request is the request as received, Prompt or Messages what the model was given
+	Request  json.RawMessage `json:"request"`
+	Prompt   string          `json:"prompt,omitempty"`
+	Messages []api.Message   `json:"messages,omitempty"`
+
+	Response         string `json:"response"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	Error            string `json:"error,omitempty"`
+}
+
+// RecordOptions are the runner options of a recorded request
+type RecordOptions struct {
+	CtxSize   int    `json:"ctx_size"`
+	NPredict  int    `json:"n_predict"`
+	LlamaArgs string `json:"llama_args,omitempty"`
+	// Prompt is the prompt the runner was started with
+	Prompt string `json:"prompt,omitempty"`
+}
+
+// Recorder appends the records to a JSONL file in the order the requests
+// were answered, the file is written and the model digests are computed in
+// the background
+type Recorder struct {
+	f       *os.File
+	records chan *Record
+	done    chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+
+	// digests of the model files by path, size and modification time
+	digests map[string]string
+}
+
+func newRecorder(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("record-file: %w", err)
+	}
+	r := &Recorder{
+		f:       f,
+		records: make(chan *Record, recordQueueSize),
+		done:    make(chan struct{}),
+		digests: map[string]string{},
+	}
+	go r.run()
+	return r, nil
+}
+
+func (r *Recorder) run() {
+	defer close(r.done)
+	for rec := range r.records {
+		digest, err := r.digest(rec.Model)
+		if err != nil {
+			log.Warn("Record model digest", "model", rec.Model, "err", err)
+		}
+		rec.ModelDigest = digest
+		data, err := json.Marshal(rec)
+		if err != nil {
+			log.Error("Record request", "id", rec.ID, "err", err)
+			continue
+		}
+		if _, err := r.f.Write(append(data, '\n')); err != nil {
+			log.Error("Record request", "id", rec.ID, "err", err)
+		}
+	}
+}
+
+func (r *Recorder) digest(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf("%s:%d:%d", path, info.Size(), info.ModTime().UnixNano())
+	if d, ok := r.digests[key]; ok {
+		return d, nil
+	}
+	d, err := ModelDigest(path)
+	if err != nil {
+		return "", err
+	}
+	r.digests[key] = d
+	return d, nil
+}
+
+// Add queues the record, it is dropped once the recorder is closed
+func (r *Recorder) Add(rec *Record) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.records <- rec
+}
+
+// Close writes the queued records and closes the file
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.records)
+	r.mu.Unlock()
+
+	<-r.done
+	return r.f.Close()
+}
+
+// ModelDigest is the sha256 digest of the model file, as sha256:<hex>
+func ModelDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// record completes the record of a generation with the request, the runner
+// and its result and queues it when recording is enabled
+func (s *Service) record(c *gin.Context, rec *Record, req any, stats *wrapper.GenStats, err error) {
+	if s.recorder == nil {
+		return
+	}
+	cfg := s.ModelConfig()
+	status := wrapper.LlamaStatus()
+
+	rec.Time = time.Now().UTC()
+	rec.ID = requestID(c)
+	rec.Route = c.FullPath()
+	rec.Model = cfg.Model
+	if !status.LoadedAt.IsZero() {
+		rec.Runner = status.LoadedAt.UnixMilli()
+	}
+	rec.Seed = status.Seed
+	rec.Sampling = status.Sampling
+	rec.Options = RecordOptions{CtxSize: cfg.CtxSize, NPredict: cfg.NPredict, LlamaArgs: cfg.LlamaArgs, Prompt: cfg.Prompt}
+	rec.Request, _ = json.Marshal(req)
+	if stats != nil {
+		rec.PromptTokens = stats.PromptTokens
+		rec.CompletionTokens = stats.GeneratedTokens
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	s.recorder.Add(rec)
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Qitmeer/llama.go/wrapper"
+	"github.com/gin-gonic/gin"
+	"github.com/ollama/ollama/api"
+	"io"
+	"net/http"
+)
+
+// RenderRequest accepts the body of either /api/generate or /api/chat, a
+// request with messages is rendered as a chat.
+type RenderRequest struct {
+	api.GenerateRequest
+	Messages []api.Message `json:"messages,omitempty"`
+}
+
+type RenderResponse struct {
+	Model  string `json:"model"`
+	Prompt string `json:"prompt"`
+
+	PromptEvalCount int `json:"prompt_eval_count"`
+	ContextSize     int `json:"context_size"`
+	ContextUsed     int `json:"context_used"`
+	// ContextRemaining is negative when the prompt does not fit
+	ContextRemaining int `json:"context_remaining"`
+}
+
+func (s *Service) RenderHandler(c *gin.Context) {
+	var req RenderRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(req.Model) > 0 && s.ModelConfig().Model != req.Model {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	msgs := req.Messages
+	if len(msgs) == 0 {
+		if req.Prompt == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "prompt or messages is required"})
+			return
+		}
+		if req.Raw && (req.Template != "" || req.System != "" || len(req.Context) > 0) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "raw mode does not support template, system, or context"})
+			return
+		}
+		prompt, err := s.generatePrompt(&req.GenerateRequest)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		msgs = []api.Message{{Role: "user", Content: prompt}}
+	}
+
+	prompt, n, err := wrapper.LlamaRender(msgs)
+	if err != nil {
+		abortModelError(c, err)
+		return
+	}
+	st := wrapper.LlamaStatus()
+	c.JSON(http.StatusOK, RenderResponse{
+		Model:            req.Model,
+		Prompt:           prompt,
+		PromptEvalCount:  n,
+		ContextSize:      st.CtxSize,
+		ContextUsed:      st.NPast,
+		ContextRemaining: st.CtxSize - st.NPast - n,
+	})
+}
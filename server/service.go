@@ -1,10 +1,13 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/Qitmeer/llama.go/config"
 	"github.com/Qitmeer/llama.go/version"
+	"github.com/Qitmeer/llama.go/wrapper"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -14,22 +17,37 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 )
 
 type Service struct {
-	ctx  *cli.Context
-	cfg  *config.Config
-	tmpl *template.Template
+	ctx     *cli.Context
+	cfg     *config.Config
+	tmpl    *template.Template
+	metrics *Metrics
+	auth    *Auth
+	limiter *RateLimiter
+	model   modelState
+	// recorder is nil unless --record-file is set
+	recorder *Recorder
+	// batches is nil unless --batch-dir is set
+	batches *batchStore
+	// batchBusy is set while a request of a batch runs
+	batchBusy atomic.Bool
 
-	addr net.Addr
 	srvr *http.Server
 
-	wg sync.WaitGroup
+	mu       sync.RWMutex
+	loadErr  error
+	draining atomic.Bool
+
+	quit chan struct{}
+	wg   sync.WaitGroup
 }
 
 func New(ctx *cli.Context, cfg *config.Config) *Service {
 	log.Info("New Server ...")
-	ser := Service{ctx: ctx, cfg: cfg}
+	ser := Service{ctx: ctx, cfg: cfg, metrics: newMetrics(), quit: make(chan struct{})}
 	return &ser
 }
 
@@ -41,30 +59,86 @@ func (s *Service) Start() error {
 	}
 	s.tmpl = tmpl
 
-	ln, err := net.Listen("tcp", s.cfg.HostURL().Host)
+	s.auth, err = newAuth(s.cfg.ApiKeys, s.cfg.ApiKeysFile)
+	if err != nil {
+		return err
+	}
+	s.limiter, err = newRateLimiter(s.cfg.RateLimitRPM, s.cfg.RateLimitTPM, s.cfg.RateLimitFile)
+	if err != nil {
+		return err
+	}
+
+	var tlsConfig *tls.Config
+	if s.cfg.TLSEnabled() {
+		tr, err := newTLSReloader(s.cfg)
+		if err != nil {
+			return err
+		}
+		tlsConfig = tr.Config()
+	}
+
+	if len(s.cfg.BatchDir) > 0 {
+		s.batches, err = newBatchStore(s.cfg.BatchDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	lns, err := s.listen()
 	if err != nil {
 		return err
 	}
-	s.addr = ln.Addr()
 
 	err = s.GenerateRoutes()
 	if err != nil {
+		closeListeners(lns)
 		return err
 	}
-	log.Info(fmt.Sprintf("Listening on %s (version %s)", ln.Addr(), version.String()))
+	if len(s.cfg.RecordFile) > 0 {
+		s.recorder, err = newRecorder(s.cfg.RecordFile)
+		if err != nil {
+			closeListeners(lns)
+			return err
+		}
+		log.Info("Recording requests", "file", s.cfg.RecordFile)
+	}
 	s.srvr = &http.Server{
-		Handler: nil,
+		Handler:   nil,
+		TLSConfig: tlsConfig,
 	}
 
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
-
-		err = s.srvr.Serve(ln)
-		if !errors.Is(err, http.ErrServerClosed) {
-			log.Error(err.Error())
-		}
+		s.limiter.run(s.quit)
 	}()
+	if s.batches != nil {
+		log.Info("Batch API enabled", "dir", s.cfg.BatchDir)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.runBatches(s.quit)
+		}()
+	}
+	for _, ln := range lns {
+		useTLS := ln.secure
+		log.Info(fmt.Sprintf("Listening on %s %s (version %s, tls %v)", ln.Addr().Network(), ln.Addr(), version.String(), useTLS))
+
+		s.wg.Add(1)
+		go func(ln net.Listener) {
+			defer s.wg.Done()
+
+			var err error
+			if useTLS {
+				err = s.srvr.ServeTLS(ln, "", "")
+			} else {
+				err = s.srvr.Serve(ln)
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				log.Error(err.Error())
+			}
+		}(ln.Listener)
+	}
 
 	return nil
 }
@@ -79,6 +153,7 @@ func (s *Service) GenerateRoutes() error {
 		"User-Agent",
 		"Accept",
 		"X-Requested-With",
+		requestIDHeader,
 
 		// OpenAI compatibility headers
 		"OpenAI-Beta",
@@ -95,35 +170,75 @@ func (s *Service) GenerateRoutes() error {
 		"x-stainless-runtime-version",
 		"x-stainless-timeout",
 	}
+	corsConfig.ExposeHeaders = []string{requestIDHeader}
 	corsConfig.AllowOrigins = s.cfg.AllowedOrigins()
 
 	gin.SetMode(gin.DebugMode)
-	r := gin.Default()
+	// the access log replaces the default logger of gin
+	r := gin.New()
+	r.Use(s.accessLogMiddleware(), gin.Recovery())
 	r.HandleMethodNotAllowed = true
+	if err := r.SetTrustedProxies(config.SplitList(s.cfg.TrustedProxies)); err != nil {
+		return err
+	}
+	policy, err := newAccessPolicy(s.cfg)
+	if err != nil {
+		return err
+	}
 	r.Use(
+		s.metrics.Middleware(),
+		policy.middleware(),
 		cors.New(corsConfig),
-		allowedHostsMiddleware(s.addr),
+		allowedHostsMiddleware(config.SplitList(s.cfg.AllowedHosts)),
+		s.authMiddleware(),
 	)
+	root := r.Group(s.cfg.URLPrefix())
 
 	// General
-	r.HEAD("/", func(c *gin.Context) { c.String(http.StatusOK, "Llamago is running") })
-	r.GET("/", func(c *gin.Context) { c.String(http.StatusOK, "Llamago is running") })
-	r.HEAD("/api/version", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"version": version.String()}) })
-	r.GET("/api/version", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"version": version.String()}) })
+	root.HEAD("/", func(c *gin.Context) { c.String(http.StatusOK, "Llamago is running") })
+	root.GET("/", func(c *gin.Context) { c.String(http.StatusOK, "Llamago is running") })
+	root.HEAD("/api/version", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"version": version.String()}) })
+	root.GET("/api/version", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"version": version.String()}) })
+	root.GET("/metrics", s.metrics.Handler())
+
+	// Health
+	root.GET("/healthz", s.HealthzHandler)
+	root.GET("/readyz", s.ReadyzHandler)
+
+	// Admin
+	root.POST("/api/admin/reload", s.adminMiddleware(), s.ReloadHandler)
 
 	// Inference
-	r.GET("/api/ps", s.PsHandler)
-	r.POST("/api/generate", s.GenerateHandler)
-	r.POST("/api/chat", s.ChatHandler)
-	r.POST("/api/embed", s.EmbedHandler)
-	r.POST("/api/embeddings", s.EmbeddingsHandler)
+	inference := root.Group("", s.readyMiddleware(), s.rateLimitMiddleware(), peekBodyMiddleware())
+	inference.GET("/api/ps", s.PsHandler)
+	inference.POST("/api/generate", s.GenerateHandler)
+	inference.POST("/api/chat", s.ChatHandler)
+	inference.POST("/api/embed", s.EmbedHandler)
+	inference.POST("/api/embeddings", s.EmbeddingsHandler)
+	inference.POST("/api/similarity", s.SimilarityHandler)
+	inference.POST("/api/tokenize", s.TokenizeHandler)
+	inference.POST("/api/detokenize", s.DetokenizeHandler)
+	inference.POST("/api/render", s.RenderHandler)
 
 	// Inference (OpenAI compatibility)
-	r.POST("/v1/chat/completions", openai.ChatMiddleware(), s.ChatHandler)
-	r.POST("/v1/completions", openai.CompletionsMiddleware(), s.GenerateHandler)
-	r.POST("/v1/embeddings", openai.EmbeddingsMiddleware(), s.EmbedHandler)
-	r.GET("/v1/models", openai.ListMiddleware(), s.ListHandler)
-	r.GET("/v1/models/:model", openai.RetrieveMiddleware(), s.ShowHandler)
+	inference.POST("/v1/chat/completions", openai.ChatMiddleware(), s.ChatHandler)
+	inference.POST("/v1/completions", openai.CompletionsMiddleware(), s.GenerateHandler)
+	inference.POST("/v1/embeddings", openai.EmbeddingsMiddleware(), s.EmbedHandler)
+	root.GET("/v1/models", openai.ListMiddleware(), s.ListHandler)
+	root.GET("/v1/models/:model", openai.RetrieveMiddleware(), s.ShowHandler)
+
+	// Batches (OpenAI compatibility), run in the background when the model is idle
+	if s.batches != nil {
+		root.POST("/v1/files", s.UploadFileHandler)
+		root.GET("/v1/files", s.ListFilesHandler)
+		root.GET("/v1/files/:file_id", s.GetFileHandler)
+		root.GET("/v1/files/:file_id/content", s.FileContentHandler)
+		root.DELETE("/v1/files/:file_id", s.DeleteFileHandler)
+		root.POST("/v1/batches", s.CreateBatchHandler)
+		root.GET("/v1/batches", s.ListBatchesHandler)
+		root.GET("/v1/batches/:batch_id", s.GetBatchHandler)
+		root.POST("/v1/batches/:batch_id/cancel", s.CancelBatchHandler)
+	}
 
 	http.Handle("/", r)
 	return nil
@@ -132,10 +247,36 @@ func (s *Service) GenerateRoutes() error {
 func (s *Service) Stop() error {
 	log.Info("Stop Server...")
 
+	// new requests get 503 while the in-flight ones finish
+	s.draining.Store(true)
+
 	var err error
 	if s.srvr != nil {
-		err = s.srvr.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+		err = s.srvr.Shutdown(ctx)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) {
+			log.Warn("Shutdown grace period expired, cancel in-flight requests", "timeout", s.cfg.ShutdownTimeout)
+			// stopping the runner fails the current and queued generations
+			if err := wrapper.LlamaStop(); err != nil {
+				log.Error(err.Error())
+			}
+			err = s.srvr.Close()
+		}
+	}
+	close(s.quit)
+	if s.batchBusy.Load() {
+		// the request of a batch would delay the shutdown, it runs again on restart
+		log.Info("Stop the running batch request")
+		if err := wrapper.LlamaStop(); err != nil {
+			log.Error(err.Error())
+		}
 	}
 	s.wg.Wait()
+	if s.recorder != nil {
+		if err := s.recorder.Close(); err != nil {
+			log.Error(err.Error())
+		}
+	}
 	return err
 }
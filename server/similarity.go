@@ -0,0 +1,168 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Qitmeer/llama.go/config"
+	"github.com/Qitmeer/llama.go/wrapper"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SimilarityRequest compares every text of Input with every text of Compare.
+// When Compare is empty, Input is compared with itself.
+type SimilarityRequest struct {
+	Model   string   `json:"model"`
+	Input   []string `json:"input"`
+	Compare []string `json:"compare,omitempty"`
+	TopK    int      `json:"top_k,omitempty"`
+}
+
+// SimilarityPair is one cell of the similarity matrix.
+type SimilarityPair struct {
+	Input   int     `json:"input"`
+	Compare int     `json:"compare"`
+	Score   float32 `json:"score"`
+}
+
+type SimilarityResponse struct {
+	Model      string           `json:"model"`
+	Similarity [][]float32      `json:"similarity"`
+	Pairs      []SimilarityPair `json:"pairs,omitempty"`
+
+	TotalDuration   time.Duration `json:"total_duration,omitempty"`
+	LoadDuration    time.Duration `json:"load_duration,omitempty"`
+	PromptEvalCount int           `json:"prompt_eval_count,omitempty"`
+}
+
+// embdJsonPlus is the document produced by the "json+" embedding output format
+type embdJsonPlus struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+	CosineSimilarity [][]float32 `json:"cosineSimilarity"`
+}
+
+func (s *Service) SimilarityHandler(c *gin.Context) {
+	checkpointStart := time.Now()
+	var req SimilarityRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	cfg := s.ModelConfig()
+	if len(req.Model) > 0 && cfg.Model != req.Model {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+	if len(req.Input) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "input is required"})
+		return
+	}
+	if req.TopK < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "top_k must not be negative"})
+		return
+	}
+
+	texts := append(slices.Clone(req.Input), req.Compare...)
+	for _, t := range texts {
+		if len(t) == 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "input must not contain empty strings"})
+			return
+		}
+		// the texts are joined by the separator for the embedding call
+		if len(cfg.EmbdSeparator) > 0 && strings.Contains(t, cfg.EmbdSeparator) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("input must not contain the embedding separator %q", cfg.EmbdSeparator)})
+			return
+		}
+	}
+
+	checkpointLoaded := time.Now()
+
+	s.metrics.ObserveEmbedding(len(texts))
+	matrix, err := similarityMatrix(cfg, texts)
+	if err != nil {
+		abortModelError(c, err)
+		return
+	}
+
+	self := len(req.Compare) == 0
+	rows := matrix[:len(req.Input)]
+	if !self {
+		for i := range rows {
+			rows[i] = rows[i][len(req.Input):]
+		}
+	}
+
+	resp := SimilarityResponse{
+		Model:           req.Model,
+		Similarity:      rows,
+		PromptEvalCount: len(texts),
+	}
+	if req.TopK > 0 {
+		resp.Pairs = topSimilarityPairs(rows, self, req.TopK)
+	}
+	resp.TotalDuration = time.Since(checkpointStart)
+	resp.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+	c.JSON(http.StatusOK, resp)
+}
+
+// similarityMatrix returns the cosine similarity matrix of texts computed by the "json+" embedding mode
+// with the model, the separator and the pooling of cfg
+func similarityMatrix(cfg *config.Config, texts []string) ([][]float32, error) {
+	ret, err := wrapper.LlamaEmbedding(cfg, cfg.Model, strings.Join(texts, cfg.EmbdSeparator), "json+")
+	if err != nil {
+		return nil, err
+	}
+	var out embdJsonPlus
+	err = json.Unmarshal([]byte(ret), &out)
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Data) != len(texts) {
+		return nil, fmt.Errorf("%d embeddings for %d inputs, pooling '%s' is not supported", len(out.Data), len(texts), cfg.Pooling)
+	}
+	// llama.cpp only emits the matrix for more than one prompt
+	if len(texts) == 1 {
+		return [][]float32{{1}}, nil
+	}
+	if len(out.CosineSimilarity) != len(texts) {
+		return nil, fmt.Errorf("%d != %d", len(out.CosineSimilarity), len(texts))
+	}
+	return out.CosineSimilarity, nil
+}
+
+// topSimilarityPairs returns the k most similar pairs of the matrix. For a
+// self comparison the diagonal and mirrored pairs are skipped.
+func topSimilarityPairs(matrix [][]float32, self bool, k int) []SimilarityPair {
+	pairs := []SimilarityPair{}
+	for i, row := range matrix {
+		for j, score := range row {
+			if self && j <= i {
+				continue
+			}
+			pairs = append(pairs, SimilarityPair{Input: i, Compare: j, Score: score})
+		}
+	}
+	slices.SortStableFunc(pairs, func(a, b SimilarityPair) int {
+		// highest score first
+		return cmp.Compare(b.Score, a.Score)
+	})
+	if len(pairs) > k {
+		pairs = pairs[:k]
+	}
+	return pairs
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/Qitmeer/llama.go/config"
+	"github.com/ethereum/go-ethereum/log"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsReloadInterval is how often the certificate files are checked for changes
+const tlsReloadInterval = 5 * time.Second
+
+// tlsReloader keeps the server certificate and the client CA pool in sync with
+// their files, so rotated certificates are served without restart
+type tlsReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  [3]time.Time
+	lastCheck time.Time
+}
+
+func newTLSReloader(cfg *config.Config) (*tlsReloader, error) {
+	if len(cfg.TLSCert) <= 0 || len(cfg.TLSKey) <= 0 {
+		return nil, fmt.Errorf("both --tls-cert and --tls-key are required to serve HTTPS")
+	}
+	r := &tlsReloader{certFile: cfg.TLSCert, keyFile: cfg.TLSKey, caFile: cfg.TLSClientCA}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func fileModTime(name string) (time.Time, error) {
+	if len(name) <= 0 {
+		return time.Time{}, nil
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// load reads the files again if any of them changed
+func (r *tlsReloader) load() error {
+	var modTimes [3]time.Time
+	for i, name := range []string{r.certFile, r.keyFile, r.caFile} {
+		t, err := fileModTime(name)
+		if err != nil {
+			return err
+		}
+		modTimes[i] = t
+	}
+	r.mu.RLock()
+	unchanged := r.cert != nil && modTimes == r.modTimes
+	r.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load TLS certificate: %w", err)
+	}
+	var pool *x509.CertPool
+	if len(r.caFile) > 0 {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in TLS client CA %s", r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCAs = pool
+	r.modTimes = modTimes
+	r.mu.Unlock()
+	log.Info("Load TLS certificate", "cert", r.certFile, "clientCA", r.caFile)
+	return nil
+}
+
+// maybeReload checks the files at most once per tlsReloadInterval, broken files
+// keep the previous certificate
+func (r *tlsReloader) maybeReload() {
+	r.mu.Lock()
+	if time.Since(r.lastCheck) < tlsReloadInterval {
+		r.mu.Unlock()
+		return
+	}
+	r.lastCheck = time.Now()
+	r.mu.Unlock()
+
+	if err := r.load(); err != nil {
+		log.Error("Reload TLS certificate failed, keeping the previous one", "error", err)
+	}
+}
+
+// Config returns the server TLS config, every handshake uses the latest certificate and client CA
+func (r *tlsReloader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.maybeReload()
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+				NextProtos:   []string{"h2", "http/1.1"},
+			}
+			if r.clientCAs != nil {
+				cfg.ClientCAs = r.clientCAs
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return cfg, nil
+		},
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Qitmeer/llama.go/wrapper"
+	"github.com/gin-gonic/gin"
+	"io"
+	"math"
+	"net/http"
+)
+
+type TokenizeRequest struct {
+	Model        string `json:"model"`
+	Text         string `json:"text"`
+	AddSpecial   bool   `json:"add_special"`
+	ParseSpecial bool   `json:"parse_special"`
+	WithPieces   bool   `json:"with_pieces"`
+}
+
+type TokenPiece struct {
+	ID    int    `json:"id"`
+	Piece string `json:"piece"`
+}
+
+type TokenizeResponse struct {
+	Model  string       `json:"model"`
+	Tokens []int        `json:"tokens"`
+	Pieces []TokenPiece `json:"pieces,omitempty"`
+}
+
+type DetokenizeRequest struct {
+	Model   string `json:"model"`
+	Tokens  []int  `json:"tokens"`
+	Special bool   `json:"special"`
+}
+
+type DetokenizeResponse struct {
+	Model string `json:"model"`
+	Text  string `json:"text"`
+}
+
+func (s *Service) TokenizeHandler(c *gin.Context) {
+	// special tokens in the text are parsed unless disabled
+	req := TokenizeRequest{ParseSpecial: true}
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(req.Model) > 0 && s.ModelConfig().Model != req.Model {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	tokens, err := wrapper.LlamaTokenize(req.Text, req.AddSpecial, req.ParseSpecial)
+	if err != nil {
+		abortModelError(c, err)
+		return
+	}
+	resp := TokenizeResponse{Model: req.Model, Tokens: tokens}
+	if req.WithPieces {
+		resp.Pieces, err = tokenPieces(tokens)
+		if err != nil {
+			abortModelError(c, err)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Service) DetokenizeHandler(c *gin.Context) {
+	var req DetokenizeRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(req.Model) > 0 && s.ModelConfig().Model != req.Model {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	// the ids are C ints, larger ones would wrap to valid tokens
+	for _, t := range req.Tokens {
+		if t < 0 || t > math.MaxInt32 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid token id %d", t)})
+			return
+		}
+	}
+
+	text, err := wrapper.LlamaDetokenize(req.Tokens, req.Special)
+	if err != nil {
+		abortModelError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, DetokenizeResponse{Model: req.Model, Text: text})
+}
+
+func tokenPieces(tokens []int) ([]TokenPiece, error) {
+	pieces := make([]TokenPiece, len(tokens))
+	for i, t := range tokens {
+		piece, err := wrapper.LlamaTokenPiece(t, true)
+		if err != nil {
+			return nil, err
+		}
+		pieces[i] = TokenPiece{ID: t, Piece: piece}
+	}
+	return pieces, nil
+}
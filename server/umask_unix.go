@@ -0,0 +1,13 @@
+//go:build darwin || linux
+
+package server
+
+import "syscall"
+
+// withUmask runs fn with the file mode creation mask of the process set to
+// mask, the mask applies to every goroutine meanwhile
+func withUmask(mask int, fn func() error) error {
+	old := syscall.Umask(mask)
+	defer syscall.Umask(old)
+	return fn()
+}
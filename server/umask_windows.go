@@ -0,0 +1,8 @@
+//go:build windows
+
+package server
+
+// withUmask runs fn, Windows has no file mode creation mask
+func withUmask(mask int, fn func() error) error {
+	return fn()
+}
@@ -1,7 +1,13 @@
 package server
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/Qitmeer/llama.go/wrapper"
 	"github.com/gin-gonic/gin"
+	"github.com/ollama/ollama/api"
+	"io"
 	"net"
 	"net/http"
 	"net/netip"
@@ -9,19 +15,123 @@ import (
 	"strings"
 )
 
+// maxPeekedBody is the size of the request bodies read before the handler,
+// the model and the prompt of larger ones are not known
+const maxPeekedBody = 8 << 20
+
+var errBodyTooLarge = fmt.Errorf("request body is larger than %d bytes", maxPeekedBody)
+
+const peekedBodyContextKey = "llamago.peeked_body"
+
+type peekedBody struct {
+	data []byte
+	err  error
+}
+
+// peekBody reads the body of a request once, up to maxPeekedBody bytes, and
+// gives the whole body back to the handler. Larger bodies return
+// errBodyTooLarge, multipart bodies such as file uploads are not read.
+func peekBody(c *gin.Context) ([]byte, error) {
+	if v, ok := c.Get(peekedBodyContextKey); ok {
+		p := v.(peekedBody)
+		return p.data, p.err
+	}
+	if c.Request.Body == nil || c.Request.Method == http.MethodGet || strings.HasPrefix(c.ContentType(), "multipart/") {
+		return nil, nil
+	}
+	body := c.Request.Body
+	data, err := io.ReadAll(io.LimitReader(body, maxPeekedBody+1))
+	c.Request.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), body), body}
+	if err == nil && len(data) > maxPeekedBody {
+		data, err = nil, errBodyTooLarge
+	}
+	c.Set(peekedBodyContextKey, peekedBody{data: data, err: err})
+	return data, err
+}
+
+// peekBodyMiddleware reads the bodies of the inference requests for the
+// access log, once they are authenticated
+func peekBodyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodPost {
+			_, _ = peekBody(c)
+		}
+		c.Next()
+	}
+}
+
 type ImageData struct {
 	Data []byte `json:"data"`
 	ID   int    `json:"id"`
 }
 
-func allowedHostsMiddleware(addr net.Addr) gin.HandlerFunc {
+// genMetrics converts the stats of a generation into the ollama response metrics
+func genMetrics(stats *wrapper.GenStats) api.Metrics {
+	if stats == nil {
+		return api.Metrics{}
+	}
+	return api.Metrics{
+		PromptEvalCount:    stats.PromptTokens,
+		PromptEvalDuration: stats.FirstTokenDuration,
+		EvalCount:          stats.GeneratedTokens,
+		EvalDuration:       stats.TotalDuration - stats.FirstTokenDuration,
+	}
+}
+
+// errorStatus is the HTTP status of a failed call to the model, from the
+// cause the wrapper reports
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, wrapper.ErrInvalidArgs),
+		errors.Is(err, wrapper.ErrContextOverflow),
+		errors.Is(err, wrapper.ErrTokenize):
+		return http.StatusBadRequest
+	case errors.Is(err, wrapper.ErrModelNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, wrapper.ErrNotStarted),
+		errors.Is(err, wrapper.ErrStopped),
+		errors.Is(err, wrapper.ErrOutOfMemory):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// abortModelError ends the request with the error of a failed call to the model
+func abortModelError(c *gin.Context, err error) {
+	c.AbortWithStatusJSON(errorStatus(err), gin.H{"error": strings.TrimSpace(err.Error())})
+}
+
+// observeGeneration records a finished generation in the metrics, the token
+// quota and the access log
+func (s *Service) observeGeneration(c *gin.Context, stats *wrapper.GenStats) {
+	s.metrics.ObserveGeneration(stats)
+	setUsage(c, stats)
+	if stats != nil {
+		c.Set(statsContextKey, stats)
+	}
+}
+
+// localAddr returns the address of the listener that accepted the request
+func localAddr(c *gin.Context) net.Addr {
+	addr, _ := c.Request.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return addr
+}
+
+// allowedHostsMiddleware checks the Host header of the requests against hosts
+// on every TCP listener, or against the local names on loopback listeners
+// when hosts is empty
+func allowedHostsMiddleware(hosts []string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if addr == nil {
+		addr := localAddr(c)
+		if addr == nil || isUnixConn(addr) {
 			c.Next()
 			return
 		}
 
-		if addr, err := netip.ParseAddrPort(addr.String()); err == nil && !addr.Addr().IsLoopback() {
+		if addr, err := netip.ParseAddrPort(addr.String()); err == nil && !addr.Addr().IsLoopback() && len(hosts) <= 0 {
 			c.Next()
 			return
 		}
@@ -31,14 +141,14 @@ func allowedHostsMiddleware(addr net.Addr) gin.HandlerFunc {
 			host = c.Request.Host
 		}
 
-		if addr, err := netip.ParseAddr(host); err == nil {
+		if addr, err := netip.ParseAddr(host); err == nil && len(hosts) <= 0 {
 			if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() || isLocalIP(addr) {
 				c.Next()
 				return
 			}
 		}
 
-		if allowedHost(host) {
+		if allowedHost(host, hosts) {
 			if c.Request.Method == http.MethodOptions {
 				c.AbortWithStatus(http.StatusNoContent)
 				return
@@ -52,9 +162,23 @@ func allowedHostsMiddleware(addr net.Addr) gin.HandlerFunc {
 	}
 }
 
-func allowedHost(host string) bool {
+// allowedHost checks the Host header against the configured hosts, or the local names without configuration
+func allowedHost(host string, hosts []string) bool {
 	host = strings.ToLower(host)
 
+	if len(hosts) > 0 {
+		for _, h := range hosts {
+			h = strings.ToLower(h)
+			switch {
+			case h == "*" || h == host:
+				return true
+			case strings.HasPrefix(h, ".") && strings.HasSuffix(host, h):
+				return true
+			}
+		}
+		return false
+	}
+
 	if host == "" || host == "localhost" {
 		return true
 	}
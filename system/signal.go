@@ -36,13 +36,13 @@ func InterruptListener() <-chan struct{} {
 		}
 		close(c)
 
-		// Listen for repeated signals and display a message so the user
-		// knows the shutdown is in progress and the process is not
-		// hung.
+		// Listen for repeated signals, a second signal forces an
+		// immediate exit without waiting for the graceful shutdown.
 		for {
 			select {
 			case sig := <-interruptChannel:
-				log.Info(fmt.Sprintf("Received signal (%s).  Already shutting down...", sig))
+				log.Warn(fmt.Sprintf("Received signal (%s) again.  Forcing exit...", sig))
+				os.Exit(1)
 
 			case <-ShutdownRequestChannel:
 				log.Info("Shutdown requested.  Already " +
@@ -54,6 +54,25 @@ func InterruptListener() <-chan struct{} {
 	return c
 }
 
+// ReloadListener returns a channel that receives a value for every SIGHUP,
+// used to reload the configuration and the model without restarting.
+func ReloadListener() <-chan struct{} {
+	c := make(chan struct{}, 1)
+	go func() {
+		hupChannel := make(chan os.Signal, 1)
+		signal.Notify(hupChannel, syscall.SIGHUP)
+		for sig := range hupChannel {
+			log.Info(fmt.Sprintf("Received signal (%s).  Reloading...", sig))
+			select {
+			case c <- struct{}{}:
+			default:
+				// a reload is already pending
+			}
+		}
+	}()
+	return c
+}
+
 // interruptRequested returns true when the channel returned by
 // interruptListener was closed.  This simplifies early shutdown slightly since
 // the caller can just use an if statement instead of a select.
@@ -0,0 +1,141 @@
+package wrapper
+
+/*
+#include "../core/include/core_types.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"fmt"
+	"github.com/Qitmeer/llama.go/config"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// program is argv[0] of the command lines passed to the core library
+const program = "llama"
+
+// startArgs is the runner command line of the config, the llama.cpp options
+// of --llama-args come last and override the typed ones
+func startArgs(cfg *config.Config) ([]string, error) {
+	args := []string{program, "-i",
+		"--model", cfg.Model,
+		"--ctx-size", strconv.Itoa(cfg.CtxSize),
+		"--n-gpu-layers", strconv.Itoa(cfg.NGpuLayers),
+		"--n-predict", strconv.Itoa(cfg.NPredict),
+		"--seed", strconv.FormatUint(uint64(cfg.Seed), 10),
+	}
+	extra, err := SplitArgs(cfg.LlamaArgs)
+	if err != nil {
+		return nil, fmt.Errorf("llama-args: %w", err)
+	}
+	return append(args, extra...), nil
+}
+
+// embeddingArgs is the embedding command line of the config for model, the
+// llama.cpp options of --llama-args come last
+func embeddingArgs(cfg *config.Config, model string, embdOutputFormat string) ([]string, error) {
+	args := []string{program,
+		"--model", model,
+		"--ctx-size", strconv.Itoa(cfg.CtxSize),
+		"--n-gpu-layers", strconv.Itoa(cfg.NGpuLayers),
+		"--n-predict", strconv.Itoa(cfg.NPredict),
+		"--seed", strconv.FormatUint(uint64(cfg.Seed), 10),
+		"--embd-normalize", strconv.Itoa(cfg.EmbdNormalize),
+		"--batch-size", strconv.Itoa(cfg.BatchSize),
+		"--ubatch-size", strconv.Itoa(cfg.UBatchSize),
+	}
+	if len(cfg.Pooling) > 0 {
+		args = append(args, "--pooling", cfg.Pooling)
+	}
+	if len(embdOutputFormat) > 0 {
+		args = append(args, "--embd-output-format", embdOutputFormat)
+	}
+	if len(cfg.EmbdSeparator) > 0 {
+		args = append(args, "--embd-separator", cfg.EmbdSeparator)
+	}
+	extra, err := SplitArgs(cfg.LlamaArgs)
+	if err != nil {
+		return nil, fmt.Errorf("llama-args: %w", err)
+	}
+	return append(args, extra...), nil
+}
+
+// SplitArgs splits options separated by spaces, single or double quotes keep
+// the spaces of a value
+func SplitArgs(s string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	var quote rune
+	inArg := false
+	for _, r := range s {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			cur.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in '%s'", s)
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// newCArgs copies the command line to C memory, release it with freeCArgs
+func newCArgs(args []string) *C.struct_llama_args {
+	ca := (*C.struct_llama_args)(C.calloc(1, C.size_t(unsafe.Sizeof(C.struct_llama_args{}))))
+	if len(args) == 0 {
+		return ca
+	}
+	argv := unsafe.Slice((**C.char)(C.calloc(C.size_t(len(args)), C.size_t(unsafe.Sizeof((*C.char)(nil))))), len(args))
+	for i, a := range args {
+		argv[i] = C.CString(a)
+	}
+	ca.argc = C.int(len(args))
+	ca.argv = &argv[0]
+	return ca
+}
+
+func freeCArgs(ca *C.struct_llama_args) {
+	if ca.argv != nil {
+		for _, a := range unsafe.Slice(ca.argv, int(ca.argc)) {
+			C.free(unsafe.Pointer(a))
+		}
+		C.free(unsafe.Pointer(ca.argv))
+	}
+	C.free(unsafe.Pointer(ca))
+}
+
+// coreError converts the error of a failed call into an *Error and releases
+// its message
+func coreError(op string, e *C.struct_llama_core_error) error {
+	defer C.llama_core_error_free(e)
+	err := &Error{Op: op, Code: int(e.code)}
+	if e.message != nil {
+		err.Message = C.GoString(e.message)
+	}
+	return err
+}
+
+// goString copies a string returned by the core library and releases it
+func goString(s *C.char) string {
+	defer C.llama_core_free(unsafe.Pointer(s))
+	return C.GoString(s)
+}
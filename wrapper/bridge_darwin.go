@@ -35,42 +35,46 @@ func LlamaInteractive(cfg *config.Config) error {
 	ip := C.CString(cfg.Prompt)
 	defer C.free(unsafe.Pointer(ip))
 
-	cfgArgs := fmt.Sprintf("llama -i --model %s --ctx-size %d --n-gpu-layers %d --n-predict %d --seed %d",
-		cfg.Model, cfg.CtxSize, cfg.NGpuLayers, cfg.NPredict, cfg.Seed)
-	ca := C.CString(cfgArgs)
-	defer C.free(unsafe.Pointer(ca))
+	args, err := startArgs(cfg)
+	if err != nil {
+		return err
+	}
+	ca := newCArgs(args)
+	defer freeCArgs(ca)
 
-	ret := C.llama_start(ca, 0, ip)
+	var cerr C.struct_llama_core_error
+	ret := C.llama_start(ca, 0, ip, &cerr)
 	if ret != 0 {
-		return fmt.Errorf("Llama start error")
+		return coreError("Llama start error", &cerr)
 	}
-	ret = C.llama_stop()
+	ret = C.llama_stop(&cerr)
 	if ret != 0 {
-		return fmt.Errorf("Llama stop error")
+		return coreError("Llama stop error", &cerr)
 	}
 	return nil
 }
 
-func LlamaGenerate(prompt string) (string, error) {
+func LlamaGenerate(prompt string) (string, *GenStats, error) {
 	if len(prompt) <= 0 {
-		return "", fmt.Errorf("No prompt")
+		return "", nil, fmt.Errorf("No prompt")
 	}
 	ip := C.CString(prompt)
 	defer C.free(unsafe.Pointer(ip))
 
-	ret := C.llama_gen(ip)
-	if ret == nil {
-		return "", fmt.Errorf("Llama run error")
+	var result *C.char
+	var stats C.struct_llama_gen_stats
+	var cerr C.struct_llama_core_error
+	ret := C.llama_gen(ip, &result, &stats, &cerr)
+	if ret != 0 {
+		return "", nil, coreError("Llama run error", &cerr)
 	}
-	content := C.GoString(ret)
-	C.free(unsafe.Pointer(ret))
-	return content, nil
+	return goString(result), newGenStats(&stats), nil
 }
 
-func LlamaChat(msgs []api.Message) (string, error) {
+func LlamaChat(msgs []api.Message) (string, *GenStats, error) {
 	size := len(msgs)
 	if size <= 0 {
-		return "", fmt.Errorf("No messages for chat")
+		return "", nil, fmt.Errorf("No messages for chat")
 	}
 	roles := make([]*C.char, size)
 	contents := make([]*C.char, size)
@@ -86,38 +90,43 @@ func LlamaChat(msgs []api.Message) (string, error) {
 	rolesPtr := (**C.char)(unsafe.Pointer(&roles[0]))
 	contentsPtr := (**C.char)(unsafe.Pointer(&contents[0]))
 
-	ret := C.llama_chat(rolesPtr, contentsPtr, C.int(size))
-	if ret == nil {
-		return "", fmt.Errorf("Llama run error")
+	var result *C.char
+	var stats C.struct_llama_gen_stats
+	var cerr C.struct_llama_core_error
+	ret := C.llama_chat(rolesPtr, contentsPtr, C.int(size), &result, &stats, &cerr)
+	if ret != 0 {
+		return "", nil, coreError("Llama run error", &cerr)
 	}
-	content := C.GoString(ret)
-	C.free(unsafe.Pointer(ret))
-	return content, nil
+	return goString(result), newGenStats(&stats), nil
 }
 
 func LlamaStart(cfg *config.Config) error {
 	if len(cfg.Model) <= 0 {
 		return fmt.Errorf("No model")
 	}
-	cfgArgs := fmt.Sprintf("llama -i --model %s --ctx-size %d --n-gpu-layers %d --n-predict %d --seed %d",
-		cfg.Model, cfg.CtxSize, cfg.NGpuLayers, cfg.NPredict, cfg.Seed)
-	ca := C.CString(cfgArgs)
-	defer C.free(unsafe.Pointer(ca))
+	args, err := startArgs(cfg)
+	if err != nil {
+		return err
+	}
+	ca := newCArgs(args)
+	defer freeCArgs(ca)
 
 	ip := C.CString(cfg.Prompt)
 	defer C.free(unsafe.Pointer(ip))
 
-	ret := C.llama_start(ca, 1, ip)
+	var cerr C.struct_llama_core_error
+	ret := C.llama_start(ca, 1, ip, &cerr)
 	if ret != 0 {
-		return fmt.Errorf("Llama start error")
+		return coreError("Llama start error", &cerr)
 	}
 	return nil
 }
 
 func LlamaStop() error {
-	ret := C.llama_stop()
+	var cerr C.struct_llama_core_error
+	ret := C.llama_stop(&cerr)
 	if ret != 0 {
-		return fmt.Errorf("Llama stop error")
+		return coreError("Llama stop error", &cerr)
 	}
 	return nil
 }
@@ -132,25 +141,18 @@ func LlamaEmbedding(cfg *config.Config, model string, prompts string, embdOutput
 	ip := C.CString(prompts)
 	defer C.free(unsafe.Pointer(ip))
 
-	cfgArgs := fmt.Sprintf("llama --model %s --ctx-size %d --n-gpu-layers %d --n-predict %d --seed %d --embd-normalize %d --batch-size %d --ubatch-size %d",
-		model, cfg.CtxSize, cfg.NGpuLayers, cfg.NPredict, cfg.Seed, cfg.EmbdNormalize, cfg.BatchSize, cfg.UBatchSize)
-	if len(cfg.Pooling) > 0 {
-		cfgArgs = fmt.Sprintf("%s --pooling %s", cfgArgs, cfg.Pooling)
-	}
-	if len(embdOutputFormat) > 0 {
-		cfgArgs = fmt.Sprintf("%s --embd-output-format %s", cfgArgs, embdOutputFormat)
+	args, err := embeddingArgs(cfg, model, embdOutputFormat)
+	if err != nil {
+		return "", err
 	}
-	if len(cfg.EmbdSeparator) > 0 {
-		cfgArgs = fmt.Sprintf("%s --embd-separator %s", cfgArgs, cfg.EmbdSeparator)
-	}
-	ca := C.CString(cfgArgs)
-	defer C.free(unsafe.Pointer(ca))
+	ca := newCArgs(args)
+	defer freeCArgs(ca)
 
-	ret := C.llama_embedding(ca, ip)
-	if ret == nil {
-		return "", fmt.Errorf("llama_embedding run error")
+	var result *C.char
+	var cerr C.struct_llama_core_error
+	ret := C.llama_embedding(ca, ip, &result, &cerr)
+	if ret != 0 {
+		return "", coreError("llama_embedding run error", &cerr)
 	}
-	content := C.GoString(ret)
-	C.free(unsafe.Pointer(ret))
-	return content, nil
+	return goString(result), nil
 }
@@ -0,0 +1,59 @@
+package wrapper
+
+/*
+#include "../core/include/core_types.h"
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+)
+
+// Causes of the failures of the core library, test them with errors.Is
+var (
+	ErrInvalidArgs     = errors.New("invalid arguments")
+	ErrNotStarted      = errors.New("model is not started")
+	ErrLoadFailed      = errors.New("model load failed")
+	ErrStopped         = errors.New("model stopped")
+	ErrRunFailed       = errors.New("request failed")
+	ErrModelNotFound   = errors.New("model not found")
+	ErrModelInvalid    = errors.New("invalid model file")
+	ErrOutOfMemory     = errors.New("out of memory")
+	ErrContextOverflow = errors.New("context overflow")
+	ErrTokenize        = errors.New("tokenization failed")
+)
+
+var codeErrors = map[C.int]error{
+	C.LLAMA_CORE_ERR_ARGS:             ErrInvalidArgs,
+	C.LLAMA_CORE_ERR_NOT_STARTED:      ErrNotStarted,
+	C.LLAMA_CORE_ERR_LOAD:             ErrLoadFailed,
+	C.LLAMA_CORE_ERR_STOPPED:          ErrStopped,
+	C.LLAMA_CORE_ERR_RUN:              ErrRunFailed,
+	C.LLAMA_CORE_ERR_MODEL_NOT_FOUND:  ErrModelNotFound,
+	C.LLAMA_CORE_ERR_MODEL_INVALID:    ErrModelInvalid,
+	C.LLAMA_CORE_ERR_OUT_OF_MEMORY:    ErrOutOfMemory,
+	C.LLAMA_CORE_ERR_CONTEXT_OVERFLOW: ErrContextOverflow,
+	C.LLAMA_CORE_ERR_TOKENIZE:         ErrTokenize,
+}
+
+// Error is the failure of a call to the core library. Message is the reason
+// given by llama.cpp, Unwrap returns the Err* value of its code.
+type Error struct {
+	Op      string
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	if len(e.Message) <= 0 {
+		return fmt.Sprintf("%s: %v", e.Op, e.Unwrap())
+	}
+	return fmt.Sprintf("%s: %s", e.Op, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	if err, ok := codeErrors[C.int(e.Code)]; ok {
+		return err
+	}
+	return ErrRunFailed
+}
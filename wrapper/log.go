@@ -0,0 +1,43 @@
+package wrapper
+
+/*
+#include "../core/include/core_types.h"
+
+extern void goLogCallback(int level, char *text);
+*/
+import "C"
+import (
+	"github.com/ethereum/go-ethereum/log"
+	"log/slog"
+	"unsafe"
+)
+
+//export goLogCallback
+func goLogCallback(level C.int, text *C.char) {
+	msg := C.GoString(text)
+	switch level {
+	case C.LLAMA_CORE_LOG_ERROR:
+		log.Error(msg)
+	case C.LLAMA_CORE_LOG_WARN:
+		log.Warn(msg)
+	case C.LLAMA_CORE_LOG_INFO:
+		log.Info(msg)
+	default:
+		log.Debug(msg)
+	}
+}
+
+// LlamaLogSet sends the logs of llama.cpp and of the runners from level up to
+// the default logger
+func LlamaLogSet(level slog.Level) {
+	clevel := C.LLAMA_CORE_LOG_INFO
+	switch {
+	case level <= slog.LevelDebug:
+		clevel = C.LLAMA_CORE_LOG_DEBUG
+	case level >= slog.LevelError:
+		clevel = C.LLAMA_CORE_LOG_ERROR
+	case level >= slog.LevelWarn:
+		clevel = C.LLAMA_CORE_LOG_WARN
+	}
+	C.llama_core_log_set((C.llama_core_log_callback)(unsafe.Pointer(C.goLogCallback)), C.int(clevel))
+}
@@ -8,6 +8,7 @@ import "C"
 import (
 	"fmt"
 	"runtime"
+	"strconv"
 	"unsafe"
 
 	"github.com/Qitmeer/llama.go/config"
@@ -25,25 +26,30 @@ func LoadFromMemory(modelData []byte, cfg *config.Config) error {
 	defer pin.Unpin()
 
 	// Build configuration arguments
-	args := buildConfigArgs(cfg)
-	cargs := C.CString(args)
-	defer C.free(unsafe.Pointer(cargs))
+	args, err := buildConfigArgs(cfg)
+	if err != nil {
+		return err
+	}
+	cargs := newCArgs(args)
+	defer freeCArgs(cargs)
 
 	// Initial prompt
 	cprompt := C.CString(cfg.Prompt)
 	defer C.free(unsafe.Pointer(cprompt))
 
 	// Call the C function to load from memory
+	var cerr C.struct_llama_core_error
 	ret := C.llama_start_from_memory(
 		unsafe.Pointer(&modelData[0]),
 		C.size_t(len(modelData)),
 		cargs,
 		C.int(0), // async = false
 		cprompt,
+		&cerr,
 	)
 
 	if ret != 0 {
-		return fmt.Errorf("failed to load model from memory")
+		return coreError("failed to load model from memory", &cerr)
 	}
 
 	return nil
@@ -56,78 +62,88 @@ func LoadFromMmap(addr uintptr, data []byte, cfg *config.Config) error {
 	}
 
 	// Build configuration arguments
-	args := buildConfigArgs(cfg)
-	cargs := C.CString(args)
-	defer C.free(unsafe.Pointer(cargs))
+	args, err := buildConfigArgs(cfg)
+	if err != nil {
+		return err
+	}
+	cargs := newCArgs(args)
+	defer freeCArgs(cargs)
 
 	// Initial prompt
 	cprompt := C.CString(cfg.Prompt)
 	defer C.free(unsafe.Pointer(cprompt))
 
 	// Call the C function to load from mmap
+	var cerr C.struct_llama_core_error
 	ret := C.llama_start_from_mmap(
 		unsafe.Pointer(addr),
 		C.size_t(len(data)),
 		cargs,
 		C.int(0), // async = false
 		cprompt,
+		&cerr,
 	)
 
 	if ret != 0 {
-		return fmt.Errorf("failed to load model from mmap")
+		return coreError("failed to load model from mmap", &cerr)
 	}
 
 	return nil
 }
 
-// buildConfigArgs builds configuration arguments string for C++ side
-func buildConfigArgs(cfg *config.Config) string {
-	args := ""
+// buildConfigArgs builds the command line for C++ side, the llama.cpp
+// options of --llama-args come last
+func buildConfigArgs(cfg *config.Config) ([]string, error) {
+	args := []string{program}
 
 	// Model path (for reference, not actually used in memory loading)
 	if cfg.Model != "" {
-		args += fmt.Sprintf(" --model %s", cfg.Model)
+		args = append(args, "--model", cfg.Model)
 	}
 
 	// Context size
 	if cfg.CtxSize > 0 {
-		args += fmt.Sprintf(" --ctx-size %d", cfg.CtxSize)
+		args = append(args, "--ctx-size", strconv.Itoa(cfg.CtxSize))
 	}
 
-	// GPU layers
-	if cfg.NGpuLayers > 0 {
-		args += fmt.Sprintf(" --n-gpu-layers %d", cfg.NGpuLayers)
+	// GPU layers, -1 keeps the default and 0 runs on the CPU
+	if cfg.NGpuLayers >= 0 {
+		args = append(args, "--n-gpu-layers", strconv.Itoa(cfg.NGpuLayers))
 	}
 
 	// Number of predictions
 	if cfg.NPredict > 0 {
-		args += fmt.Sprintf(" --n-predict %d", cfg.NPredict)
+		args = append(args, "--n-predict", strconv.Itoa(cfg.NPredict))
 	}
 
 	// Seed
 	if cfg.Seed > 0 {
-		args += fmt.Sprintf(" --seed %d", cfg.Seed)
+		args = append(args, "--seed", strconv.FormatUint(uint64(cfg.Seed), 10))
 	}
 
 	// Batch size
 	if cfg.BatchSize > 0 {
-		args += fmt.Sprintf(" --batch-size %d", cfg.BatchSize)
+		args = append(args, "--batch-size", strconv.Itoa(cfg.BatchSize))
 	}
 
 	// Ubatch size
 	if cfg.UBatchSize > 0 {
-		args += fmt.Sprintf(" --ubatch-size %d", cfg.UBatchSize)
+		args = append(args, "--ubatch-size", strconv.Itoa(cfg.UBatchSize))
 	}
 
 	// Pooling type for embeddings
 	if cfg.Pooling != "" {
-		args += fmt.Sprintf(" --pooling %s", cfg.Pooling)
+		args = append(args, "--pooling", cfg.Pooling)
 	}
 
 	// Interactive mode
 	if cfg.Interactive {
-		args += " --interactive"
+		args = append(args, "--interactive")
 	}
 
-	return args
+	extra, err := SplitArgs(cfg.LlamaArgs)
+	if err != nil {
+		return nil, fmt.Errorf("llama-args: %w", err)
+	}
+	return append(args, extra...), nil
 }
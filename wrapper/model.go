@@ -0,0 +1,186 @@
+package wrapper
+
+/*
+#include "../core/include/process.h"
+#include "../core/include/embedding.h"
+#include <stdint.h>
+#include <stdlib.h>
+
+extern int goTokenCallback(char *piece, void *user_data);
+*/
+import "C"
+import (
+	"fmt"
+	"github.com/ollama/ollama/api"
+	"runtime/cgo"
+	"unsafe"
+)
+
+// TokenFunc receives the text of every generated token, returning false
+// stops the generation
+type TokenFunc func(piece string) bool
+
+//export goTokenCallback
+func goTokenCallback(piece *C.char, userData unsafe.Pointer) C.int {
+	h := cgo.Handle(*(*C.uintptr_t)(userData))
+	if !h.Value().(TokenFunc)(C.GoString(piece)) {
+		return 1
+	}
+	return 0
+}
+
+// tokenCallback holds onToken for the runner thread, release it with free
+type tokenCallback struct {
+	fn   C.llama_token_callback
+	data unsafe.Pointer
+}
+
+func newTokenCallback(onToken TokenFunc) *tokenCallback {
+	if onToken == nil {
+		return &tokenCallback{}
+	}
+	// the handle is passed through C memory, the runner only sees a pointer
+	data := C.malloc(C.size_t(unsafe.Sizeof(C.uintptr_t(0))))
+	*(*C.uintptr_t)(data) = C.uintptr_t(cgo.NewHandle(onToken))
+	return &tokenCallback{
+		fn:   (C.llama_token_callback)(unsafe.Pointer(C.goTokenCallback)),
+		data: data,
+	}
+}
+
+func (t *tokenCallback) free() {
+	if t.data == nil {
+		return
+	}
+	cgo.Handle(*(*C.uintptr_t)(t.data)).Delete()
+	C.free(t.data)
+}
+
+// Model is loaded once and shared by the runners created with NewRunner,
+// each of them has its own context
+type Model struct {
+	h unsafe.Pointer
+}
+
+// LoadModel loads the model of the command line, only its model options are used
+func LoadModel(args []string) (*Model, error) {
+	ca := newCArgs(args)
+	defer freeCArgs(ca)
+
+	var cerr C.struct_llama_core_error
+	h := C.llama_core_model_load(ca, &cerr)
+	if h == nil {
+		return nil, coreError("Llama load model error", &cerr)
+	}
+	return &Model{h: h}, nil
+}
+
+// LoadModelFromMemory loads a model from a buffer that must stay valid and
+// in place until the model is freed, mmap tells that it is a mapped file
+func LoadModelFromMemory(data unsafe.Pointer, size int, mmap bool, args []string) (*Model, error) {
+	ca := newCArgs(args)
+	defer freeCArgs(ca)
+
+	var cerr C.struct_llama_core_error
+	h := C.llama_core_model_load_from_memory(data, C.size_t(size), cbool(mmap), ca, &cerr)
+	if h == nil {
+		return nil, coreError("Llama load model error", &cerr)
+	}
+	return &Model{h: h}, nil
+}
+
+// Free releases the model, the weights are freed with the last of its runners
+func (m *Model) Free() {
+	C.llama_core_model_free(m.h)
+}
+
+// NewRunner creates a runner of the model, Start creates its context
+func (m *Model) NewRunner(args []string) *Runner {
+	ca := newCArgs(args)
+	defer freeCArgs(ca)
+
+	ip := C.CString("")
+	defer C.free(unsafe.Pointer(ip))
+
+	return &Runner{h: C.llama_runner_new_with_model(m.h, ca, 1, ip)}
+}
+
+// Embedding computes the embeddings of prompts, split by the --embd-separator
+// of args, with a context of its own
+func (m *Model) Embedding(args []string, prompts string) (string, error) {
+	if len(prompts) <= 0 {
+		return "", fmt.Errorf("No prompt")
+	}
+	ca := newCArgs(args)
+	defer freeCArgs(ca)
+
+	ip := C.CString(prompts)
+	defer C.free(unsafe.Pointer(ip))
+
+	var result *C.char
+	var cerr C.struct_llama_core_error
+	ret := C.llama_core_model_embedding(m.h, ca, ip, &result, &cerr)
+	if ret != 0 {
+		return "", coreError("llama_embedding run error", &cerr)
+	}
+	return goString(result), nil
+}
+
+// Reset makes the next request of the runner start from an empty context
+func (r *Runner) Reset() {
+	C.llama_runner_reset(r.h)
+}
+
+// Generate runs the prompt on the runner, onToken may be nil
+func (r *Runner) Generate(prompt string, onToken TokenFunc) (string, *GenStats, error) {
+	if len(prompt) <= 0 {
+		return "", nil, fmt.Errorf("No prompt")
+	}
+	ip := C.CString(prompt)
+	defer C.free(unsafe.Pointer(ip))
+
+	cb := newTokenCallback(onToken)
+	defer cb.free()
+
+	var result *C.char
+	var stats C.struct_llama_gen_stats
+	var cerr C.struct_llama_core_error
+	ret := C.llama_runner_gen(r.h, ip, cb.fn, cb.data, &result, &stats, &cerr)
+	if ret != 0 {
+		return "", nil, coreError("Llama run error", &cerr)
+	}
+	return goString(result), newGenStats(&stats), nil
+}
+
+// Chat sends the messages to the runner, onToken may be nil
+func (r *Runner) Chat(msgs []api.Message, onToken TokenFunc) (string, *GenStats, error) {
+	size := len(msgs)
+	if size <= 0 {
+		return "", nil, fmt.Errorf("No messages for chat")
+	}
+	roles := make([]*C.char, size)
+	contents := make([]*C.char, size)
+
+	for i, m := range msgs {
+		roles[i] = C.CString(m.Role)
+		defer C.free(unsafe.Pointer(roles[i]))
+
+		contents[i] = C.CString(m.Content)
+		defer C.free(unsafe.Pointer(contents[i]))
+	}
+
+	rolesPtr := (**C.char)(unsafe.Pointer(&roles[0]))
+	contentsPtr := (**C.char)(unsafe.Pointer(&contents[0]))
+
+	cb := newTokenCallback(onToken)
+	defer cb.free()
+
+	var result *C.char
+	var stats C.struct_llama_gen_stats
+	var cerr C.struct_llama_core_error
+	ret := C.llama_runner_chat(r.h, rolesPtr, contentsPtr, C.int(size), cb.fn, cb.data, &result, &stats, &cerr)
+	if ret != 0 {
+		return "", nil, coreError("Llama run error", &cerr)
+	}
+	return goString(result), newGenStats(&stats), nil
+}
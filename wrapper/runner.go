@@ -0,0 +1,222 @@
+package wrapper
+
+/*
+#include "../core/include/process.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"fmt"
+	"github.com/Qitmeer/llama.go/config"
+	"github.com/ollama/ollama/api"
+	"slices"
+	"time"
+	"unsafe"
+)
+
+// GenStats are the token counts and timings of one generation
+type GenStats struct {
+	PromptTokens    int
+	GeneratedTokens int
+	// QueueDuration is the time spent waiting for the runner
+	QueueDuration time.Duration
+	// FirstTokenDuration and TotalDuration are measured from the moment
+	// the runner picked up the request
+	FirstTokenDuration time.Duration
+	TotalDuration      time.Duration
+}
+
+// TokensPerSecond is the generation speed after the first token
+func (s *GenStats) TokensPerSecond() float64 {
+	d := s.TotalDuration - s.FirstTokenDuration
+	if s.GeneratedTokens <= 1 || d <= 0 {
+		return 0
+	}
+	return float64(s.GeneratedTokens-1) / d.Seconds()
+}
+
+func newGenStats(st *C.struct_llama_gen_stats) *GenStats {
+	return &GenStats{
+		PromptTokens:       int(st.n_prompt),
+		GeneratedTokens:    int(st.n_gen),
+		QueueDuration:      msDuration(st.t_queue_ms),
+		FirstTokenDuration: msDuration(st.t_first_ms),
+		TotalDuration:      msDuration(st.t_total_ms),
+	}
+}
+
+// Status describes the state of the running model
+type Status struct {
+	Running    bool
+	Ready      bool
+	Busy       bool
+	QueueDepth int
+	CtxSize    int
+	NPast      int
+
+	PromptTokensTotal    uint64
+	GeneratedTokensTotal uint64
+	LoadDuration         time.Duration
+	LoadedAt             time.Time
+
+	// Seed is the seed of the sampler, the drawn one when it was random
+	Seed     uint32
+	Sampling Sampling
+}
+
+// Sampling are the main sampling parameters of a runner
+type Sampling struct {
+	Temperature   float32 `json:"temperature"`
+	TopK          int     `json:"top_k"`
+	TopP          float32 `json:"top_p"`
+	MinP          float32 `json:"min_p"`
+	RepeatPenalty float32 `json:"repeat_penalty"`
+}
+
+// LlamaStatus returns the state of the running model
+func LlamaStatus() Status {
+	var st C.struct_llama_runner_status
+	C.llama_status(&st)
+	return newStatus(&st)
+}
+
+func newStatus(st *C.struct_llama_runner_status) Status {
+	status := Status{
+		Running:              st.running != 0,
+		Ready:                st.ready != 0,
+		Busy:                 st.busy != 0,
+		QueueDepth:           int(st.queue_depth),
+		CtxSize:              int(st.n_ctx),
+		NPast:                int(st.n_past),
+		PromptTokensTotal:    uint64(st.n_prompt_total),
+		GeneratedTokensTotal: uint64(st.n_gen_total),
+		LoadDuration:         msDuration(st.t_load_ms),
+		Seed:                 uint32(st.seed),
+		Sampling: Sampling{
+			Temperature:   float32(st.temp),
+			TopK:          int(st.top_k),
+			TopP:          float32(st.top_p),
+			MinP:          float32(st.min_p),
+			RepeatPenalty: float32(st.repeat_penalty),
+		},
+	}
+	if st.t_loaded_unix_ms > 0 {
+		status.LoadedAt = time.UnixMilli(int64(st.t_loaded_unix_ms))
+	}
+	return status
+}
+
+// exitArgs make llama.cpp print something and exit the process
+var exitArgs = []string{"-h", "--help", "--usage", "--version", "--completion-bash", "--list-devices"}
+
+// LlamaCheckArgs rejects the runner arguments llama.cpp would not accept, so
+// unknown options fail at startup instead of when the model loads
+func LlamaCheckArgs(cfg *config.Config) error {
+	args, err := startArgs(cfg)
+	if err != nil {
+		return err
+	}
+	for _, a := range args {
+		if slices.Contains(exitArgs, a) {
+			return fmt.Errorf("llama-args: %s is not supported", a)
+		}
+	}
+	ca := newCArgs(args)
+	defer freeCArgs(ca)
+
+	var cerr C.struct_llama_core_error
+	if C.llama_check_args(ca, &cerr) != 0 {
+		return fmt.Errorf("llama-args: invalid llama.cpp options '%s', see the error above: %w", cfg.LlamaArgs, coreError("Llama check args error", &cerr))
+	}
+	return nil
+}
+
+// Runner is a model runner created next to the current one, it serves
+// LlamaGenerate and LlamaChat once swapped in with SwapRunner
+type Runner struct {
+	h unsafe.Pointer
+}
+
+// NewRunner creates a runner for the model of the config, Start loads it
+func NewRunner(cfg *config.Config) (*Runner, error) {
+	if len(cfg.Model) <= 0 {
+		return nil, fmt.Errorf("No model")
+	}
+	args, err := startArgs(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ca := newCArgs(args)
+	defer freeCArgs(ca)
+
+	ip := C.CString(cfg.Prompt)
+	defer C.free(unsafe.Pointer(ip))
+
+	return &Runner{h: C.llama_runner_new(ca, 1, ip)}, nil
+}
+
+// Start loads the model and processes requests, it blocks until the runner is stopped
+func (r *Runner) Start() error {
+	var cerr C.struct_llama_core_error
+	ret := C.llama_runner_start(r.h, &cerr)
+	if ret != 0 {
+		return coreError("Llama start error", &cerr)
+	}
+	return nil
+}
+
+// Status returns the state of the runner
+func (r *Runner) Status() Status {
+	var st C.struct_llama_runner_status
+	C.llama_runner_get_status(r.h, &st)
+	return newStatus(&st)
+}
+
+// Free waits for the requests the runner already took, stops and frees it
+func (r *Runner) Free() {
+	C.llama_runner_free(r.h)
+}
+
+// SwapRunner makes r the current runner and returns the previous one, nil if none
+func SwapRunner(r *Runner) *Runner {
+	prev := C.llama_runner_swap(r.h)
+	if prev == nil {
+		return nil
+	}
+	return &Runner{h: prev}
+}
+
+func msDuration(ms C.double) time.Duration {
+	return time.Duration(float64(ms) * float64(time.Millisecond))
+}
+
+// LlamaRender returns the prompt and its token count that the running model
+// would be fed for the messages, without generating anything.
+func LlamaRender(msgs []api.Message) (string, int, error) {
+	size := len(msgs)
+	if size <= 0 {
+		return "", 0, fmt.Errorf("No messages for render")
+	}
+	roles := make([]*C.char, size)
+	contents := make([]*C.char, size)
+
+	for i, m := range msgs {
+		roles[i] = C.CString(m.Role)
+		defer C.free(unsafe.Pointer(roles[i]))
+
+		contents[i] = C.CString(m.Content)
+		defer C.free(unsafe.Pointer(contents[i]))
+	}
+
+	rolesPtr := (**C.char)(unsafe.Pointer(&roles[0]))
+	contentsPtr := (**C.char)(unsafe.Pointer(&contents[0]))
+
+	var result *C.char
+	var nTokens C.int
+	var cerr C.struct_llama_core_error
+	ret := C.llama_render(rolesPtr, contentsPtr, C.int(size), &result, &nTokens, &cerr)
+	if ret != 0 {
+		return "", 0, coreError("Llama render error", &cerr)
+	}
+	return goString(result), int(nTokens), nil
+}
@@ -0,0 +1,90 @@
+package wrapper
+
+/*
+#include "../core/include/tokenize.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"fmt"
+	"unsafe"
+)
+
+// LlamaVocabLoad loads only the vocabulary of a model, which is enough to
+// tokenize without a running model.
+func LlamaVocabLoad(model string) error {
+	if len(model) <= 0 {
+		return fmt.Errorf("No model")
+	}
+	cm := C.CString(model)
+	defer C.free(unsafe.Pointer(cm))
+
+	var cerr C.struct_llama_core_error
+	ret := C.llama_vocab_only_load(cm, &cerr)
+	if ret != 0 {
+		return coreError("Llama vocab load error", &cerr)
+	}
+	return nil
+}
+
+// LlamaVocabFree releases the vocabulary loaded by LlamaVocabLoad
+func LlamaVocabFree() {
+	C.llama_vocab_only_free()
+}
+
+// LlamaTokenize converts text into token ids of the loaded vocabulary
+func LlamaTokenize(text string, addSpecial bool, parseSpecial bool) ([]int, error) {
+	ct := C.CString(text)
+	defer C.free(unsafe.Pointer(ct))
+
+	var ctokens *C.int
+	var cerr C.struct_llama_core_error
+	n := C.llama_text_tokenize(ct, cbool(addSpecial), cbool(parseSpecial), &ctokens, &cerr)
+	if n < 0 {
+		return nil, coreError("Llama tokenize error", &cerr)
+	}
+	tokens := make([]int, int(n))
+	if n == 0 {
+		return tokens, nil
+	}
+	defer C.llama_core_free(unsafe.Pointer(ctokens))
+
+	for i, t := range unsafe.Slice(ctokens, int(n)) {
+		tokens[i] = int(t)
+	}
+	return tokens, nil
+}
+
+// LlamaDetokenize converts token ids back into text
+func LlamaDetokenize(tokens []int, special bool) (string, error) {
+	if len(tokens) == 0 {
+		return "", nil
+	}
+	ctokens := make([]C.int, len(tokens))
+	for i, t := range tokens {
+		ctokens[i] = C.int(t)
+	}
+	var cerr C.struct_llama_core_error
+	ret := C.llama_text_detokenize(&ctokens[0], C.int(len(ctokens)), cbool(special), &cerr)
+	if ret == nil {
+		return "", coreError("Llama detokenize error", &cerr)
+	}
+	return goString(ret), nil
+}
+
+// LlamaTokenPiece returns the text piece of a single token
+func LlamaTokenPiece(token int, special bool) (string, error) {
+	var cerr C.struct_llama_core_error
+	ret := C.llama_token_piece(C.int(token), cbool(special), &cerr)
+	if ret == nil {
+		return "", coreError("Llama token piece error", &cerr)
+	}
+	return goString(ret), nil
+}
+
+func cbool(b bool) C.int {
+	if b {
+		return 1
+	}
+	return 0
+}